@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	defaultServerSocket = "/var/run/cniserver.sock"
+	defaultBridge       = "cni0"
+)
+
+// supportedVersions 支持的 CNI 规范版本, CHECK 命令从 0.4.0 开始才有.
+var supportedVersions = []string{"0.3.0", "0.3.1", "0.4.0", "1.0.0"}
+
+// NetConf 从 stdin 读取的网络配置, 如
+//
+//	{
+//	  "cniVersion": "0.3.1",
+//	  "name": "ipkeeper",
+//	  "type": "ipkeeper-cni",
+//	  "server_socket": "/var/run/cniserver.sock",
+//	  "bridge": "cni0",
+//	  "fallback": {"type": "bridge", "bridge": "cni0", "ipam": {"type": "host-local", "subnet": "10.244.1.0/24"}}
+//	}
+type NetConf struct {
+	CNIVersion string `json:"cniVersion"`
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	// ServerSocket cni server 监听的 unix socket, 见 cmd/main.go 的 --bind-socket 参数.
+	ServerSocket string `json:"server_socket"`
+	// Bridge 宿主机端 veth 接入的网桥.
+	Bridge string `json:"bridge"`
+	// Fallback 没有声明 IP 池的 Pod(cni server 返回 DoNothing)交给这个插件处理, 不指定时这类 Pod 会创建失败.
+	// 其中的 cniVersion 与 name 未指定时继承外层的值.
+	Fallback map[string]interface{} `json:"fallback,omitempty"`
+	// RawPrevResult CHECK 与 DEL 时由运行时传入的上一次 ADD 的结果.
+	RawPrevResult map[string]interface{} `json:"prevResult,omitempty"`
+}
+
+// loadNetConf 解析 stdin 中的网络配置并填充默认值.
+func loadNetConf(stdin []byte) (conf *NetConf, err error) {
+	conf = &NetConf{}
+	if err = json.Unmarshal(stdin, conf); err != nil {
+		return nil, newError(errDecodingFailure, "failed to parse network configuration", err)
+	}
+	if conf.CNIVersion == "" {
+		conf.CNIVersion = "0.3.0"
+	}
+	if !versionSupported(conf.CNIVersion) {
+		return nil, newError(
+			errIncompatibleVersion, "incompatible CNI versions",
+			fmt.Errorf("config is %s, plugin supports %s", conf.CNIVersion, strings.Join(supportedVersions, ", ")),
+		)
+	}
+	if conf.ServerSocket == "" {
+		conf.ServerSocket = defaultServerSocket
+	}
+	if conf.Bridge == "" {
+		conf.Bridge = defaultBridge
+	}
+	if conf.Fallback != nil {
+		if _, ok := conf.Fallback["type"].(string); !ok {
+			return nil, newError(errInvalidNetworkConfig, "fallback plugin must have a type", nil)
+		}
+		if _, ok := conf.Fallback["cniVersion"]; !ok {
+			conf.Fallback["cniVersion"] = conf.CNIVersion
+		}
+		if _, ok := conf.Fallback["name"]; !ok {
+			conf.Fallback["name"] = conf.Name
+		}
+	}
+	return
+}
+
+func versionSupported(version string) bool {
+	for _, v := range supportedVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// CmdArgs 运行时通过环境变量传入的参数.
+type CmdArgs struct {
+	Command     string
+	ContainerID string
+	Netns       string
+	IfName      string
+	// Path 查找 fallback 插件的目录列表
+	Path []string
+
+	PodName      string
+	PodNamespace string
+	PodUID       string
+}
+
+// loadArgs 读取 CNI_* 环境变量, kubelet 在 CNI_ARGS 中传入 Pod 的名称, 命名空间与 UID,
+// 格式如 "IgnoreUnknown=1;K8S_POD_NAMESPACE=default;K8S_POD_NAME=test;K8S_POD_UID=xxx".
+func loadArgs() (args *CmdArgs, err error) {
+	args = &CmdArgs{
+		Command:     os.Getenv("CNI_COMMAND"),
+		ContainerID: os.Getenv("CNI_CONTAINERID"),
+		Netns:       os.Getenv("CNI_NETNS"),
+		IfName:      os.Getenv("CNI_IFNAME"),
+	}
+	if cniPath := os.Getenv("CNI_PATH"); cniPath != "" {
+		args.Path = strings.Split(cniPath, string(os.PathListSeparator))
+	}
+	for _, pair := range strings.Split(os.Getenv("CNI_ARGS"), ";") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "K8S_POD_NAME":
+			args.PodName = kv[1]
+		case "K8S_POD_NAMESPACE":
+			args.PodNamespace = kv[1]
+		case "K8S_POD_UID":
+			args.PodUID = kv[1]
+		}
+	}
+
+	// VERSION 不需要其他参数, DEL 时 netns 可能已经不存在.
+	required := map[string]string{}
+	switch args.Command {
+	case "ADD", "CHECK":
+		required = map[string]string{
+			"CNI_CONTAINERID": args.ContainerID, "CNI_NETNS": args.Netns, "CNI_IFNAME": args.IfName,
+			"K8S_POD_NAME": args.PodName, "K8S_POD_NAMESPACE": args.PodNamespace,
+		}
+	case "DEL":
+		required = map[string]string{"CNI_CONTAINERID": args.ContainerID, "CNI_IFNAME": args.IfName}
+	}
+	for key, val := range required {
+		if val == "" {
+			return nil, newError(errInvalidEnvironmentVariables, fmt.Sprintf("%s is required", key), nil)
+		}
+	}
+	return
+}
@@ -0,0 +1,255 @@
+// ipkeeper-cni 由 kubelet 调用的 CNI 插件, 本身不做任何网络配置,
+// 而是将请求通过 unix socket 转发给节点上的 cni server(见 pkg/server), 再将结果按 CNI 规范输出.
+// 没有声明 IP 池的 Pod 可以交给配置中的 fallback 插件处理.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+
+	"github.com/generals-space/crd-ipkeeper/pkg/restapi"
+)
+
+func main() {
+	err := run()
+	if err == nil {
+		return
+	}
+	cniErr, ok := err.(*Error)
+	if !ok {
+		cniErr = newError(errIOFailure, err.Error(), nil)
+	}
+	if cniErr.CNIVersion == "" {
+		cniErr.CNIVersion = supportedVersions[len(supportedVersions)-1]
+	}
+	printJSON(cniErr)
+	os.Exit(1)
+}
+
+func run() (err error) {
+	args, err := loadArgs()
+	if err != nil {
+		return
+	}
+	if args.Command == "VERSION" {
+		return printJSON(map[string]interface{}{
+			"cniVersion":        supportedVersions[len(supportedVersions)-1],
+			"supportedVersions": supportedVersions,
+		})
+	}
+	stdin, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return newError(errIOFailure, "failed to read network configuration", err)
+	}
+	conf, err := loadNetConf(stdin)
+	if err != nil {
+		return
+	}
+	switch args.Command {
+	case "ADD":
+		err = cmdAdd(conf, args)
+	case "DEL":
+		err = cmdDel(conf, args)
+	case "CHECK":
+		err = cmdCheck(conf, args)
+	default:
+		err = newError(errInvalidEnvironmentVariables, fmt.Sprintf("unknown CNI_COMMAND %s", args.Command), nil)
+	}
+	if cniErr, ok := err.(*Error); ok && cniErr.CNIVersion == "" {
+		cniErr.CNIVersion = conf.CNIVersion
+	}
+	return
+}
+
+func newPodRequest(conf *NetConf, args *CmdArgs) *restapi.PodRequest {
+	return &restapi.PodRequest{
+		PodName:      args.PodName,
+		PodNamespace: args.PodNamespace,
+		PodUID:       args.PodUID,
+		ContainerID:  args.ContainerID,
+		NetNs:        args.Netns,
+		CNI0:         conf.Bridge,
+	}
+}
+
+// containerIfName cni server 总是将容器内的网卡命名为 eth0, 见 pkg/server/setip.go 中的 setContainerVeth().
+const containerIfName = "eth0"
+
+// checkIfName 不支持 eth0 以外的网卡(如 Multus 的附加网络), 否则 server 配置的网卡与 result 不一致.
+func checkIfName(args *CmdArgs) error {
+	if args.IfName == containerIfName {
+		return nil
+	}
+	return newError(
+		errInvalidEnvironmentVariables,
+		fmt.Sprintf("ipkeeper-cni only configures %s, got CNI_IFNAME %s", containerIfName, args.IfName), nil,
+	)
+}
+
+// cmdAdd 向 cni server 申请 IP, server 会创建 veth 并完成容器内的配置.
+func cmdAdd(conf *NetConf, args *CmdArgs) (err error) {
+	if err = checkIfName(args); err != nil {
+		return
+	}
+	client := restapi.NewCNIServerClient(conf.ServerSocket)
+	resp, err := client.Add(newPodRequest(conf, args))
+	if err != nil {
+		return newError(errTryAgainLater, "failed to request ip from cni server", err)
+	}
+	if resp.DoNothing {
+		if conf.Fallback == nil {
+			return newError(
+				errNoStaticIP, fmt.Sprintf("pod %s/%s has no ip pool", args.PodNamespace, args.PodName),
+				fmt.Errorf("no fallback plugin is configured"),
+			)
+		}
+		return delegate(conf, args)
+	}
+	result, err := newResult(conf, args, resp)
+	if err != nil {
+		return
+	}
+	return printJSON(result)
+}
+
+// cmdDel 通知 cni server 释放 IP 并删除宿主机端的 veth, server 的处理是幂等的.
+// Pod 可能是由 fallback 插件处理的, 所以同样需要交给它清理.
+func cmdDel(conf *NetConf, args *CmdArgs) (err error) {
+	// ADD 时已经拒绝了其他网卡, 没有需要清理的, 也不能释放 eth0 的 IP.
+	if checkIfName(args) != nil {
+		return nil
+	}
+	// 规范允许 DEL 时缺少部分参数, 此时 IP 由 controller 在 Pod 删除时释放.
+	if args.PodName != "" && args.PodNamespace != "" {
+		client := restapi.NewCNIServerClient(conf.ServerSocket)
+		err = client.Del(newPodRequest(conf, args))
+		if err != nil {
+			return newError(errTryAgainLater, "failed to release ip from cni server", err)
+		}
+	}
+	if conf.Fallback != nil {
+		return delegate(conf, args)
+	}
+	return nil
+}
+
+// cmdCheck 检查容器内的网卡上是否仍有上一次 ADD 时分配的地址,
+// 检查不通过且配置了 fallback 插件时, 说明该 Pod 可能是由 fallback 插件处理的, 交给它检查.
+func cmdCheck(conf *NetConf, args *CmdArgs) (err error) {
+	if conf.CNIVersion == "0.3.0" || conf.CNIVersion == "0.3.1" {
+		return newError(errIncompatibleVersion, "CHECK is not supported before 0.4.0", nil)
+	}
+	if err = checkIfName(args); err != nil {
+		return
+	}
+	if conf.RawPrevResult == nil {
+		return newError(errInvalidNetworkConfig, "prevResult is required by CHECK", nil)
+	}
+	err = checkAddresses(conf, args)
+	if err != nil && conf.Fallback != nil {
+		return delegate(conf, args)
+	}
+	return
+}
+
+// checkAddresses 确认 prevResult 中的每个地址都在容器的网卡上.
+func checkAddresses(conf *NetConf, args *CmdArgs) (err error) {
+	data, err := json.Marshal(conf.RawPrevResult)
+	if err != nil {
+		return newError(errDecodingFailure, "failed to parse prevResult", err)
+	}
+	prevResult := &Result{}
+	if err = json.Unmarshal(data, prevResult); err != nil {
+		return newError(errDecodingFailure, "failed to parse prevResult", err)
+	}
+	if len(prevResult.IPs) == 0 {
+		return newError(errInvalidNetworkConfig, "prevResult has no ip", nil)
+	}
+	return ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(args.IfName)
+		if err != nil {
+			return newError(errInvalidNetworkConfig, fmt.Sprintf("can not find %s in container", args.IfName), err)
+		}
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return newError(errIOFailure, fmt.Sprintf("failed to list addresses of %s", args.IfName), err)
+		}
+		for _, ipConf := range prevResult.IPs {
+			ip, _, err := net.ParseCIDR(ipConf.Address)
+			if err != nil {
+				return newError(errDecodingFailure, "prevResult has an invalid address", err)
+			}
+			found := false
+			for _, addr := range addrs {
+				if addr.IP.Equal(ip) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return newError(
+					errInvalidNetworkConfig, fmt.Sprintf("%s is missing on %s", ipConf.Address, args.IfName), nil,
+				)
+			}
+		}
+		return nil
+	})
+}
+
+// delegate 以相同的环境变量调用 fallback 插件, 并将其输出原样转发到 stdout.
+func delegate(conf *NetConf, args *CmdArgs) (err error) {
+	pluginType := conf.Fallback["type"].(string)
+	fallback := map[string]interface{}{}
+	for key, val := range conf.Fallback {
+		fallback[key] = val
+	}
+	// CHECK 与 DEL 时需要把 prevResult 一并传给 fallback 插件.
+	if conf.RawPrevResult != nil {
+		fallback["prevResult"] = conf.RawPrevResult
+	}
+	stdin, err := json.Marshal(fallback)
+	if err != nil {
+		return newError(errInvalidNetworkConfig, "failed to encode fallback configuration", err)
+	}
+	pluginPath, err := findPlugin(pluginType, args.Path)
+	if err != nil {
+		return
+	}
+	stdout := &bytes.Buffer{}
+	cmd := exec.Command(pluginPath)
+	cmd.Env = os.Environ()
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = stdout
+	cmd.Stderr = os.Stderr
+	runErr := cmd.Run()
+	if runErr != nil {
+		// 插件失败时 stdout 中是规范格式的错误, 原样返回.
+		cniErr := &Error{}
+		if json.Unmarshal(stdout.Bytes(), cniErr) == nil && cniErr.Msg != "" {
+			return cniErr
+		}
+		return newError(errIOFailure, fmt.Sprintf("fallback plugin %s failed", pluginType), runErr)
+	}
+	_, err = os.Stdout.Write(stdout.Bytes())
+	return
+}
+
+// findPlugin 在 CNI_PATH 中查找名为 pluginType 的插件.
+func findPlugin(pluginType string, paths []string) (string, error) {
+	for _, dir := range paths {
+		pluginPath := filepath.Join(dir, pluginType)
+		if info, err := os.Stat(pluginPath); err == nil && !info.IsDir() {
+			return pluginPath, nil
+		}
+	}
+	return "", newError(errInvalidNetworkConfig, fmt.Sprintf("fallback plugin %s not found in CNI_PATH", pluginType), nil)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+
+	"github.com/generals-space/crd-ipkeeper/pkg/restapi"
+)
+
+// CNI 规范中定义的错误码, 见 https://github.com/containernetworking/cni/blob/main/SPEC.md#error
+const (
+	errIncompatibleVersion         = 1
+	errInvalidEnvironmentVariables = 4
+	errIOFailure                   = 5
+	errDecodingFailure             = 6
+	errInvalidNetworkConfig        = 7
+	errTryAgainLater               = 11
+	// errNoStaticIP 插件自定义的错误码: Pod 没有声明 IP 池, 且没有配置 fallback 插件.
+	errNoStaticIP = 100
+)
+
+// Error 输出到 stdout 的错误信息.
+type Error struct {
+	CNIVersion string `json:"cniVersion,omitempty"`
+	Code       uint   `json:"code"`
+	Msg        string `json:"msg"`
+	Details    string `json:"details,omitempty"`
+}
+
+func (e *Error) Error() string {
+	if e.Details == "" {
+		return e.Msg
+	}
+	return fmt.Sprintf("%s: %s", e.Msg, e.Details)
+}
+
+func newError(code uint, msg string, err error) *Error {
+	e := &Error{Code: code, Msg: msg}
+	if err != nil {
+		e.Details = err.Error()
+	}
+	return e
+}
+
+// Interface 规范中 result 的 interfaces 字段.
+type Interface struct {
+	Name    string `json:"name"`
+	Mac     string `json:"mac,omitempty"`
+	Sandbox string `json:"sandbox,omitempty"`
+}
+
+// IPConfig 规范中 result 的 ips 字段, version 只存在于 1.0.0 之前的版本.
+type IPConfig struct {
+	Version   string `json:"version,omitempty"`
+	Interface *int   `json:"interface,omitempty"`
+	Address   string `json:"address"`
+	Gateway   string `json:"gateway,omitempty"`
+}
+
+// Route 规范中 result 的 routes 字段.
+type Route struct {
+	Dst string `json:"dst"`
+	GW  string `json:"gw,omitempty"`
+}
+
+// Result ADD 成功后输出到 stdout 的结果.
+type Result struct {
+	CNIVersion string       `json:"cniVersion"`
+	Interfaces []*Interface `json:"interfaces,omitempty"`
+	IPs        []*IPConfig  `json:"ips,omitempty"`
+	Routes     []*Route     `json:"routes,omitempty"`
+}
+
+// newResult 根据 cni server 的返回生成 result, 地址与路由都在容器内的 eth0 上, 与 server 中 setContainerVeth() 一致.
+// 调用前已经由 checkIfName() 确认 CNI_IFNAME 为 eth0.
+func newResult(conf *NetConf, args *CmdArgs, resp *restapi.PodResponse) (result *Result, err error) {
+	ifIndex := 0
+	result = &Result{
+		CNIVersion: conf.CNIVersion,
+		Interfaces: []*Interface{
+			{Name: args.IfName, Mac: containerMac(args.Netns, args.IfName), Sandbox: args.Netns},
+		},
+		IPs:    []*IPConfig{},
+		Routes: []*Route{},
+	}
+	pairs := []struct{ address, gateway, version, dst string }{
+		{resp.IPAddress, resp.Gateway, "4", "0.0.0.0/0"},
+		{resp.IPAddress6, resp.Gateway6, "6", "::/0"},
+	}
+	for _, pair := range pairs {
+		if pair.address == "" {
+			continue
+		}
+		if _, _, err = net.ParseCIDR(pair.address); err != nil {
+			return nil, newError(errDecodingFailure, "cni server returned an invalid address", err)
+		}
+		ipConf := &IPConfig{Interface: &ifIndex, Address: pair.address, Gateway: pair.gateway}
+		if conf.CNIVersion != "1.0.0" {
+			ipConf.Version = pair.version
+		}
+		result.IPs = append(result.IPs, ipConf)
+		if pair.gateway != "" {
+			result.Routes = append(result.Routes, &Route{Dst: pair.dst, GW: pair.gateway})
+		}
+	}
+	return
+}
+
+// containerMac 获取容器内网卡的 MAC 地址, 只是为了填充 result, 获取失败时返回空字符串.
+func containerMac(netnsPath, ifName string) (mac string) {
+	ns.WithNetNSPath(netnsPath, func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return err
+		}
+		mac = link.Attrs().HardwareAddr.String()
+		return nil
+	})
+	return
+}
+
+// printJSON 将 result 或 error 输出到 stdout.
+func printJSON(obj interface{}) error {
+	data, err := json.MarshalIndent(obj, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
@@ -7,6 +7,7 @@ import (
 	"flag"
 	"os"
 
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 
@@ -17,6 +18,7 @@ import (
 	"github.com/generals-space/crd-ipkeeper/pkg/server"
 	"github.com/generals-space/crd-ipkeeper/pkg/signals"
 	"github.com/generals-space/crd-ipkeeper/pkg/util"
+	"github.com/generals-space/crd-ipkeeper/pkg/webhook"
 )
 
 // stopHandler 收到退出信号清理 cniserver.sock 文件.
@@ -52,9 +54,17 @@ func main() {
 
 	kubeClient := kubernetes.NewForConfigOrDie(kubeConfig)
 	crdClient := crdClientset.NewForConfigOrDie(kubeConfig)
-	c, err := controller.NewController(kubeClient, crdClient)
+	// dynamicClient 用于获取 CloneSet, Rollout 等任意类型的 owner 资源.
+	dynamicClient := dynamic.NewForConfigOrDie(kubeConfig)
+	c, err := controller.NewController(kubeClient, crdClient, dynamicClient, config.OwnerKinds)
 	go c.Run(stopCh)
 
-	cniServer := server.NewCNIServer(config, kubeClient, crdClient)
-	cniServer.Run()
+	// 未指定证书时不启动 admission webhook.
+	if config.TLSCertFile != "" && config.TLSKeyFile != "" {
+		webhookServer := webhook.NewWebhookServer(config, kubeClient, crdClient, dynamicClient)
+		go webhookServer.Run(stopCh)
+	}
+
+	cniServer := server.NewCNIServer(config, kubeClient, crdClient, dynamicClient)
+	cniServer.Run(stopCh)
 }
@@ -31,6 +31,8 @@ func addKnownTypes(scheme *runtime.Scheme) error {
         SchemeGroupVersion,
         &StaticIP{},
         &StaticIPList{},
+        &IPPool{},
+        &IPPoolList{},
     )
 
     // register the type in the scheme
@@ -1,6 +1,7 @@
 package v1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	apimtypes "k8s.io/apimachinery/pkg/types"
 )
@@ -14,29 +15,39 @@ type StaticIP struct {
 	metav1.TypeMeta `json:",inline"`
 	// ObjectMeta为特定类型的元信息, 包括name, namespace, selfLink, labels等.
 	metav1.ObjectMeta `json:"metadata,omitempty"`
-	// spec字段
+	// spec字段, 只保存期望的 IP 池信息(来源于 owner 资源的注解).
 	Spec StaticIPSpec `json:"spec"`
-	// status字段.
-	// 其实不需要 Status 字段, 因为 StaticIP 本身就是一个反应其他资源状态的类型,
-	// StaticIP 的所有成员表示的都是其他资源的信息.
-	Status StaticIPStatus `json:"status"`
+	// status字段, 保存 IP 的实际分配情况.
+	// 作为 /status 子资源, 只能通过 UpdateStatus() 修改,
+	// 这样 controller 与 cni server 在分配/释放 IP 时不会与修改 spec 的操作相冲突.
+	Status StaticIPStatus `json:"status,omitempty"`
 }
 
 // StaticIPSpec is the spec for a MyResource resource
 type StaticIPSpec struct {
 	Namespace string `json:"namespace"`
 	OwnerKind string `json:"ownerKind"`
-	// 格式可为 "192.168.1.1/24,192.168.1.2/24"
+	// 格式可为 "192.168.1.1/24,192.168.1.2/24",
+	// 也支持网段(192.168.1.0/26), 范围(192.168.1.10-192.168.1.80/24)与排除项(!192.168.1.1)
+	// 双栈时可同时包含 IPv4 与 IPv6 地址, 每个 Pod 会各分配到一个.
 	IPPool  string `json:"ipPool"`
 	Gateway string `json:"gateway"`
-
-	// IPMap key 为 192.168.1.1/24 这种点分十进制字符串
-	// val 为 OwnerPod 对象, 表示此 IP 的拥有者
-	IPMap     map[string]*OwnerPod `json:"ipmap"`
-	Used      []string             `json:"used"`
-	Avaliable []string             `json:"avaliable"`
-	// 已分配的IP占IP池的比例, 如 1/4, 2/4 等
-	Ratio string `json:"ratio"`
+	// Gateway6 IPv6 网关, IP 池中包含 IPv6 地址时必须指定.
+	Gateway6 string `json:"gateway6,omitempty"`
+	// PoolRef 引用的集群级别 IPPool 名称, 不为空时 IPPool 与 Gateway 字段由该池划分得到.
+	PoolRef string `json:"poolRef,omitempty"`
+	// NodeIPs 仅用于 DaemonSet, 显式声明各节点使用的 IP,
+	// 格式为 "node1=192.168.1.10,node2=192.168.1.11", 双栈时同一节点可出现两次.
+	NodeIPs string `json:"nodeIPs,omitempty"`
+	// Strategy 从 IP 池中选取空闲 IP 的策略, 可选值为 lowest(默认), round-robin, hash.
+	// StatefulSet 与 DaemonSet 分别按序号与节点绑定 IP, 不使用此字段.
+	Strategy string `json:"strategy,omitempty"`
+	// ReleaseCooldown 被释放的 IP 需要冷却多久才能再次分配, 格式同 time.ParseDuration(), 如 30s, 5m.
+	// 为空时释放后立即可用.
+	ReleaseCooldown string `json:"releaseCooldown,omitempty"`
+	// ShrinkPolicy 仅用于 Deployment, IP 池缩小后如何处理占用了被移除的 IP 的 Pod,
+	// 可选值为 evict(默认), drain.
+	ShrinkPolicy string `json:"shrinkPolicy,omitempty"`
 }
 
 // OwnerPod ...
@@ -44,6 +55,61 @@ type OwnerPod struct {
 	Namespace string        `json:"namespace"`
 	Name      string        `json:"name"`
 	UID       apimtypes.UID `json:"uid"`
+	// NodeName Pod 所在的节点
+	NodeName string `json:"nodeName,omitempty"`
+	// ContainerID 申请此 IP 的 pause 容器(sandbox) ID, 用于识别 kubelet 重复发起的 ADD/DEL 请求.
+	ContainerID string `json:"containerID,omitempty"`
+	// NetNs pause 容器的 netns 路径, 网关变化时节点上的 cni server 通过它更新 Pod 的默认路由.
+	NetNs string `json:"netns,omitempty"`
+	// Gateway Pod 内与此 IP 对应的默认路由当前使用的网关.
+	Gateway string `json:"gateway,omitempty"`
+	// GatewayError 最近一次更新默认路由失败的原因, 成功后清空.
+	GatewayError string `json:"gatewayError,omitempty"`
+}
+
+// IPHandover Deployment 滚动更新时, 旧 Pod 的 IP 为新 ReplicaSet 的 Pod 预留的记录.
+type IPHandover struct {
+	// PodTemplateHash 新 ReplicaSet 的 pod-template-hash, 只有该 ReplicaSet 的 Pod 能使用此 IP.
+	PodTemplateHash string `json:"podTemplateHash"`
+	// Since 开始预留的时间, 超时后预留失效.
+	Since metav1.Time `json:"since"`
+}
+
+// AdoptionPhase 接管已有 Pod 的阶段.
+type AdoptionPhase string
+
+const (
+	// AdoptionRestarting 正在逐个重建没有固定 IP 的 Pod.
+	AdoptionRestarting AdoptionPhase = "Restarting"
+	// AdoptionBlocked 驱逐 Pod 被 PodDisruptionBudget 拒绝, 稍后重试.
+	AdoptionBlocked AdoptionPhase = "Blocked"
+	// AdoptionCompleted 所有 Pod 都已使用固定 IP.
+	AdoptionCompleted AdoptionPhase = "Completed"
+)
+
+// AdoptionStatus 接管已有 Pod 的进度.
+type AdoptionStatus struct {
+	Phase AdoptionPhase `json:"phase"`
+	// Pending 还没有固定 IP 的 Pod 数量.
+	Pending int32 `json:"pending"`
+	// Restarted 已经被驱逐重建的 Pod 数量.
+	Restarted int32 `json:"restarted"`
+	// LastEvictionTime 最近一次驱逐 Pod 的时间.
+	LastEvictionTime metav1.Time `json:"lastEvictionTime,omitempty"`
+	Message          string      `json:"message,omitempty"`
+}
+
+// ShrinkStatus IP 池缩小后驱逐 Pod 的进度.
+type ShrinkStatus struct {
+	// Pending 等待驱逐的 Pod 数量.
+	Pending int32 `json:"pending"`
+	// Evicted 已经驱逐的 Pod 数量.
+	Evicted int32 `json:"evicted"`
+	// Blocked 驱逐被 PodDisruptionBudget 拒绝的次数, 被拒绝的 Pod 稍后会再次尝试.
+	Blocked int32 `json:"blocked"`
+	// LastEvictionTime 最近一次尝试驱逐 Pod 的时间, 同一 StaticIP 两次驱逐之间至少间隔一段时间.
+	LastEvictionTime metav1.Time `json:"lastEvictionTime,omitempty"`
+	Message          string      `json:"message,omitempty"`
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
@@ -57,4 +123,118 @@ type StaticIPList struct {
 }
 
 // StaticIPStatus is the status for a StaticIPStatus resource
-type StaticIPStatus struct{}
+type StaticIPStatus struct {
+	// ObservedGeneration 最近一次根据 spec 同步 status 时, StaticIP 对象的 generation 值.
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// IPMap key 为 192.168.1.1/24 这种点分十进制字符串
+	// val 为 OwnerPod 对象, 表示此 IP 的拥有者
+	IPMap     map[string]*OwnerPod `json:"ipmap"`
+	Used      []string             `json:"used"`
+	Avaliable []string             `json:"avaliable"`
+	// 已分配的IP占IP池的比例, 如 1/4, 2/4 等
+	Ratio string `json:"ratio"`
+
+	// NodeBindings 仅用于 DaemonSet, key 为节点名称, val 为该节点绑定的 IP 列表(与 IPMap 的 key 格式相同).
+	// 节点上的 Pod 第一次分配到 IP 后即与该节点绑定, 之后重建的 Pod 仍会使用相同的 IP.
+	NodeBindings map[string][]string `json:"nodeBindings,omitempty"`
+	// OrdinalBindings 仅用于 StatefulSet, key 为 Pod 的序号, val 为该序号绑定的 IP 列表(与 IPMap 的 key 格式相同).
+	// 序号第一次分配到 IP 后即与之绑定, 从 IP 池中移除其他 IP 不会影响已有的绑定.
+	OrdinalBindings map[string][]string `json:"ordinalBindings,omitempty"`
+
+	// LastReleased 各 IP 最近一次被释放的时间, 供 round-robin 策略使用.
+	LastReleased map[string]metav1.Time `json:"lastReleased,omitempty"`
+	// Releasing 处于冷却期的 IP 及其释放时间, 这些 IP 既不在 Used 中也不在 Avaliable 中,
+	// 冷却结束后由 controller 移回 Avaliable.
+	Releasing map[string]metav1.Time `json:"releasing,omitempty"`
+	// Handover 仅用于 Deployment, 滚动更新时正在退出的旧 Pod 的 IP 为新 ReplicaSet 的 Pod 预留.
+	Handover map[string]IPHandover `json:"handover,omitempty"`
+	// ReclaimedTotal 被 controller 回收的泄漏 IP 的累计数量, 即 IPMap 中的 Pod 已经不存在, 却没有被释放的 IP.
+	ReclaimedTotal int64 `json:"reclaimedTotal,omitempty"`
+	// Adoption 为已经运行的 Deployment 添加 IP 池注解后, 重建其 Pod 以获得固定 IP 的进度.
+	Adoption *AdoptionStatus `json:"adoption,omitempty"`
+	// Evicting IP 池缩小后被移除, 但仍被 Pod 占用的 IP, key 与 IPMap 相同.
+	// 这些 Pod 会通过 Eviction 接口逐个驱逐, 退出后从这里移除.
+	Evicting map[string]*OwnerPod `json:"evicting,omitempty"`
+	// Shrink IP 池缩小后驱逐 Pod 的进度.
+	Shrink *ShrinkStatus `json:"shrink,omitempty"`
+	// Draining shrink_policy 为 drain 时, IP 池缩小后被移除, 但仍被 Pod 占用的 IP, key 与 IPMap 相同.
+	// 这些 Pod 不会被驱逐, 被自然替换后从这里移除, 其 IP 不会再分配出去.
+	Draining map[string]*OwnerPod `json:"draining,omitempty"`
+
+	Conditions []StaticIPCondition `json:"conditions,omitempty"`
+}
+
+// StaticIPConditionType StaticIP 的状态类型.
+type StaticIPConditionType string
+
+const (
+	// StaticIPReady IP 池已根据 spec 完成初始化, 可以分配 IP.
+	StaticIPReady StaticIPConditionType = "Ready"
+	// StaticIPPoolExhausted IP 池中已经没有可用的 IP.
+	StaticIPPoolExhausted StaticIPConditionType = "PoolExhausted"
+	// StaticIPConflict IP 池中存在与其他 StaticIP 重复的 IP.
+	StaticIPConflict StaticIPConditionType = "Conflict"
+	// StaticIPRetiring owner 的 IP 池注解已被移除, 不再分配新的 IP, 所有 IP 都被释放后 StaticIP 会被删除.
+	StaticIPRetiring StaticIPConditionType = "Retiring"
+	// StaticIPTerminating StaticIP 正在被删除, 等待占用 IP 的 Pod 全部退出, message 中记录了删除进度.
+	StaticIPTerminating StaticIPConditionType = "Terminating"
+)
+
+// StaticIPCondition 与 Pod, Deployment 的 Condition 格式保持一致.
+type StaticIPCondition struct {
+	Type   StaticIPConditionType  `json:"type"`
+	Status corev1.ConditionStatus `json:"status"`
+	// LastTransitionTime Status 字段发生变化的时间.
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+	Reason             string      `json:"reason,omitempty"`
+	Message            string      `json:"message,omitempty"`
+}
+
+// +genclient
+// +genclient:nonNamespaced
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// IPPool 集群级别的 IP 池, 各 StaticIP 可以通过注解引用, 从中划分出一段 IP 使用,
+// 由 IPPool 统一记录各段 IP 的归属, 避免不同的工作负载声明了相同的 IP.
+type IPPool struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   IPPoolSpec   `json:"spec"`
+	Status IPPoolStatus `json:"status,omitempty"`
+}
+
+// IPPoolSpec is the spec for a IPPool resource
+type IPPoolSpec struct {
+	// Subnet 网段, 如 192.168.1.0/24, 网络地址与广播地址不参与分配.
+	Subnet  string `json:"subnet"`
+	Gateway string `json:"gateway"`
+	// Subnet6 与 Gateway6 为 IPv6 网段与网关, 用于双栈集群, 可与 Subnet 同时存在, 也可单独使用.
+	// 设置后每个 StaticIP 会同时划分到相同数量的 IPv4 与 IPv6 地址.
+	Subnet6  string `json:"subnet6,omitempty"`
+	Gateway6 string `json:"gateway6,omitempty"`
+	// Excludes 不参与分配的 IP, 可为单个 IP(192.168.1.1),
+	// 或是范围(192.168.1.200-192.168.1.254). 网关地址会被自动排除.
+	Excludes []string `json:"excludes,omitempty"`
+}
+
+// IPPoolStatus is the status for a IPPool resource
+type IPPoolStatus struct {
+	// Allocations key 为 StaticIP 的 namespace/name, val 为划分给该 StaticIP 的 IP 列表(不含掩码).
+	Allocations map[string][]string `json:"allocations,omitempty"`
+	// Total 池中可分配的 IP 总数(已去除 Excludes 部分)
+	Total int `json:"total"`
+	// Free 尚未划分给任何 StaticIP 的 IP 数量
+	Free int `json:"free"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// IPPoolList is a list of IPPool resources
+type IPPoolList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+
+	Items []IPPool `json:"items"`
+}
@@ -28,6 +28,10 @@ type FakeIpkeeperV1 struct {
 	*testing.Fake
 }
 
+func (c *FakeIpkeeperV1) IPPools() v1.IPPoolInterface {
+	return &FakeIPPools{c}
+}
+
 func (c *FakeIpkeeperV1) StaticIPs(namespace string) v1.StaticIPInterface {
 	return &FakeStaticIPs{c, namespace}
 }
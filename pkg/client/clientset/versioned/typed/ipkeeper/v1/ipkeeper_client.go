@@ -26,6 +26,7 @@ import (
 
 type IpkeeperV1Interface interface {
 	RESTClient() rest.Interface
+	IPPoolsGetter
 	StaticIPsGetter
 }
 
@@ -34,6 +35,10 @@ type IpkeeperV1Client struct {
 	restClient rest.Interface
 }
 
+func (c *IpkeeperV1Client) IPPools() IPPoolInterface {
+	return newIPPools(c)
+}
+
 func (c *IpkeeperV1Client) StaticIPs(namespace string) StaticIPInterface {
 	return newStaticIPs(c, namespace)
 }
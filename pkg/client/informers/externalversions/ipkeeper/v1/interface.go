@@ -24,6 +24,8 @@ import (
 
 // Interface provides access to all the informers in this group version.
 type Interface interface {
+	// IPPools returns a IPPoolInformer.
+	IPPools() IPPoolInformer
 	// StaticIPs returns a StaticIPInformer.
 	StaticIPs() StaticIPInformer
 }
@@ -39,6 +41,11 @@ func New(f internalinterfaces.SharedInformerFactory, namespace string, tweakList
 	return &version{factory: f, namespace: namespace, tweakListOptions: tweakListOptions}
 }
 
+// IPPools returns a IPPoolInformer.
+func (v *version) IPPools() IPPoolInformer {
+	return &iPPoolInformer{factory: v.factory, tweakListOptions: v.tweakListOptions}
+}
+
 // StaticIPs returns a StaticIPInformer.
 func (v *version) StaticIPs() StaticIPInformer {
 	return &staticIPInformer{factory: v.factory, namespace: v.namespace, tweakListOptions: v.tweakListOptions}
@@ -18,6 +18,10 @@ limitations under the License.
 
 package v1
 
+// IPPoolListerExpansion allows custom methods to be added to
+// IPPoolLister.
+type IPPoolListerExpansion interface{}
+
 // StaticIPListerExpansion allows custom methods to be added to
 // StaticIPLister.
 type StaticIPListerExpansion interface{}
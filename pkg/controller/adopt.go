@@ -0,0 +1,170 @@
+package controller
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	apimerrors "k8s.io/apimachinery/pkg/api/errors"
+	apimmetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apimtypes "k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	cgcache "k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+
+	ipkv1 "github.com/generals-space/crd-ipkeeper/pkg/apis/ipkeeper/v1"
+	"github.com/generals-space/crd-ipkeeper/pkg/staticip"
+	"github.com/generals-space/crd-ipkeeper/pkg/util"
+)
+
+// 为已经运行的 Deployment 添加 IP 池注解后, 已有的 Pod 并不会获得固定 IP.
+// Deployment 同时拥有 adopt_pods 注解时, controller 会通过 Eviction 接口逐个驱逐这些 Pod,
+// 每次只驱逐一个, 并等到所有 Pod 都 Ready 后才驱逐下一个, 驱逐被 PodDisruptionBudget 拒绝时稍后重试.
+// 进度记录在 StaticIP 的 status.adoption 中.
+
+// adoptInterval 检查接管进度的间隔.
+const adoptInterval = 10 * time.Second
+
+// enqueueAdoptDeploy deploy 需要接管已有 Pod 时加入 adoptDeployQueue.
+// caller: c.handleAddDeploy(), c.enqueueUpdateDeploy()
+func (c *Controller) enqueueAdoptDeploy(key string, annotations map[string]string) {
+	if annotations[util.AdoptPodsAnnotation] != "true" {
+		return
+	}
+	klog.Infof("enqueue adopt pods of deploy %s", key)
+	c.adoptDeployQueue.Add(key)
+}
+
+//////////////////////////////////////////////////////////////
+// process 实际操作 Adopt 部分
+func (c *Controller) runAdoptDeployWorker() {
+	for c.processNextAdoptDeployWorkItem() {
+	}
+}
+
+func (c *Controller) processNextAdoptDeployWorkItem() bool {
+	obj, shutdown := c.adoptDeployQueue.Get()
+	if shutdown {
+		return false
+	}
+	err := c.processNextWorkItem(obj, c.adoptDeployQueue, c.handleAdoptDeploy)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return true
+	}
+
+	return true
+}
+
+// handleAdoptDeploy 驱逐 deploy 下一个没有固定 IP 的 Pod, 还有其他 Pod 需要驱逐时, 过一段时间再次入队.
+func (c *Controller) handleAdoptDeploy(key string) (err error) {
+	ns, name, err := cgcache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return nil
+	}
+	deploy, err := c.deployLister.Deployments(ns).Get(name)
+	if err != nil {
+		if apimerrors.IsNotFound(err) {
+			return nil
+		}
+		return
+	}
+	if !util.HasIPPoolAnnotations(deploy.Annotations) ||
+		deploy.Annotations[util.AdoptPodsAnnotation] != "true" {
+		return nil
+	}
+	sip, err := c.sipHelper.GetStaticIP(deploy, "Deployment")
+	if err != nil {
+		// StaticIP 可能还没有创建.
+		if apimerrors.IsNotFound(err) {
+			c.adoptDeployQueue.AddAfter(key, adoptInterval)
+			return nil
+		}
+		return
+	}
+	selector, err := apimmetav1.LabelSelectorAsSelector(deploy.Spec.Selector)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return nil
+	}
+	pods, err := c.podLister.Pods(ns).List(selector)
+	if err != nil {
+		return
+	}
+
+	owned := map[apimtypes.UID]bool{}
+	for _, ownerPod := range sip.Status.IPMap {
+		if ownerPod != nil {
+			owned[ownerPod.UID] = true
+		}
+	}
+	pending := []*corev1.Pod{}
+	busy := false
+	for _, pod := range pods {
+		if podCompleted(pod) {
+			continue
+		}
+		// 有 Pod 正在退出或还没有 Ready 时, 上一次驱逐还没有完成.
+		if pod.DeletionTimestamp != nil || !podReady(pod) {
+			busy = true
+		}
+		if pod.DeletionTimestamp == nil && !owned[pod.UID] {
+			pending = append(pending, pod)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Name < pending[j].Name })
+
+	adoption := &ipkv1.AdoptionStatus{}
+	if sip.Status.Adoption != nil {
+		adoption = sip.Status.Adoption.DeepCopy()
+	}
+	adoption.Pending = int32(len(pending))
+	if len(pending) == 0 {
+		adoption.Phase = ipkv1.AdoptionCompleted
+		adoption.Message = "all pods have static ips"
+		return c.sipHelper.UpdateAdoption(sip, adoption)
+	}
+	defer c.adoptDeployQueue.AddAfter(key, adoptInterval)
+	if busy {
+		adoption.Phase = ipkv1.AdoptionRestarting
+		adoption.Message = "waiting for pods to become ready"
+		return c.sipHelper.UpdateAdoption(sip, adoption)
+	}
+
+	pod := pending[0]
+	err = c.kubeClient.PolicyV1beta1().Evictions(pod.Namespace).Evict(&policyv1beta1.Eviction{
+		ObjectMeta: apimmetav1.ObjectMeta{Namespace: pod.Namespace, Name: pod.Name},
+	})
+	if apimerrors.IsTooManyRequests(err) {
+		// PodDisruptionBudget 不允许此时驱逐.
+		adoption.Phase = ipkv1.AdoptionBlocked
+		adoption.Message = fmt.Sprintf("eviction of pod %s is blocked: %s", pod.Name, err)
+		return c.sipHelper.UpdateAdoption(sip, adoption)
+	}
+	if err != nil && !apimerrors.IsNotFound(err) {
+		return
+	}
+	klog.Infof("evict pod %s/%s to adopt it with static ip", pod.Namespace, pod.Name)
+	staticip.RecordEvent(
+		c.recorder, sip, pod, corev1.EventTypeNormal, util.EventPodAdopted,
+		"evicted pod %s so that it comes back with a static ip", pod.Name,
+	)
+	adoption.Phase = ipkv1.AdoptionRestarting
+	adoption.Restarted++
+	adoption.LastEvictionTime = apimmetav1.Now()
+	adoption.Message = fmt.Sprintf("evicted pod %s", pod.Name)
+	return c.sipHelper.UpdateAdoption(sip, adoption)
+}
+
+// podReady 判断 Pod 的 Ready 状态是否为 True.
+func podReady(pod *corev1.Pod) bool {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodReady {
+			return cond.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
@@ -6,11 +6,15 @@ import (
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	apimerrors "k8s.io/apimachinery/pkg/api/errors"
+	apimmetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	cgcache "k8s.io/client-go/tools/cache"
 	cgworkqueue "k8s.io/client-go/util/workqueue"
 	"k8s.io/klog"
 
+	ipkv1 "github.com/generals-space/crd-ipkeeper/pkg/apis/ipkeeper/v1"
+	"github.com/generals-space/crd-ipkeeper/pkg/staticip"
 	"github.com/generals-space/crd-ipkeeper/pkg/util"
 )
 
@@ -39,10 +43,58 @@ func (c *Controller) getDeployFromKey(key string) (deploy *appsv1.Deployment, er
 	}
 
 	// 能加入到 addDeployQueue 都是已经经过 enqueueAddDeploy() 方法筛选过的,
-	// 但还是要检查一遍
-	if deploy.Annotations[util.IPPoolAnnotation] == "" &&
-		deploy.Annotations[util.GatewayAnnotation] == "" {
-		klog.Fatal("deploy doesn't exist: %s/%s ...", ns, name)
+	// 但注解可能在重新入队期间被移除, 此时交由 retireDeployQueue 处理.
+	if !util.HasIPPoolAnnotations(deploy.Annotations) {
+		return nil, nil
+	}
+	return
+}
+
+// getStsFromKey 从 Lister 成员中取得指定 ns/name 的 statefulset 对象.
+// 具体操作基本等同于 c.getDeployFromKey()
+func (c *Controller) getStsFromKey(key string) (sts *appsv1.StatefulSet, err error) {
+	ns, name, err := cgcache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		err = fmt.Errorf("invalid resource key: %s", key)
+		return
+	}
+
+	sts, err = c.stsLister.StatefulSets(ns).Get(name)
+	if err != nil {
+		if apimerrors.IsNotFound(err) {
+			klog.Infof("statefulset doesn't exist: %s/%s ...", ns, name)
+			return nil, nil
+		}
+		err = fmt.Errorf("failed to list statefulset by: %s/%s", ns, name)
+		return
+	}
+
+	if !util.HasIPPoolAnnotations(sts.Annotations) {
+		return nil, nil
+	}
+	return
+}
+
+// getDsFromKey 从 Lister 成员中取得指定 ns/name 的 daemonset 对象.
+// 具体操作基本等同于 c.getDeployFromKey()
+func (c *Controller) getDsFromKey(key string) (ds *appsv1.DaemonSet, err error) {
+	ns, name, err := cgcache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		err = fmt.Errorf("invalid resource key: %s", key)
+		return
+	}
+
+	ds, err = c.dsLister.DaemonSets(ns).Get(name)
+	if err != nil {
+		if apimerrors.IsNotFound(err) {
+			klog.Infof("daemonset doesn't exist: %s/%s ...", ns, name)
+			return nil, nil
+		}
+		err = fmt.Errorf("failed to list daemonset by: %s/%s", ns, name)
+		return
+	}
+
+	if !util.HasIPPoolAnnotations(ds.Annotations) {
 		return nil, nil
 	}
 	return
@@ -73,6 +125,119 @@ func (c *Controller) getPodFromKey(key string) (pod *corev1.Pod, err error) {
 	return
 }
 
+// checkIPPoolAnnotation 检查 owner 的 IP 池注解格式是否合法, 不合法时在 owner 上记录 Warning 事件.
+// 格式错误无法通过重试解决, 所以返回 false 时调用者应直接返回, 而不是将 key 重新入队.
+// caller: c.handleAddDeploy(), c.handleUpdateDeploy(), c.handleAddPod()
+func (c *Controller) checkIPPoolAnnotation(owner runtime.Object, poolStr string) bool {
+	// IPv6 大网段在创建 StaticIP 时才按数量划分, 这里只需要检查格式.
+	poolStr, err := staticip.ExpandIPPool(poolStr, 1)
+	if err == nil {
+		_, err = staticip.ParseIPPool(poolStr)
+	}
+	if err != nil {
+		klog.Warningf("invalid ip pool annotation: %s", err)
+		c.recorder.Eventf(
+			owner, corev1.EventTypeWarning, util.EventInvalidIPPool,
+			"invalid ip pool annotation: %s", err,
+		)
+		return false
+	}
+	return true
+}
+
+// checkPoolSize 检查 StatefulSet 的 IP 池是否小于其 replicas, 是则在其上记录 Warning 事件.
+// 每个序号绑定一个 IP, 多出来的 Pod 将无法分配到 IP, 见 staticip.pickOrdinalIPs().
+// caller: c.handleAddSts(), c.handleUpdateSts()
+func (c *Controller) checkPoolSize(sts *appsv1.StatefulSet) {
+	if sts.Spec.Replicas == nil {
+		return
+	}
+	sip, err := c.sipHelper.GetStaticIP(sts, "StatefulSet")
+	if err != nil {
+		return
+	}
+	size := staticip.PoolSize(sip)
+	if size < int(*sts.Spec.Replicas) {
+		c.recorder.Eventf(
+			sts, corev1.EventTypeWarning, util.EventPoolTooSmall,
+			"ip pool has %d IPs but replicas is %d, %d pods can not get IP",
+			size, *sts.Spec.Replicas, int(*sts.Spec.Replicas)-size,
+		)
+	}
+}
+
+// checkSurgeCapacity 检查 Deployment 的 IP 池是否小于 replicas + maxSurge, 是则在其上记录 Warning 事件.
+// 此时滚动更新多出来的新 Pod 分配不到 IP, 如果 maxUnavailable 又为 0, 旧 Pod 不会退出, 滚动更新将无法进行.
+// caller: c.handleAddDeploy(), c.handleUpdateDeploy()
+func (c *Controller) checkSurgeCapacity(deploy *appsv1.Deployment) {
+	capacity, err := staticip.SurgeCapacity(deploy)
+	if err != nil {
+		klog.Warningf("failed to get surge capacity of deploy %s: %s", deploy.Name, err)
+		return
+	}
+	sip, err := c.sipHelper.GetStaticIP(deploy, "Deployment")
+	if err != nil {
+		return
+	}
+	size := staticip.PoolSize(sip)
+	if size < capacity {
+		c.recorder.Eventf(
+			deploy, corev1.EventTypeWarning, util.EventPoolTooSmall,
+			"ip pool has %d IPs but replicas + maxSurge is %d, rolling update may get stuck",
+			size, capacity,
+		)
+	}
+}
+
+// waitForTerminatingSIP owner 被删除后又以相同名称重建时, 旧的 StaticIP 可能还在等待 Pod 退出.
+// 此时将 key 稍后重新入队, 等旧的 StaticIP 被删除后再创建新的, 以免其中的 IP 被重复分配.
+// 返回 true 时调用者应直接返回.
+// caller: c.handleAddDeploy(), c.handleAddSts(), c.handleAddDs()
+func (c *Controller) waitForTerminatingSIP(
+	owner apimmetav1.Object,
+	ownerKind, key string,
+	queue cgworkqueue.RateLimitingInterface,
+) bool {
+	sip, err := c.sipHelper.GetStaticIP(owner, ownerKind)
+	if err != nil || sip.DeletionTimestamp == nil {
+		return false
+	}
+	klog.Infof("staticip %s of %s is being deleted, wait for it", sip.Name, key)
+	queue.AddAfter(key, finalizeInterval)
+	return true
+}
+
+// renewStaticIP 将 owner 的 StaticIP 更新为 newSIP, IP 池缩小时在 workload 与 StaticIP 上记录事件,
+// 因为占用了被移除的 IP 的 Pod 会被驱逐, 需要让用户知道这些 Pod 为什么被重建.
+// shrink_policy 为 drain 时这些 Pod 不会被驱逐, 也需要让用户知道这些 IP 仍在使用中.
+// caller: c.handleUpdateDeploy(), c.handleUpdateSts(), c.handleUpdateDs()
+func (c *Controller) renewStaticIP(oldSIP, newSIP *ipkv1.StaticIP) (err error) {
+	// RenewStaticIP() 会修改 oldSIP, 需要事先计算.
+	oldSize, newSize := staticip.PoolSize(oldSIP), staticip.PoolSize(newSIP)
+	evicting, err := staticip.RenewStaticIP(c.crdClient, oldSIP, newSIP)
+	if err != nil {
+		return
+	}
+	if newSize < oldSize && oldSIP.Spec.ShrinkPolicy == staticip.ShrinkPolicyDrain {
+		// RenewStaticIP() 之后 oldSIP 已经是更新后的状态.
+		staticip.RecordEvent(
+			c.recorder, oldSIP, nil, corev1.EventTypeWarning, util.EventPoolShrunk,
+			"ip pool shrunk from %d to %d IPs, %d removed IPs are draining until their pods are replaced",
+			oldSize, newSize, len(oldSIP.Status.Draining),
+		)
+	} else if newSize < oldSize {
+		staticip.RecordEvent(
+			c.recorder, oldSIP, nil, corev1.EventTypeWarning, util.EventPoolShrunk,
+			"ip pool shrunk from %d to %d IPs, %d pods using the removed IPs will be evicted",
+			oldSize, newSize, evicting,
+		)
+	}
+	if evicting != 0 {
+		c.evictSIPQueue.Add(oldSIP.Namespace + "/" + oldSIP.Name)
+	}
+	return
+}
+
 // processNextWorkItem 调用 handler 处理具体的事件,
 // 并根据其结果对 queue 调用 Done() 和 Forget(), 表示该 obj 事件已经处理成功或失败.
 // caller: c.processNextAddDeployWorkItem(), c.processNextDelDeployWorkItem()
@@ -101,3 +266,17 @@ func (c *Controller) processNextWorkItem(
 	klog.Infof("Successfully synced '%s'", key)
 	return nil
 }
+
+// processNextRetryWorkItem 与 c.processNextWorkItem() 相同, 但 handler 失败时将 obj 按照限速重新入队.
+// 用于失败后不会再有事件触发的队列, 如 StaticIP 删除后归还 IPPool 中的 IP.
+func (c *Controller) processNextRetryWorkItem(
+	obj interface{},
+	queue cgworkqueue.RateLimitingInterface,
+	handler func(key string) (err error),
+) (err error) {
+	err = c.processNextWorkItem(obj, queue, handler)
+	if err != nil {
+		queue.AddRateLimited(obj)
+	}
+	return
+}
@@ -3,11 +3,13 @@ package controller
 import (
 	"context"
 	"os"
+	"sync"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	utilwait "k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
 	kubeInformers "k8s.io/client-go/informers"
 	cgkuber "k8s.io/client-go/kubernetes"
 	cgscheme "k8s.io/client-go/kubernetes/scheme"
@@ -47,10 +49,24 @@ type Controller struct {
 	podLister cglisterscorev1.PodLister
 	podSynced cgcache.InformerSynced
 
-	// 这3个基本没用上.
-	sipLister   crdLister.StaticIPLister
-	sipSynced   cgcache.InformerSynced
-	addSIPQueue cgworkqueue.RateLimitingInterface
+	stsLister cglistersappsv1.StatefulSetLister
+	stsSynced cgcache.InformerSynced
+
+	dsLister cglistersappsv1.DaemonSetLister
+	dsSynced cgcache.InformerSynced
+
+	// 滚动更新时查找 Deployment 最新版本的 ReplicaSet, 见 handleTermPod().
+	rsLister cglistersappsv1.ReplicaSetLister
+	rsSynced cgcache.InformerSynced
+
+	sipLister crdLister.StaticIPLister
+	sipSynced cgcache.InformerSynced
+	// 为 StaticIP 添加 finalizer, 以及在其被删除时等待 Pod 退出并释放 IP, 见 staticip/finalizer.go.
+	syncSIPQueue cgworkqueue.RateLimitingInterface
+	// 引用了 IPPool 的 StaticIP 被删除时, 需要将划分到的 IP 归还给 IPPool.
+	delSIPQueue cgworkqueue.RateLimitingInterface
+	// IP 池缩小后, 逐个驱逐占用了被移除的 IP 的 Pod, 见 evict.go.
+	evictSIPQueue cgworkqueue.RateLimitingInterface
 
 	// queue 的主要作用就是限流, 接收与处理是分为两个部分单独完成的.
 	addDeployQueue cgworkqueue.RateLimitingInterface
@@ -60,11 +76,29 @@ type Controller struct {
 	// 反而是每隔一段时间(大概是30s, 或1min), 就会调用一次 UpdateFunc(), 不会主动触发???
 	updateDeployQueue cgworkqueue.RateLimitingInterface
 	// 由于每个 StaticIP 都绑定了 deployment/pod 作为 owner,
-	// 在其 owner 被删除的同时会被关联删除, 所以其实也用不到 del 队列.
-	delDeployQueue cgworkqueue.RateLimitingInterface
+	// 在其 owner 被删除的同时会被关联删除, 所以不需要 del 队列, IP 的释放由 StaticIP 的 finalizer 保证.
+	// IP 池注解被移除的 deployment, 其 StaticIP 在所有 IP 释放后删除.
+	retireDeployQueue cgworkqueue.RateLimitingInterface
+	// 添加了 IP 池注解的 deployment, 逐个驱逐其已有的 Pod 使之获得固定 IP, 见 adopt.go.
+	adoptDeployQueue cgworkqueue.RateLimitingInterface
 
 	addPodQueue cgworkqueue.RateLimitingInterface
 	delPodQueue cgworkqueue.RateLimitingInterface
+	// Deployment 滚动更新时, 旧 Pod 开始退出后将其 IP 预留给新版本的 Pod.
+	termPodQueue cgworkqueue.RateLimitingInterface
+	// deletedPods 被删除的 Pod 对象, key 为 ns/name.
+	// Pod 被删除后无法再从 podLister 中获取, 所以在 enqueueDelPod() 时保存一份, 供 handleDelPod() 使用.
+	deletedPods sync.Map
+	// orphanSince 各泄漏 IP 第一次被发现的时间, 只在 collectOrphanIPs() 中使用, 见 gc.go.
+	orphanSince map[string]time.Time
+	// blockOrphanSince IPPool 中各泄漏的划分第一次被发现的时间, key 为 StaticIP 的 ns/name, 见 collectStaleBlocks().
+	blockOrphanSince map[string]time.Time
+
+	addStsQueue    cgworkqueue.RateLimitingInterface
+	updateStsQueue cgworkqueue.RateLimitingInterface
+
+	addDsQueue    cgworkqueue.RateLimitingInterface
+	updateDsQueue cgworkqueue.RateLimitingInterface
 
 	recorder   cgrecord.EventRecorder
 	electionID string
@@ -94,6 +128,8 @@ func makeRecorder(kubeClient cgkuber.Interface) (recorder cgrecord.EventRecorder
 func NewController(
 	kubeClient cgkuber.Interface,
 	crdClient crdClientset.Interface,
+	dynamicClient dynamic.Interface,
+	ownerKinds []string,
 ) (controller *Controller, err error) {
 	// 所有 CRD controller 都把这一句放在第一位
 	utilruntime.Must(crdScheme.AddToScheme(cgscheme.Scheme))
@@ -106,6 +142,9 @@ func NewController(
 	)
 	deployInformer := kubeInformerFactory.Apps().V1().Deployments()
 	podInformer := kubeInformerFactory.Core().V1().Pods()
+	stsInformer := kubeInformerFactory.Apps().V1().StatefulSets()
+	dsInformer := kubeInformerFactory.Apps().V1().DaemonSets()
+	rsInformer := kubeInformerFactory.Apps().V1().ReplicaSets()
 	sipInformer := crdInformerFactory.Ipkeeper().V1().StaticIPs()
 
 	controller = &Controller{
@@ -114,7 +153,7 @@ func NewController(
 
 		kubeClient: kubeClient,
 		crdClient:  crdClient,
-		sipHelper:  staticip.New(kubeClient, crdClient),
+		sipHelper:  staticip.New(kubeClient, crdClient, dynamicClient, ownerKinds),
 
 		kuberInformerFactory: kubeInformerFactory,
 		crdInformerFactory:   crdInformerFactory,
@@ -128,6 +167,15 @@ func NewController(
 		podLister: podInformer.Lister(),
 		podSynced: podInformer.Informer().HasSynced,
 
+		stsLister: stsInformer.Lister(),
+		stsSynced: stsInformer.Informer().HasSynced,
+
+		dsLister: dsInformer.Lister(),
+		dsSynced: dsInformer.Informer().HasSynced,
+
+		rsLister: rsInformer.Lister(),
+		rsSynced: rsInformer.Informer().HasSynced,
+
 		addDeployQueue: cgworkqueue.NewNamedRateLimitingQueue(
 			cgworkqueue.DefaultControllerRateLimiter(),
 			"AddDeploy",
@@ -136,9 +184,13 @@ func NewController(
 			cgworkqueue.DefaultControllerRateLimiter(),
 			"UpdateDeploy",
 		),
-		delDeployQueue: cgworkqueue.NewNamedRateLimitingQueue(
+		retireDeployQueue: cgworkqueue.NewNamedRateLimitingQueue(
+			cgworkqueue.DefaultControllerRateLimiter(),
+			"RetireDeploy",
+		),
+		adoptDeployQueue: cgworkqueue.NewNamedRateLimitingQueue(
 			cgworkqueue.DefaultControllerRateLimiter(),
-			"DelDeploy",
+			"AdoptDeploy",
 		),
 		addPodQueue: cgworkqueue.NewNamedRateLimitingQueue(
 			cgworkqueue.DefaultControllerRateLimiter(),
@@ -148,15 +200,60 @@ func NewController(
 			cgworkqueue.DefaultControllerRateLimiter(),
 			"DelPod",
 		),
-		recorder:   makeRecorder(kubeClient),
-		electionID: "crd-ipkeeper",
+		termPodQueue: cgworkqueue.NewNamedRateLimitingQueue(
+			cgworkqueue.DefaultControllerRateLimiter(),
+			"TermPod",
+		),
+		addStsQueue: cgworkqueue.NewNamedRateLimitingQueue(
+			cgworkqueue.DefaultControllerRateLimiter(),
+			"AddSts",
+		),
+		updateStsQueue: cgworkqueue.NewNamedRateLimitingQueue(
+			cgworkqueue.DefaultControllerRateLimiter(),
+			"UpdateSts",
+		),
+		addDsQueue: cgworkqueue.NewNamedRateLimitingQueue(
+			cgworkqueue.DefaultControllerRateLimiter(),
+			"AddDs",
+		),
+		updateDsQueue: cgworkqueue.NewNamedRateLimitingQueue(
+			cgworkqueue.DefaultControllerRateLimiter(),
+			"UpdateDs",
+		),
+		syncSIPQueue: cgworkqueue.NewNamedRateLimitingQueue(
+			cgworkqueue.DefaultControllerRateLimiter(),
+			"SyncSIP",
+		),
+		delSIPQueue: cgworkqueue.NewNamedRateLimitingQueue(
+			cgworkqueue.DefaultControllerRateLimiter(),
+			"DelSIP",
+		),
+		evictSIPQueue: cgworkqueue.NewNamedRateLimitingQueue(
+			cgworkqueue.DefaultControllerRateLimiter(),
+			"EvictSIP",
+		),
+		orphanSince:      map[string]time.Time{},
+		blockOrphanSince: map[string]time.Time{},
+		recorder:         makeRecorder(kubeClient),
+		electionID:       "crd-ipkeeper",
 	}
 
 	deployInformer.Informer().AddEventHandler(
 		cgcache.ResourceEventHandlerFuncs{
 			AddFunc:    controller.enqueueAddDeploy,
 			UpdateFunc: controller.enqueueUpdateDeploy,
-			DeleteFunc: controller.enqueueDelDeploy,
+		},
+	)
+	stsInformer.Informer().AddEventHandler(
+		cgcache.ResourceEventHandlerFuncs{
+			AddFunc:    controller.enqueueAddSts,
+			UpdateFunc: controller.enqueueUpdateSts,
+		},
+	)
+	dsInformer.Informer().AddEventHandler(
+		cgcache.ResourceEventHandlerFuncs{
+			AddFunc:    controller.enqueueAddDs,
+			UpdateFunc: controller.enqueueUpdateDs,
 		},
 	)
 	podInformer.Informer().AddEventHandler(
@@ -166,9 +263,17 @@ func NewController(
 			// 这个时机应该处于 pause 容器创建之前(或者说过程中),
 			// 因为此时 pause 还没有调用 cni 插件申请到 IP 地址.
 			AddFunc:    controller.enqueueAddPod,
+			UpdateFunc: controller.enqueueUpdatePod,
 			DeleteFunc: controller.enqueueDelPod,
 		},
 	)
+	sipInformer.Informer().AddEventHandler(
+		cgcache.ResourceEventHandlerFuncs{
+			AddFunc:    controller.enqueueAddSIP,
+			UpdateFunc: controller.enqueueUpdateSIP,
+			DeleteFunc: controller.enqueueDelSIP,
+		},
+	)
 	/*
 		// informer factory 只是加载回调函数的其中一种方式, 这里给出另外一种.
 
@@ -213,8 +318,18 @@ func (c *Controller) Run(stopCh <-chan struct{}) {
 	defer utilruntime.HandleCrash()
 	defer c.addDeployQueue.ShutDown()
 	defer c.updateDeployQueue.ShutDown()
+	defer c.retireDeployQueue.ShutDown()
+	defer c.adoptDeployQueue.ShutDown()
 	defer c.addPodQueue.ShutDown()
 	defer c.delPodQueue.ShutDown()
+	defer c.termPodQueue.ShutDown()
+	defer c.addStsQueue.ShutDown()
+	defer c.updateStsQueue.ShutDown()
+	defer c.addDsQueue.ShutDown()
+	defer c.updateDsQueue.ShutDown()
+	defer c.syncSIPQueue.ShutDown()
+	defer c.delSIPQueue.ShutDown()
+	defer c.evictSIPQueue.ShutDown()
 
 	c.stopCh = stopCh
 	// 创建分布式资源锁, 执行竞争, 并挂载回调处理函数
@@ -234,10 +349,13 @@ func (c *Controller) run(ctx context.Context) {
 
 	// 在执行 WaitForCacheSync() (和 启动 Worker ???)之前, 一定要先运行如下语句.
 	// 否则 WaitForCacheSync() 会卡住, 而且貌似根本进不去这个函数.
+	c.sipHelper.StartOwnerInformers(c.stopCh)
 	c.kuberInformerFactory.Start(c.stopCh)
 	c.crdInformerFactory.Start(c.stopCh)
 
-	ok := cgcache.WaitForCacheSync(c.stopCh, c.sipSynced, c.deploySynced)
+	ok := cgcache.WaitForCacheSync(
+		c.stopCh, c.sipSynced, c.deploySynced, c.stsSynced, c.dsSynced, c.podSynced, c.rsSynced,
+	)
 	if !ok {
 		klog.Fatal("failed to wait for caches to sync")
 		return
@@ -246,12 +364,25 @@ func (c *Controller) run(ctx context.Context) {
 	klog.Info("Starting workers")
 	go utilwait.Until(c.runAddDeployWorker, time.Second, c.stopCh)
 	go utilwait.Until(c.runUpdateDeployWorker, time.Second, c.stopCh)
+	go utilwait.Until(c.runRetireDeployWorker, time.Second, c.stopCh)
+	go utilwait.Until(c.runAdoptDeployWorker, time.Second, c.stopCh)
 	// 貌似因为设置了 Owner, 所以当 deploy 被移除的时候, 被绑定的 StaticIP 也会被移除.
-	// 不需要额外的 del 操作.
-	// go utilwait.Until(c.runDelDeployWorker, time.Second, c.stopCh)
+	// 不需要额外的 del 操作, StaticIP 的 finalizer 由 runSyncSIPWorker 处理.
+
+	go utilwait.Until(c.runAddStsWorker, time.Second, c.stopCh)
+	go utilwait.Until(c.runUpdateStsWorker, time.Second, c.stopCh)
+	go utilwait.Until(c.runAddDsWorker, time.Second, c.stopCh)
+	go utilwait.Until(c.runUpdateDsWorker, time.Second, c.stopCh)
 
 	go utilwait.Until(c.runAddPodWorker, time.Second, c.stopCh)
 	go utilwait.Until(c.runDelPodWorker, time.Second, c.stopCh)
+	go utilwait.Until(c.runTermPodWorker, time.Second, c.stopCh)
+	go utilwait.Until(c.runSyncSIPWorker, time.Second, c.stopCh)
+	go utilwait.Until(c.runDelSIPWorker, time.Second, c.stopCh)
+	go utilwait.Until(c.runEvictSIPWorker, time.Second, c.stopCh)
+	go utilwait.Until(c.reclaimReleasingIPs, reclaimInterval, c.stopCh)
+	go utilwait.Until(c.collectOrphanIPs, gcInterval, c.stopCh)
+	go utilwait.Until(c.collectStaleBlocks, gcInterval, c.stopCh)
 
 	klog.Info("Started workers")
 	<-c.stopCh
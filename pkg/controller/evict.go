@@ -0,0 +1,161 @@
+package controller
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	apimerrors "k8s.io/apimachinery/pkg/api/errors"
+	apimmetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apimtypes "k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	cgcache "k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+
+	ipkv1 "github.com/generals-space/crd-ipkeeper/pkg/apis/ipkeeper/v1"
+	"github.com/generals-space/crd-ipkeeper/pkg/staticip"
+	"github.com/generals-space/crd-ipkeeper/pkg/util"
+)
+
+// IP 池缩小后, 占用了被移除的 IP 的 Pod 记录在 StaticIP 的 status.evicting 中.
+// controller 通过 Eviction 接口逐个驱逐这些 Pod, 以遵守 PodDisruptionBudget,
+// 每个 StaticIP 每隔 evictInterval 最多驱逐一个 Pod, 驱逐被拒绝时稍后重试.
+// 进度记录在 StaticIP 的 status.shrink 中.
+
+// evictInterval 同一个 StaticIP 两次驱逐之间的最小间隔.
+const evictInterval = 10 * time.Second
+
+// enqueueEvictSIP 还有 Pod 等待驱逐的 StaticIP 加入 evictSIPQueue, controller 重启后也能继续驱逐.
+// caller: c.enqueueAddSIP(), c.enqueueUpdateSIP()
+func (c *Controller) enqueueEvictSIP(obj interface{}) {
+	if !c.isLeader() {
+		return
+	}
+	sip := obj.(*ipkv1.StaticIP)
+	if len(sip.Status.Evicting) == 0 || sip.DeletionTimestamp != nil {
+		return
+	}
+	key, err := cgcache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	c.evictSIPQueue.Add(key)
+}
+
+//////////////////////////////////////////////////////////////
+// process 实际操作 Evict 部分
+func (c *Controller) runEvictSIPWorker() {
+	for c.processNextEvictSIPWorkItem() {
+	}
+}
+
+func (c *Controller) processNextEvictSIPWorkItem() bool {
+	obj, shutdown := c.evictSIPQueue.Get()
+	if shutdown {
+		return false
+	}
+	err := c.processNextWorkItem(obj, c.evictSIPQueue, c.handleEvictSIP)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return true
+	}
+
+	return true
+}
+
+// handleEvictSIP 移除 Evicting 中已经退出的 Pod, 并驱逐下一个仍在运行的 Pod,
+// 还有 Pod 需要驱逐时, 过一段时间再次入队.
+func (c *Controller) handleEvictSIP(key string) (err error) {
+	ns, name, err := cgcache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return nil
+	}
+	sip, err := c.sipLister.StaticIPs(ns).Get(name)
+	if err != nil {
+		if apimerrors.IsNotFound(err) {
+			return nil
+		}
+		return
+	}
+	// 正在删除的 StaticIP 由 handleSyncSIP() 等待 Pod 退出.
+	if sip.DeletionTimestamp != nil {
+		return nil
+	}
+
+	gone := map[string]apimtypes.UID{}
+	for ip, ownerPod := range sip.Status.Evicting {
+		if ownerPod != nil && c.isOrphan(ownerPod) {
+			gone[ip] = ownerPod.UID
+		}
+	}
+	pending := []*corev1.Pod{}
+	for _, ownerPod := range staticip.EvictingPods(sip) {
+		if c.isOrphan(ownerPod) {
+			continue
+		}
+		pod, err := c.podLister.Pods(ownerPod.Namespace).Get(ownerPod.Name)
+		if err != nil {
+			continue
+		}
+		pending = append(pending, pod)
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Name < pending[j].Name })
+
+	shrink := &ipkv1.ShrinkStatus{}
+	if sip.Status.Shrink != nil {
+		shrink = sip.Status.Shrink.DeepCopy()
+	}
+	shrink.Pending = int32(len(pending))
+	if len(pending) == 0 {
+		shrink.Message = "all pods using removed ips are evicted"
+		return c.sipHelper.UpdateShrink(sip, gone, shrink)
+	}
+	defer c.evictSIPQueue.AddAfter(key, evictInterval)
+
+	// 已经在退出的 Pod 不需要再次驱逐.
+	var pod *corev1.Pod
+	for _, p := range pending {
+		if p.DeletionTimestamp == nil {
+			pod = p
+			break
+		}
+	}
+	if pod == nil {
+		shrink.Message = fmt.Sprintf("waiting for %d evicted pods to exit", len(pending))
+		return c.sipHelper.UpdateShrink(sip, gone, shrink)
+	}
+	if shrink.LastEvictionTime.Add(evictInterval).After(time.Now()) {
+		return c.sipHelper.UpdateShrink(sip, gone, shrink)
+	}
+
+	err = c.kubeClient.PolicyV1beta1().Evictions(pod.Namespace).Evict(&policyv1beta1.Eviction{
+		ObjectMeta: apimmetav1.ObjectMeta{Namespace: pod.Namespace, Name: pod.Name},
+	})
+	if apimerrors.IsTooManyRequests(err) {
+		// PodDisruptionBudget 不允许此时驱逐.
+		staticip.RecordEvent(
+			c.recorder, sip, pod, corev1.EventTypeWarning, util.EventEvictionBlocked,
+			"eviction of pod %s is blocked: %s", pod.Name, err,
+		)
+		shrink.Blocked++
+		shrink.LastEvictionTime = apimmetav1.Now()
+		shrink.Message = fmt.Sprintf("eviction of pod %s is blocked: %s", pod.Name, err)
+		return c.sipHelper.UpdateShrink(sip, gone, shrink)
+	}
+	if err != nil && !apimerrors.IsNotFound(err) {
+		return
+	}
+	klog.Infof("evict pod %s/%s which is using an ip removed from the pool", pod.Namespace, pod.Name)
+	staticip.RecordEvent(
+		c.recorder, sip, pod, corev1.EventTypeNormal, util.EventPodEvicted,
+		"evicted pod %s because its ip is removed from the pool", pod.Name,
+	)
+	shrink.Evicted++
+	shrink.LastEvictionTime = apimmetav1.Now()
+	shrink.Message = fmt.Sprintf("evicted pod %s", pod.Name)
+	return c.sipHelper.UpdateShrink(sip, gone, shrink)
+}
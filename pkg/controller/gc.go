@@ -0,0 +1,143 @@
+package controller
+
+import (
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apimerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	apimtypes "k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	cgcache "k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+
+	ipkv1 "github.com/generals-space/crd-ipkeeper/pkg/apis/ipkeeper/v1"
+	"github.com/generals-space/crd-ipkeeper/pkg/util"
+)
+
+// 正常情况下 IP 在 Pod 删除或运行结束时由 handleDelPod() 释放,
+// 但 controller 停止运行, 失去 leader 身份, 或是错过了删除事件时, IP 会一直被已经不存在的 Pod 占用,
+// informer 的 resync 也无法修复这种情况. 这里定期遍历所有 StaticIP 回收这些 IP.
+
+// gcInterval 检查泄漏 IP 的间隔.
+const gcInterval = time.Minute
+
+// gcGracePeriod IP 的 owner 不存在的状态持续这么久之后才会被回收.
+// CNI server 分配 IP 时, controller 的 podLister 中可能还没有这个 Pod, 需要等待缓存同步.
+const gcGracePeriod = 2 * time.Minute
+
+// collectOrphanIPs 遍历所有 StaticIP, 回收其中被已不存在(或已运行结束)的 Pod 占用的 IP,
+// 并在 StaticIP 上为每个回收的 IP 记录事件, 回收的累计数量见 status.reclaimedTotal.
+func (c *Controller) collectOrphanIPs() {
+	sips, err := c.sipLister.List(labels.Everything())
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	now := time.Now()
+	seen := map[string]bool{}
+	for _, sip := range sips {
+		orphans := map[string]apimtypes.UID{}
+		candidates := map[string]*ipkv1.OwnerPod{}
+		// Evicting 中的记录通常由 handleEvictSIP() 在 Pod 退出后移除, 但 Pod 在没有 leader 运行时退出的话,
+		// 之后 StaticIP 不会再有变化, 也就不会再入队, 这里同样需要回收.
+		for _, ipMap := range []map[string]*ipkv1.OwnerPod{
+			sip.Status.IPMap, sip.Status.Draining, sip.Status.Evicting,
+		} {
+			for ip, ownerPod := range ipMap {
+				candidates[ip] = ownerPod
+			}
+		}
+		for ip, ownerPod := range candidates {
+			if ownerPod == nil || !c.isOrphan(ownerPod) {
+				continue
+			}
+			key := orphanKey(sip, ip, ownerPod)
+			seen[key] = true
+			since, ok := c.orphanSince[key]
+			if !ok {
+				c.orphanSince[key] = now
+				continue
+			}
+			if now.Sub(since) >= gcGracePeriod {
+				orphans[ip] = ownerPod.UID
+			}
+		}
+		if len(orphans) == 0 {
+			continue
+		}
+		reclaimed, err := c.sipHelper.ReleaseOrphanIPs(sip, orphans)
+		if err != nil {
+			utilruntime.HandleError(fmt.Errorf("failed to reclaim orphan ips of %s/%s: %s", sip.Namespace, sip.Name, err))
+			continue
+		}
+		for ip, ownerPod := range reclaimed {
+			klog.Infof("reclaim ip %s of staticip %s/%s from pod %s", ip, sip.Namespace, sip.Name, ownerPod.Name)
+			c.recorder.Eventf(
+				sip, corev1.EventTypeNormal, util.EventIPReclaimed,
+				"reclaimed ip %s from pod %s/%s(%s) which no longer exists",
+				ip, ownerPod.Namespace, ownerPod.Name, ownerPod.UID,
+			)
+		}
+	}
+	// 已经恢复正常或已被回收的记录.
+	for key := range c.orphanSince {
+		if !seen[key] {
+			delete(c.orphanSince, key)
+		}
+	}
+}
+
+// collectStaleBlocks 归还 IPPool 中已经不存在的 StaticIP 划分到的 IP.
+// 正常情况下由 handleDelSIP() 归还, 但 StaticIP 在没有 leader 运行时被删除的话, 删除事件就丢失了.
+// StaticIP 创建前会先划分 IP, 所以同样要等待 gcGracePeriod, 以免归还正在创建的 StaticIP 的 IP.
+func (c *Controller) collectStaleBlocks() {
+	sipKeys, err := c.sipHelper.PoolBlockOwners()
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	now := time.Now()
+	for _, sipKey := range sipKeys {
+		ns, name, err := cgcache.SplitMetaNamespaceKey(sipKey)
+		if err != nil {
+			utilruntime.HandleError(err)
+			continue
+		}
+		_, err = c.sipLister.StaticIPs(ns).Get(name)
+		if !apimerrors.IsNotFound(err) {
+			delete(c.blockOrphanSince, sipKey)
+			continue
+		}
+		since, ok := c.blockOrphanSince[sipKey]
+		if !ok {
+			c.blockOrphanSince[sipKey] = now
+			continue
+		}
+		if now.Sub(since) < gcGracePeriod {
+			continue
+		}
+		klog.Infof("release block of staticip %s which no longer exists", sipKey)
+		if err = c.sipHelper.ReleasePoolBlock(sipKey); err != nil {
+			utilruntime.HandleError(err)
+			continue
+		}
+		delete(c.blockOrphanSince, sipKey)
+	}
+}
+
+// isOrphan 判断 ownerPod 是否已经不存在, 同名但 UID 不同的 Pod 是重建后的新 Pod, 也视为不存在.
+// 运行结束的 Pod 同样不再需要 IP, 见 enqueueUpdatePod().
+func (c *Controller) isOrphan(ownerPod *ipkv1.OwnerPod) bool {
+	pod, err := c.podLister.Pods(ownerPod.Namespace).Get(ownerPod.Name)
+	if err != nil {
+		return apimerrors.IsNotFound(err)
+	}
+	return pod.UID != ownerPod.UID || podCompleted(pod)
+}
+
+// orphanKey 记录 orphanSince 使用的 key.
+func orphanKey(sip *ipkv1.StaticIP, ip string, ownerPod *ipkv1.OwnerPod) string {
+	return fmt.Sprintf("%s/%s/%s/%s", sip.Namespace, sip.Name, ip, ownerPod.UID)
+}
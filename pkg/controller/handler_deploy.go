@@ -2,6 +2,7 @@ package controller
 
 import (
 	appsv1 "k8s.io/api/apps/v1"
+	apimerrors "k8s.io/apimachinery/pkg/api/errors"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	cgcache "k8s.io/client-go/tools/cache"
 	"k8s.io/klog"
@@ -28,8 +29,7 @@ func (c *Controller) enqueueAddDeploy(obj interface{}) {
 	}
 
 	deploy := obj.(*appsv1.Deployment)
-	if deploy.Annotations[util.IPPoolAnnotation] != "" &&
-		deploy.Annotations[util.GatewayAnnotation] != "" {
+	if c.sipHelper.OwnerKindAllowed("Deployment") && util.HasIPPoolAnnotations(deploy.Annotations) {
 		klog.Infof("enqueue add ip pool deploy %s", key)
 		c.addDeployQueue.AddRateLimited(key)
 	}
@@ -59,21 +59,24 @@ func (c *Controller) enqueueUpdateDeploy(oldObj, newObj interface{}) {
 		utilruntime.HandleError(err)
 		return
 	}
-	prev := oldD.Annotations[util.IPPoolAnnotation] != "" &&
-		oldD.Annotations[util.GatewayAnnotation] != ""
-	next := newD.Annotations[util.IPPoolAnnotation] != "" &&
-		newD.Annotations[util.GatewayAnnotation] != ""
+	prev := util.HasIPPoolAnnotations(oldD.Annotations)
+	next := util.HasIPPoolAnnotations(newD.Annotations)
 
 	if !prev && next {
-		// 1. IPPool 注解从无到有: 要走的是 Add 流程
-		// c.addDeployQueue.AddRateLimited(newKey)
+		// 1. IPPool 注解从无到有: 要走的是 Add 流程, 已有的 Pod 按 adopt_pods 注解决定是否重建.
+		klog.Infof("enqueue add ip pool deploy %s", key)
+		c.addDeployQueue.AddRateLimited(key)
 	} else if prev && !next {
-		// 2. IPPool 注解从有到无: 要走的是 Del 流程
-		// c.delDeployQueue.AddRateLimited(newKey)
+		// 2. IPPool 注解从有到无: 已分配的 IP 继续使用, 新 Pod 不再分配 IP, 全部释放后删除 StaticIP.
+		klog.Infof("enqueue retire ip pool deploy %s", key)
+		c.retireDeployQueue.AddRateLimited(key)
 	} else if prev && next {
 		// 3. IPPool 发生变化: StaticIP 资源不变, 内容需要进行修改
-		if oldD.Annotations[util.IPPoolAnnotation] == newD.Annotations[util.IPPoolAnnotation] &&
-			oldD.Annotations[util.GatewayAnnotation] == newD.Annotations[util.GatewayAnnotation] {
+		if oldD.Annotations[util.AdoptPodsAnnotation] != newD.Annotations[util.AdoptPodsAnnotation] {
+			c.enqueueAdoptDeploy(key, newD.Annotations)
+		}
+		if !ipPoolChanged(oldD.Annotations, newD.Annotations, oldD.Spec.Replicas, newD.Spec.Replicas) &&
+			!surgeChanged(oldD, newD) {
 			// 如果 IPPool 和 Gateway 注解值未发生变动, 则无需操作
 			return
 		}
@@ -85,6 +88,45 @@ func (c *Controller) enqueueUpdateDeploy(oldObj, newObj interface{}) {
 	return
 }
 
+// ipPoolChanged 判断 deploy, statefulset, daemonset 等资源声明的 IP 池是否发生了变化.
+// 对于引用 IPPool 或 ip_pool 中有 IPv6 大网段, 且未指定 pool_size 的资源, replicas 的变化也会影响划分到的 IP 数量.
+func ipPoolChanged(oldAnno, newAnno map[string]string, oldReplicas, newReplicas *int32) bool {
+	for _, anno := range []string{
+		util.IPPoolAnnotation,
+		util.GatewayAnnotation,
+		util.PoolNameAnnotation,
+		util.PoolSizeAnnotation,
+		util.NodeIPsAnnotation,
+		util.StrategyAnnotation,
+		util.ReleaseCooldownAnnotation,
+		util.ShrinkPolicyAnnotation,
+	} {
+		if oldAnno[anno] != newAnno[anno] {
+			return true
+		}
+	}
+	if (newAnno[util.PoolNameAnnotation] != "" || staticip.HasLargeSubnet(newAnno[util.IPPoolAnnotation])) &&
+		newAnno[util.PoolSizeAnnotation] == "" {
+		oldNum, newNum := int32(1), int32(1)
+		if oldReplicas != nil {
+			oldNum = *oldReplicas
+		}
+		if newReplicas != nil {
+			newNum = *newReplicas
+		}
+		return oldNum != newNum
+	}
+	return false
+}
+
+// surgeChanged 判断 Deployment 的 replicas 或滚动更新策略是否发生了变化,
+// 此时需要重新检查 IP 池能否容纳滚动更新时多出来的 Pod, 见 c.checkSurgeCapacity().
+func surgeChanged(oldD, newD *appsv1.Deployment) bool {
+	oldCap, _ := staticip.SurgeCapacity(oldD)
+	newCap, _ := staticip.SurgeCapacity(newD)
+	return oldCap != newCap
+}
+
 //////////////////////////////////////////////////////////////
 // process 实际操作 Add 部分
 func (c *Controller) runAddDeployWorker() {
@@ -145,8 +187,28 @@ func (c *Controller) handleAddDeploy(key string) (err error) {
 	if deploy == nil {
 		return nil
 	}
+	if deploy.Annotations[util.PoolNameAnnotation] == "" &&
+		!c.checkIPPoolAnnotation(deploy, deploy.Annotations[util.IPPoolAnnotation]) {
+		return nil
+	}
+
+	if c.waitForTerminatingSIP(deploy, "Deployment", key, c.addDeployQueue) {
+		return nil
+	}
+	// 放在创建 StaticIP 之前, controller 重启时 StaticIP 已经存在, 仍要继续之前的接管.
+	c.enqueueAdoptDeploy(key, deploy.Annotations)
 
-	return c.sipHelper.CreateStaticIP(deploy, "Deployment")
+	sip, err := c.sipHelper.GetStaticIP(deploy, "Deployment")
+	if err == nil && staticip.IsRetiring(sip) {
+		// IP 池注解被移除后又被加了回来, 此时 StaticIP 还没有被删除, 按更新流程恢复.
+		return c.handleUpdateDeploy(key)
+	}
+	err = c.sipHelper.CreateStaticIP(deploy, "Deployment")
+	if err != nil {
+		return
+	}
+	c.checkSurgeCapacity(deploy)
+	return
 }
 
 //////////////////////////////////////////////////////////////
@@ -186,9 +248,76 @@ func (c *Controller) handleUpdateDeploy(key string) (err error) {
 	if deploy == nil {
 		return nil
 	}
+	if deploy.Annotations[util.PoolNameAnnotation] == "" &&
+		!c.checkIPPoolAnnotation(deploy, deploy.Annotations[util.IPPoolAnnotation]) {
+		return nil
+	}
 
 	oldSIP, err := c.sipHelper.GetStaticIP(deploy, "Deployment")
-	newSIP := c.sipHelper.NewStaticIP(deploy, "Deployment")
+	if err != nil {
+		return
+	}
+	newSIP, err := c.sipHelper.NewStaticIP(deploy, "Deployment")
+	if err != nil {
+		return
+	}
 
-	return staticip.RenewStaticIP(c.kubeClient, c.crdClient, oldSIP, newSIP)
+	err = c.renewStaticIP(oldSIP, newSIP)
+	if err != nil {
+		return
+	}
+	c.checkSurgeCapacity(deploy)
+	return
+}
+
+//////////////////////////////////////////////////////////////
+// process 实际操作 Retire 部分
+func (c *Controller) runRetireDeployWorker() {
+	for c.processNextRetireDeployWorkItem() {
+	}
+}
+
+func (c *Controller) processNextRetireDeployWorkItem() bool {
+	obj, shutdown := c.retireDeployQueue.Get()
+	if shutdown {
+		return false
+	}
+	err := c.processNextRetryWorkItem(obj, c.retireDeployQueue, c.handleRetireDeploy)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return true
+	}
+
+	return true
+}
+
+// handleRetireDeploy deployment 的 IP 池注解被移除后, 将其 StaticIP 标记为 Retiring,
+// 没有 Pod 占用 IP 时直接删除, 否则等到最后一个 IP 被释放时删除, 见 staticip.RetireStaticIP().
+// 这里不能使用 c.getDeployFromKey(), 因为此时 deploy 已经没有 IP 池注解了.
+func (c *Controller) handleRetireDeploy(key string) (err error) {
+	ns, name, err := cgcache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return nil
+	}
+	deploy, err := c.deployLister.Deployments(ns).Get(name)
+	if err != nil {
+		// deploy 被删除时 StaticIP 会随之被删除.
+		if apimerrors.IsNotFound(err) {
+			return nil
+		}
+		return
+	}
+	// 注解在此期间又被加了回来.
+	if util.HasIPPoolAnnotations(deploy.Annotations) {
+		return nil
+	}
+	sip, err := c.sipHelper.GetStaticIP(deploy, "Deployment")
+	if err != nil {
+		if apimerrors.IsNotFound(err) {
+			return nil
+		}
+		return
+	}
+	return c.sipHelper.RetireStaticIP(sip)
 }
@@ -0,0 +1,151 @@
+package controller
+
+import (
+	appsv1 "k8s.io/api/apps/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	cgcache "k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+
+	"github.com/generals-space/crd-ipkeeper/pkg/util"
+)
+
+// DaemonSet 的处理流程与 Deployment 基本相同, 见 handler_deploy.go.
+// 区别在于分配 IP 时按节点绑定, 见 staticip.pickNodeIPs().
+
+//////////////////////////////////////////////////////////////
+// enqueue 前期操作
+func (c *Controller) enqueueAddDs(obj interface{}) {
+	if !c.isLeader() {
+		return
+	}
+	key, err := cgcache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+
+	ds := obj.(*appsv1.DaemonSet)
+	if c.sipHelper.OwnerKindAllowed("DaemonSet") && util.HasIPPoolAnnotations(ds.Annotations) {
+		klog.Infof("enqueue add ip pool daemonset %s", key)
+		c.addDsQueue.AddRateLimited(key)
+	}
+	return
+}
+
+func (c *Controller) enqueueUpdateDs(oldObj, newObj interface{}) {
+	if !c.isLeader() {
+		return
+	}
+
+	oldD := oldObj.(*appsv1.DaemonSet)
+	newD := newObj.(*appsv1.DaemonSet)
+
+	if oldD.ResourceVersion == newD.ResourceVersion {
+		return
+	}
+
+	key, err := cgcache.MetaNamespaceKeyFunc(newObj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	prev := util.HasIPPoolAnnotations(oldD.Annotations)
+	next := util.HasIPPoolAnnotations(newD.Annotations)
+
+	if prev && next {
+		if !ipPoolChanged(oldD.Annotations, newD.Annotations, nil, nil) {
+			return
+		}
+		klog.Infof("enqueue update ip pool daemonset %s", key)
+		c.updateDsQueue.AddRateLimited(key)
+	}
+	return
+}
+
+//////////////////////////////////////////////////////////////
+// process 实际操作 Add 部分
+func (c *Controller) runAddDsWorker() {
+	for c.processNextAddDsWorkItem() {
+	}
+}
+
+func (c *Controller) processNextAddDsWorkItem() bool {
+	obj, shutdown := c.addDsQueue.Get()
+	if shutdown {
+		return false
+	}
+	err := c.processNextWorkItem(obj, c.addDsQueue, c.handleAddDs)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return true
+	}
+
+	return true
+}
+
+func (c *Controller) handleAddDs(key string) (err error) {
+	ds, err := c.getDsFromKey(key)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	if ds == nil {
+		return nil
+	}
+	if ds.Annotations[util.PoolNameAnnotation] == "" &&
+		!c.checkIPPoolAnnotation(ds, ds.Annotations[util.IPPoolAnnotation]) {
+		return nil
+	}
+	if c.waitForTerminatingSIP(ds, "DaemonSet", key, c.addDsQueue) {
+		return nil
+	}
+
+	return c.sipHelper.CreateStaticIP(ds, "DaemonSet")
+}
+
+//////////////////////////////////////////////////////////////
+// process 实际操作 Update 部分
+func (c *Controller) runUpdateDsWorker() {
+	for c.processNextUpdateDsWorkItem() {
+	}
+}
+
+func (c *Controller) processNextUpdateDsWorkItem() bool {
+	obj, shutdown := c.updateDsQueue.Get()
+	if shutdown {
+		return false
+	}
+	err := c.processNextWorkItem(obj, c.updateDsQueue, c.handleUpdateDs)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return true
+	}
+
+	return true
+}
+
+func (c *Controller) handleUpdateDs(key string) (err error) {
+	ds, err := c.getDsFromKey(key)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	if ds == nil {
+		return nil
+	}
+	if ds.Annotations[util.PoolNameAnnotation] == "" &&
+		!c.checkIPPoolAnnotation(ds, ds.Annotations[util.IPPoolAnnotation]) {
+		return nil
+	}
+
+	oldSIP, err := c.sipHelper.GetStaticIP(ds, "DaemonSet")
+	if err != nil {
+		return
+	}
+	newSIP, err := c.sipHelper.NewStaticIP(ds, "DaemonSet")
+	if err != nil {
+		return
+	}
+
+	return c.renewStaticIP(oldSIP, newSIP)
+}
@@ -1,12 +1,19 @@
 package controller
 
 import (
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	apimerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	cgcache "k8s.io/client-go/tools/cache"
 	"k8s.io/klog"
 
 	ipkv1 "github.com/generals-space/crd-ipkeeper/pkg/apis/ipkeeper/v1"
+	"github.com/generals-space/crd-ipkeeper/pkg/staticip"
+	"github.com/generals-space/crd-ipkeeper/pkg/util"
 )
 
 //////////////////////////////////////////////////////////////
@@ -47,27 +54,85 @@ func (c *Controller) enqueueDelPod(obj interface{}) {
 	// 将该对象(应该是将该对象的事件)放入 cache 缓存, 即在本地保存 deploy 资源列表,
 	// 之前先从 cache 取数据, 以减轻 apiserver 的压力.
 	// key 的格式如 kube-system/devops-deploy
-	key, err = cgcache.MetaNamespaceKeyFunc(obj)
+	key, err = cgcache.DeletionHandlingMetaNamespaceKeyFunc(obj)
 	if err != nil {
 		utilruntime.HandleError(err)
 		return
 	}
-	pod := obj.(*corev1.Pod)
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		// 错过了删除事件时, obj 为 DeletedFinalStateUnknown 类型.
+		tombstone, ok := obj.(cgcache.DeletedFinalStateUnknown)
+		if !ok {
+			return
+		}
+		if pod, ok = tombstone.Obj.(*corev1.Pod); !ok {
+			return
+		}
+		key = tombstone.Key
+	}
 	// 直属于 Pod 的 StaticIP 资源会随 Pod 一同被移除, 不需要额外操作.
 	if pod.OwnerReferences == nil {
 		return
 	}
-	// 查询是否存在当前 Pod 对应的 StaticIP 对象
-	_, err = c.sipHelper.GetPodOwnerSIP(pod)
+	// 查询是否存在当前 Pod 对应的 StaticIP 对象, owner 的 IP 池注解被移除后仍需要释放 IP.
+	sip, err := c.sipHelper.FindPodOwnerSIP(pod)
 	if err != nil {
 		utilruntime.HandleError(err)
 		return
 	}
+	if sip == nil {
+		return
+	}
 
+	c.deletedPods.Store(key, pod)
 	c.delPodQueue.AddRateLimited(key)
 	return
 }
 
+// enqueueUpdatePod Pod 进入 Succeeded 或 Failed 状态时, 其容器已经全部退出,
+// 此时即释放其占用的 IP, 而不必等到 Pod 对象被删除.
+// Job, CronJob 完成后的 Pod 往往会保留很长时间, 如果等到删除时再释放, IP 池很快就会耗尽.
+func (c *Controller) enqueueUpdatePod(oldObj, newObj interface{}) {
+	if !c.isLeader() {
+		return
+	}
+	oldPod := oldObj.(*corev1.Pod)
+	newPod := newObj.(*corev1.Pod)
+	key, err := cgcache.MetaNamespaceKeyFunc(newObj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	// Pod 开始退出.
+	if newPod.DeletionTimestamp != nil && oldPod.DeletionTimestamp == nil &&
+		newPod.Labels[appsv1.DefaultDeploymentUniqueLabelKey] != "" {
+		c.termPodQueue.AddRateLimited(key)
+	}
+	if !podCompleted(newPod) || podCompleted(oldPod) {
+		return
+	}
+	// 查询是否存在当前 Pod 对应的 StaticIP 对象
+	sip, err := c.sipHelper.FindPodOwnerSIP(newPod)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	if sip == nil {
+		return
+	}
+	klog.Infof("enqueue completed pod %s to release its ip", key)
+	// 与 enqueueDelPod() 相同, 保存一份 Pod 对象供 handleDelPod() 使用.
+	c.deletedPods.Store(key, newPod)
+	c.delPodQueue.AddRateLimited(key)
+	return
+}
+
+// podCompleted 判断 Pod 是否已经运行结束.
+func podCompleted(pod *corev1.Pod) bool {
+	return pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed
+}
+
 //////////////////////////////////////////////////////////////
 // process 实际操作 Add 部分
 func (c *Controller) runAddPodWorker() {
@@ -109,12 +174,30 @@ func (c *Controller) handleAddPod(key string) (err error) {
 	// 查询是否存在当前 Pod 对应的 StaticIP 对象
 	sip, err = c.sipHelper.GetPodOwnerSIP(pod)
 	if err != nil {
-		klog.Warning("failed to find static ip for pod %s: %s", pod.Name, err)
+		klog.Warningf("failed to find static ip for pod %s: %s", pod.Name, err)
 		return nil
 	}
-	// 当 Pod 没有 Owner 时, err 为 nil, sip 也为 nil, 此时需要为其创建对应 StaticIP 对象.
+	// 当 Pod 没有 Owner, 或 Owner 是 controller 没有直接监听的资源类型(如 CloneSet)时,
+	// err 为 nil, sip 也为 nil, 此时需要为其 owner 创建对应 StaticIP 对象.
 	if sip == nil {
-		return c.sipHelper.CreateStaticIP(pod, "Pod")
+		owner, ownerKind, err := c.sipHelper.GetPodOwner(pod)
+		if err != nil {
+			klog.Warningf("failed to find owner for pod %s: %s", pod.Name, err)
+			return nil
+		}
+		poolKey := util.IPPoolAnnotation
+		if ownerKind == "Pod" {
+			poolKey = util.IPAddressAnnotation
+		}
+		ownerObj, ok := owner.(runtime.Object)
+		if !ok {
+			return nil
+		}
+		if owner.GetAnnotations()[util.PoolNameAnnotation] == "" &&
+			!c.checkIPPoolAnnotation(ownerObj, owner.GetAnnotations()[poolKey]) {
+			return nil
+		}
+		return c.sipHelper.CreateStaticIP(owner, ownerKind)
 	}
 
 	return
@@ -138,7 +221,8 @@ func (c *Controller) processNextDelPodWorkItem() bool {
 	if shutdown {
 		return false
 	}
-	err = c.processNextWorkItem(obj, c.delPodQueue, c.handleDelPod)
+	// 删除事件不会再次触发, 释放失败时需要重新入队, 否则 IP 会一直泄漏到 GC 时.
+	err = c.processNextRetryWorkItem(obj, c.delPodQueue, c.handleDelPod)
 	if err != nil {
 		utilruntime.HandleError(err)
 		return true
@@ -148,22 +232,93 @@ func (c *Controller) processNextDelPodWorkItem() bool {
 }
 
 func (c *Controller) handleDelPod(key string) (err error) {
-	pod, err := c.getPodFromKey(key)
+	// 优先使用 enqueueDelPod() 中保存的被删除的 Pod 对象.
+	// StatefulSet 的 Pod 会以相同的名称重建, lister 中同名的 Pod 可能已经是新的 Pod,
+	// 按名称查找会释放掉新 Pod 正在使用的 IP, 而被删除的 Pod 的 IP 则一直泄漏.
+	var pod *corev1.Pod
+	if obj, ok := c.deletedPods.Load(key); ok {
+		pod = obj.(*corev1.Pod)
+	} else {
+		// 运行结束的 Pod 仍然存在, 从 lister 中获取, 只有确实已经运行结束时才释放.
+		pod, err = c.getPodFromKey(key)
+		if apimerrors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return
+		}
+		if !podCompleted(pod) {
+			return nil
+		}
+	}
+	// 查询是否存在当前 Pod 对应的 StaticIP 对象
+	sip, err := c.sipHelper.FindPodOwnerSIP(pod)
+	if err != nil || sip == nil {
+		klog.Warningf("failed to find static ip for pod %s: %v", pod.Name, err)
+		c.deletedPods.Delete(key)
+		return nil
+	}
+
+	////////////////////////////////////////////////////////////////////
+	released, err := c.sipHelper.ReleaseIP(sip, pod, "")
+	if err != nil {
+		return
+	}
+	c.deletedPods.Delete(key)
+	if len(released) != 0 {
+		staticip.RecordEvent(
+			c.recorder, sip, pod, corev1.EventTypeNormal, util.EventAddressReleased,
+			"released ip %s of pod %s", strings.Join(released, ","), pod.Name,
+		)
+	}
+	return
+}
+
+//////////////////////////////////////////////////////////////
+// process 实际操作 Terminating 部分
+func (c *Controller) runTermPodWorker() {
+	for c.processNextTermPodWorkItem() {
+	}
+}
+
+func (c *Controller) processNextTermPodWorkItem() bool {
+	obj, shutdown := c.termPodQueue.Get()
+	if shutdown {
+		return false
+	}
+	err := c.processNextWorkItem(obj, c.termPodQueue, c.handleTermPod)
 	if err != nil {
 		utilruntime.HandleError(err)
+		return true
+	}
+
+	return true
+}
+
+// handleTermPod Deployment 滚动更新时, 旧版本的 Pod 开始退出后, 将其 IP 预留给最新版本的 Pod.
+// 缩容等情况下退出的是最新版本的 Pod, 此时不需要预留.
+func (c *Controller) handleTermPod(key string) (err error) {
+	pod, err := c.getPodFromKey(key)
+	if apimerrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
 		return
 	}
-	// 当 pod 中不含 ipaddr 等字段时即为 nil, 也不需要处理.
-	if pod == nil {
+	owner, ownerKind, err := c.sipHelper.GetPodOwner(pod)
+	if err != nil || ownerKind != "Deployment" {
 		return nil
 	}
-	// 查询是否存在当前 Pod 对应的 StaticIP 对象
 	sip, err := c.sipHelper.GetPodOwnerSIP(pod)
+	if err != nil || sip == nil {
+		return nil
+	}
+	hash, err := staticip.NewestRevisionHash(c.rsLister, owner)
 	if err != nil {
-		klog.Warning("failed to find static ip for pod %s: %s", pod.Name, err)
+		return
+	}
+	if pod.Labels[appsv1.DefaultDeploymentUniqueLabelKey] == hash {
 		return nil
 	}
-
-	////////////////////////////////////////////////////////////////////
-	return c.sipHelper.ReleaseIP(sip, pod)
+	return c.sipHelper.ReserveForHandover(sip, pod, hash)
 }
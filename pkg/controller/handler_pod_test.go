@@ -0,0 +1,160 @@
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apimmetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apimtypes "k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	cgscheme "k8s.io/client-go/kubernetes/scheme"
+	cglisterscorev1 "k8s.io/client-go/listers/core/v1"
+	cgcache "k8s.io/client-go/tools/cache"
+	cgleaderelection "k8s.io/client-go/tools/leaderelection"
+	cgresourcelock "k8s.io/client-go/tools/leaderelection/resourcelock"
+	cgrecord "k8s.io/client-go/tools/record"
+	cgworkqueue "k8s.io/client-go/util/workqueue"
+
+	ipkv1 "github.com/generals-space/crd-ipkeeper/pkg/apis/ipkeeper/v1"
+	crdfake "github.com/generals-space/crd-ipkeeper/pkg/client/clientset/versioned/fake"
+	"github.com/generals-space/crd-ipkeeper/pkg/staticip"
+)
+
+const testPodIP = "172.16.0.1/24"
+
+// newTestController 创建只包含 Pod 相关队列的 Controller, 其中的 Job test 拥有 StaticIP job-test,
+// IP testPodIP 已经分配给了 pod. 锁的 identity 为空, IsLeader() 恒为 true.
+func newTestController(t *testing.T, pod *corev1.Pod) *Controller {
+	job := &batchv1.Job{
+		TypeMeta:   apimmetav1.TypeMeta{APIVersion: "batch/v1", Kind: "Job"},
+		ObjectMeta: apimmetav1.ObjectMeta{Name: "test", Namespace: "default", UID: "uid-job"},
+	}
+	sip := &ipkv1.StaticIP{
+		ObjectMeta: apimmetav1.ObjectMeta{Name: "job-test", Namespace: "default"},
+		Spec: ipkv1.StaticIPSpec{
+			Namespace: "default",
+			OwnerKind: "Job",
+			IPPool:    testPodIP,
+			Gateway:   "172.16.0.254",
+		},
+		Status: ipkv1.StaticIPStatus{
+			Avaliable: []string{},
+			Used:      []string{testPodIP},
+			IPMap: map[string]*ipkv1.OwnerPod{
+				testPodIP: {Namespace: pod.Namespace, Name: pod.Name, UID: pod.UID},
+			},
+		},
+	}
+	kubeClient := kubefake.NewSimpleClientset(pod)
+	kubeClient.Resources = []*apimmetav1.APIResourceList{
+		{
+			GroupVersion: "batch/v1",
+			APIResources: []apimmetav1.APIResource{{Name: "jobs", Kind: "Job", Namespaced: true}},
+		},
+	}
+	crdClient := crdfake.NewSimpleClientset(sip)
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(cgscheme.Scheme, job)
+
+	indexer := cgcache.NewIndexer(cgcache.MetaNamespaceKeyFunc, cgcache.Indexers{})
+	if err := indexer.Add(pod); err != nil {
+		t.Fatalf("failed to add pod to indexer: %s", err)
+	}
+	elector, err := cgleaderelection.NewLeaderElector(cgleaderelection.LeaderElectionConfig{
+		Lock:          &cgresourcelock.ConfigMapLock{},
+		LeaseDuration: 8 * time.Second,
+		RenewDeadline: 4 * time.Second,
+		RetryPeriod:   2 * time.Second,
+		Callbacks: cgleaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {},
+			OnStoppedLeading: func() {},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create leader elector: %s", err)
+	}
+	return &Controller{
+		kubeClient:   kubeClient,
+		crdClient:    crdClient,
+		sipHelper:    staticip.New(kubeClient, crdClient, dynamicClient, []string{"Job"}),
+		podLister:    cglisterscorev1.NewPodLister(indexer),
+		delPodQueue:  cgworkqueue.NewRateLimitingQueue(cgworkqueue.DefaultControllerRateLimiter()),
+		termPodQueue: cgworkqueue.NewRateLimitingQueue(cgworkqueue.DefaultControllerRateLimiter()),
+		recorder:     cgrecord.NewFakeRecorder(10),
+		elector:      elector,
+	}
+}
+
+func newJobPod(phase corev1.PodPhase) *corev1.Pod {
+	controller := true
+	return &corev1.Pod{
+		ObjectMeta: apimmetav1.ObjectMeta{
+			Name:      "test-abcde",
+			Namespace: "default",
+			UID:       apimtypes.UID("uid-pod"),
+			OwnerReferences: []apimmetav1.OwnerReference{
+				{APIVersion: "batch/v1", Kind: "Job", Name: "test", UID: "uid-job", Controller: &controller},
+			},
+		},
+		Status: corev1.PodStatus{Phase: phase},
+	}
+}
+
+// assertReleased 检查 testPodIP 已经从 StaticIP 的 IPMap 中释放.
+func assertReleased(t *testing.T, c *Controller) {
+	sip, err := c.crdClient.IpkeeperV1().StaticIPs("default").Get("job-test", apimmetav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get staticip: %s", err)
+	}
+	if ownerPod := sip.Status.IPMap[testPodIP]; ownerPod != nil {
+		t.Errorf("expected ip %s to be released, still owned by %s", testPodIP, ownerPod.Name)
+	}
+}
+
+// TestHandleDelPodCompleted 运行结束但没有被删除的 Pod 不在 deletedPods 中, 需要从 lister 中获取后释放其 IP.
+func TestHandleDelPodCompleted(t *testing.T) {
+	pod := newJobPod(corev1.PodSucceeded)
+	c := newTestController(t, pod)
+	if err := c.handleDelPod("default/test-abcde"); err != nil {
+		t.Fatalf("failed to handle pod: %s", err)
+	}
+	assertReleased(t, c)
+}
+
+// TestHandleDelPodRunning lister 中的 Pod 仍在运行时不释放其 IP.
+func TestHandleDelPodRunning(t *testing.T) {
+	pod := newJobPod(corev1.PodRunning)
+	c := newTestController(t, pod)
+	if err := c.handleDelPod("default/test-abcde"); err != nil {
+		t.Fatalf("failed to handle pod: %s", err)
+	}
+	sip, err := c.crdClient.IpkeeperV1().StaticIPs("default").Get("job-test", apimmetav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get staticip: %s", err)
+	}
+	if sip.Status.IPMap[testPodIP] == nil {
+		t.Errorf("ip %s of running pod should not be released", testPodIP)
+	}
+}
+
+// TestEnqueueUpdatePodCompleted Job 的 Pod 由 Running 变为 Succeeded 后, 不必等待 GC 即释放其 IP.
+func TestEnqueueUpdatePodCompleted(t *testing.T) {
+	oldPod := newJobPod(corev1.PodRunning)
+	newPod := newJobPod(corev1.PodSucceeded)
+	newPod.ResourceVersion = "2"
+	c := newTestController(t, newPod)
+
+	c.enqueueUpdatePod(oldPod, newPod)
+	if _, ok := c.deletedPods.Load("default/test-abcde"); !ok {
+		t.Errorf("completed pod should be stored in deletedPods")
+	}
+	// AddRateLimited() 会延迟入队, Get() 会一直等到 key 入队.
+	c.processNextDelPodWorkItem()
+	assertReleased(t, c)
+	if _, ok := c.deletedPods.Load("default/test-abcde"); ok {
+		t.Errorf("deletedPods entry should be removed after release")
+	}
+}
@@ -0,0 +1,188 @@
+package controller
+
+import (
+	"time"
+
+	apimerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	apimtypes "k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	cgcache "k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+
+	ipkv1 "github.com/generals-space/crd-ipkeeper/pkg/apis/ipkeeper/v1"
+	"github.com/generals-space/crd-ipkeeper/pkg/staticip"
+)
+
+//////////////////////////////////////////////////////////////
+// enqueue 前期操作
+
+func (c *Controller) enqueueAddSIP(obj interface{}) {
+	c.enqueueSyncSIP(obj)
+	c.enqueueEvictSIP(obj)
+}
+
+// enqueueSyncSIP 没有 finalizer, 或是正在被删除的 StaticIP 需要处理.
+func (c *Controller) enqueueSyncSIP(obj interface{}) {
+	if !c.isLeader() {
+		return
+	}
+	sip := obj.(*ipkv1.StaticIP)
+	if staticip.HasFinalizer(sip) && sip.DeletionTimestamp == nil {
+		return
+	}
+	key, err := cgcache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	c.syncSIPQueue.AddRateLimited(key)
+}
+
+func (c *Controller) enqueueUpdateSIP(oldObj, newObj interface{}) {
+	c.enqueueSyncSIP(newObj)
+	c.enqueueEvictSIP(newObj)
+}
+
+func (c *Controller) enqueueDelSIP(obj interface{}) {
+	if !c.isLeader() {
+		return
+	}
+	var key string
+	var err error
+	// StaticIP 被删除时, obj 可能是 DeletedFinalStateUnknown 类型, 需要使用这个函数获取 key.
+	key, err = cgcache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	// 只有引用了 IPPool 的 StaticIP 才需要在删除后归还 IP.
+	if sip, ok := obj.(*ipkv1.StaticIP); ok && sip.Spec.PoolRef == "" {
+		return
+	}
+	klog.Infof("enqueue del staticip %s", key)
+	c.delSIPQueue.AddRateLimited(key)
+}
+
+//////////////////////////////////////////////////////////////
+// process 实际操作 Sync 部分
+
+// finalizeInterval StaticIP 被删除后, 检查占用其 IP 的 Pod 是否已经退出的间隔.
+const finalizeInterval = 5 * time.Second
+
+func (c *Controller) runSyncSIPWorker() {
+	for c.processNextSyncSIPWorkItem() {
+	}
+}
+
+func (c *Controller) processNextSyncSIPWorkItem() bool {
+	obj, shutdown := c.syncSIPQueue.Get()
+	if shutdown {
+		return false
+	}
+	err := c.processNextRetryWorkItem(obj, c.syncSIPQueue, c.handleSyncSIP)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return true
+	}
+
+	return true
+}
+
+// handleSyncSIP 为没有 finalizer 的 StaticIP 添加 finalizer.
+// 对于正在被删除的 StaticIP, 释放其中已经不存在的 Pod 占用的 IP(不需要像 collectOrphanIPs() 那样等待,
+// 因为 StaticIP 已经不会再分配 IP 了), 还有 Pod 没有退出时稍后再次检查, 全部释放后移除 finalizer.
+func (c *Controller) handleSyncSIP(key string) (err error) {
+	ns, name, err := cgcache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return nil
+	}
+	sip, err := c.sipLister.StaticIPs(ns).Get(name)
+	if err != nil {
+		if apimerrors.IsNotFound(err) {
+			return nil
+		}
+		return
+	}
+	if sip.DeletionTimestamp == nil {
+		return c.sipHelper.EnsureFinalizer(sip)
+	}
+	if !staticip.HasFinalizer(sip) {
+		return nil
+	}
+	gone := map[string]apimtypes.UID{}
+	for _, ipMap := range []map[string]*ipkv1.OwnerPod{
+		sip.Status.IPMap, sip.Status.Evicting, sip.Status.Draining,
+	} {
+		for ip, ownerPod := range ipMap {
+			if ownerPod != nil && c.isOrphan(ownerPod) {
+				gone[ip] = ownerPod.UID
+			}
+		}
+	}
+	remaining, err := c.sipHelper.FinalizeStaticIP(sip, gone)
+	if err != nil {
+		return
+	}
+	if remaining != 0 {
+		klog.Infof("staticip %s is waiting for %d pods to release their ips", key, remaining)
+		c.syncSIPQueue.AddAfter(key, finalizeInterval)
+	}
+	return nil
+}
+
+//////////////////////////////////////////////////////////////
+// process 实际操作 Del 部分
+func (c *Controller) runDelSIPWorker() {
+	for c.processNextDelSIPWorkItem() {
+	}
+}
+
+func (c *Controller) processNextDelSIPWorkItem() bool {
+	var err error
+	obj, shutdown := c.delSIPQueue.Get()
+	if shutdown {
+		return false
+	}
+	err = c.processNextRetryWorkItem(obj, c.delSIPQueue, c.handleDelSIP)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return true
+	}
+
+	return true
+}
+
+// handleDelSIP 将被删除的 StaticIP 从 IPPool 中划分到的 IP 归还.
+// 此时 StaticIP 对象已经不存在, 所以只能通过 key 查找.
+func (c *Controller) handleDelSIP(key string) (err error) {
+	return c.sipHelper.ReleasePoolBlock(key)
+}
+
+//////////////////////////////////////////////////////////////
+// 定时回收冷却结束的 IP
+
+// reclaimInterval 检查冷却期 IP 的间隔, 冷却结束的 IP 最多会晚这么久才能再次分配.
+const reclaimInterval = 5 * time.Second
+
+// reclaimReleasingIPs 遍历所有 StaticIP, 将其中冷却结束的 IP 移回 Avaliable.
+// 先通过 lister 中的缓存判断, 只有确实存在冷却结束的 IP 时才会请求 apiserver.
+func (c *Controller) reclaimReleasingIPs() {
+	sips, err := c.sipLister.List(labels.Everything())
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	now := time.Now()
+	for _, sip := range sips {
+		if !staticip.HasExpiredReleasing(sip, now) {
+			continue
+		}
+		klog.Infof("reclaim releasing ips of staticip %s/%s", sip.Namespace, sip.Name)
+		err = c.sipHelper.ReclaimReleasing(sip)
+		if err != nil {
+			utilruntime.HandleError(err)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package controller
+
+import (
+	appsv1 "k8s.io/api/apps/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	cgcache "k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+
+	"github.com/generals-space/crd-ipkeeper/pkg/util"
+)
+
+// StatefulSet 的处理流程与 Deployment 基本相同, 见 handler_deploy.go.
+// 区别在于分配 IP 时按 Pod 序号绑定, 见 staticip.pickOrdinalIPs().
+
+//////////////////////////////////////////////////////////////
+// enqueue 前期操作
+func (c *Controller) enqueueAddSts(obj interface{}) {
+	if !c.isLeader() {
+		return
+	}
+	key, err := cgcache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+
+	sts := obj.(*appsv1.StatefulSet)
+	if c.sipHelper.OwnerKindAllowed("StatefulSet") && util.HasIPPoolAnnotations(sts.Annotations) {
+		klog.Infof("enqueue add ip pool statefulset %s", key)
+		c.addStsQueue.AddRateLimited(key)
+	}
+	return
+}
+
+func (c *Controller) enqueueUpdateSts(oldObj, newObj interface{}) {
+	if !c.isLeader() {
+		return
+	}
+
+	oldS := oldObj.(*appsv1.StatefulSet)
+	newS := newObj.(*appsv1.StatefulSet)
+
+	if oldS.ResourceVersion == newS.ResourceVersion {
+		return
+	}
+
+	key, err := cgcache.MetaNamespaceKeyFunc(newObj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	prev := util.HasIPPoolAnnotations(oldS.Annotations)
+	next := util.HasIPPoolAnnotations(newS.Annotations)
+
+	if prev && next {
+		if !ipPoolChanged(oldS.Annotations, newS.Annotations, oldS.Spec.Replicas, newS.Spec.Replicas) {
+			// replicas 变化时即使 IP 池不变, 也需要检查 IP 池是否足够.
+			if oldS.Spec.Replicas != nil && newS.Spec.Replicas != nil &&
+				*oldS.Spec.Replicas != *newS.Spec.Replicas {
+				c.checkPoolSize(newS)
+			}
+			return
+		}
+		klog.Infof("enqueue update ip pool statefulset %s", key)
+		c.updateStsQueue.AddRateLimited(key)
+	}
+	return
+}
+
+//////////////////////////////////////////////////////////////
+// process 实际操作 Add 部分
+func (c *Controller) runAddStsWorker() {
+	for c.processNextAddStsWorkItem() {
+	}
+}
+
+func (c *Controller) processNextAddStsWorkItem() bool {
+	obj, shutdown := c.addStsQueue.Get()
+	if shutdown {
+		return false
+	}
+	err := c.processNextWorkItem(obj, c.addStsQueue, c.handleAddSts)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return true
+	}
+
+	return true
+}
+
+func (c *Controller) handleAddSts(key string) (err error) {
+	sts, err := c.getStsFromKey(key)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	if sts == nil {
+		return nil
+	}
+	if sts.Annotations[util.PoolNameAnnotation] == "" &&
+		!c.checkIPPoolAnnotation(sts, sts.Annotations[util.IPPoolAnnotation]) {
+		return nil
+	}
+	if c.waitForTerminatingSIP(sts, "StatefulSet", key, c.addStsQueue) {
+		return nil
+	}
+
+	err = c.sipHelper.CreateStaticIP(sts, "StatefulSet")
+	if err != nil {
+		return
+	}
+	c.checkPoolSize(sts)
+	return nil
+}
+
+//////////////////////////////////////////////////////////////
+// process 实际操作 Update 部分
+func (c *Controller) runUpdateStsWorker() {
+	for c.processNextUpdateStsWorkItem() {
+	}
+}
+
+func (c *Controller) processNextUpdateStsWorkItem() bool {
+	obj, shutdown := c.updateStsQueue.Get()
+	if shutdown {
+		return false
+	}
+	err := c.processNextWorkItem(obj, c.updateStsQueue, c.handleUpdateSts)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return true
+	}
+
+	return true
+}
+
+func (c *Controller) handleUpdateSts(key string) (err error) {
+	sts, err := c.getStsFromKey(key)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	if sts == nil {
+		return nil
+	}
+	if sts.Annotations[util.PoolNameAnnotation] == "" &&
+		!c.checkIPPoolAnnotation(sts, sts.Annotations[util.IPPoolAnnotation]) {
+		return nil
+	}
+
+	oldSIP, err := c.sipHelper.GetStaticIP(sts, "StatefulSet")
+	if err != nil {
+		return
+	}
+	newSIP, err := c.sipHelper.NewStaticIP(sts, "StatefulSet")
+	if err != nil {
+		return
+	}
+
+	// IP 池缩减后, 占用了被移除 IP 的 Pod 会被删除并由 StatefulSet 重建,
+	// 重建的 Pod 如果序号超出了 IP 池的范围, 将无法分配到 IP.
+	err = c.renewStaticIP(oldSIP, newSIP)
+	if err != nil {
+		return
+	}
+	c.checkPoolSize(sts)
+	return nil
+}
@@ -13,8 +13,10 @@ import (
 type PodRequest struct {
 	PodName      string `json:"pod_name"`
 	PodNamespace string `json:"pod_namespace"`
-	ContainerID  string `json:"container_id"`
-	NetNs        string `json:"net_ns"`
+	// PodUID 由 kubelet 通过 CNI_ARGS 中的 K8S_POD_UID 传入, 较早版本的 kubelet 可能没有.
+	PodUID      string `json:"pod_uid,omitempty"`
+	ContainerID string `json:"container_id"`
+	NetNs       string `json:"net_ns"`
 	// cni插件使用的网桥设备的名称, 一般默认为cni0.
 	CNI0 string `json:"cni0"`
 }
@@ -23,8 +25,11 @@ type PodRequest struct {
 type PodResponse struct {
 	// IPAddress 点分十进制+掩码字符串, 如`192.168.0.1/24`
 	IPAddress string `json:"address"`
-	Gateway    string `json:"gateway"`
-	DoNothing bool   `json:"do_nothing"`
+	Gateway   string `json:"gateway"`
+	// IPAddress6 IPv6 地址+掩码字符串, 如`fd00::10/64`, 双栈或纯 IPv6 时才有值.
+	IPAddress6 string `json:"address6,omitempty"`
+	Gateway6   string `json:"gateway6,omitempty"`
+	DoNothing  bool   `json:"do_nothing"`
 }
 
 // CNIServerClient ...
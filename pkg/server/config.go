@@ -2,14 +2,26 @@ package server
 
 import (
 	"flag"
+	"os"
 
 	"github.com/spf13/pflag"
+
+	"github.com/generals-space/crd-ipkeeper/pkg/staticip"
 )
 
 // Configuration ...
 type Configuration struct {
 	BindSocket     string
 	KubeConfigFile string
+	// OwnerKinds 允许拥有 StaticIP 的资源类型, 如 Deployment, CloneSet, Rollout 等.
+	OwnerKinds []string
+	// NodeName 当前节点的名称, cni server 只更新本节点上 Pod 的默认路由.
+	NodeName string
+	// WebhookBindAddress admission webhook 的监听地址,
+	// 只有同时指定了 TLSCertFile 与 TLSKeyFile 时才会启动 webhook.
+	WebhookBindAddress string
+	TLSCertFile        string
+	TLSKeyFile         string
 }
 
 // ParseFlags ...
@@ -18,6 +30,12 @@ func ParseFlags() *Configuration {
 	var (
 		argBindSocket     = pflag.String("bind-socket", "/var/run/cniserver.sock", "The socket daemon bind to.")
 		argKubeConfigFile = pflag.String("kubeconfig", "", "Path to kubeconfig file with authorization and master location information. If not set use the inCluster token.")
+		argOwnerKinds     = pflag.StringSlice("owner-kinds", staticip.DefaultOwnerKinds, "The kinds of top-level controllers which are allowed to own static IPs, such as CloneSet or Rollout.")
+		argNodeName       = pflag.String("node-name", os.Getenv("NODE_NAME"), "The name of the node this daemon runs on. If not set use the NODE_NAME env.")
+
+		argWebhookBindAddress = pflag.String("webhook-bind-address", ":9443", "The address the admission webhook server listens on.")
+		argTLSCertFile        = pflag.String("tls-cert-file", "", "Path to the TLS certificate of the admission webhook. If not set the webhook is disabled.")
+		argTLSKeyFile         = pflag.String("tls-private-key-file", "", "Path to the TLS private key of the admission webhook.")
 	)
 	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
 	pflag.Parse()
@@ -27,5 +45,11 @@ func ParseFlags() *Configuration {
 	return &Configuration{
 		BindSocket:     *argBindSocket,
 		KubeConfigFile: *argKubeConfigFile,
+		OwnerKinds:     *argOwnerKinds,
+		NodeName:       *argNodeName,
+
+		WebhookBindAddress: *argWebhookBindAddress,
+		TLSCertFile:        *argTLSCertFile,
+		TLSKeyFile:         *argTLSKeyFile,
 	}
 }
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apimerrors "k8s.io/apimachinery/pkg/api/errors"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	cgcache "k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+
+	ipkv1 "github.com/generals-space/crd-ipkeeper/pkg/apis/ipkeeper/v1"
+	"github.com/generals-space/crd-ipkeeper/pkg/staticip"
+	"github.com/generals-space/crd-ipkeeper/pkg/util"
+)
+
+// 只修改 IP 池的网关时, controller 更新 StaticIP 后 Pod 仍然保留原来的 IP, 但其默认路由还是旧的网关.
+// 每个节点上的 cni server 监听 StaticIP, 发现本节点上的 Pod 记录的网关与声明的不一致时,
+// 进入其 netns 替换默认路由, 并将每个 Pod 的结果写回 StaticIP, 同时在 Pod 上记录事件.
+
+// gatewayRetryInterval 更新默认路由失败后重试的间隔.
+const gatewayRetryInterval = 30 * time.Second
+
+//////////////////////////////////////////////////////////////
+// enqueue 前期操作
+
+// enqueueSyncGateway 本节点上有 Pod 需要更新默认路由的 StaticIP 加入 gatewayQueue.
+func (s *CNIServer) enqueueSyncGateway(obj interface{}) {
+	sip := obj.(*ipkv1.StaticIP)
+	if sip.DeletionTimestamp != nil || len(staticip.StaleGateways(sip, s.config.NodeName)) == 0 {
+		return
+	}
+	key, err := cgcache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	s.gatewayQueue.Add(key)
+}
+
+func (s *CNIServer) enqueueUpdateGateway(oldObj, newObj interface{}) {
+	s.enqueueSyncGateway(newObj)
+}
+
+//////////////////////////////////////////////////////////////
+// process 实际操作 Sync 部分
+func (s *CNIServer) runGatewayWorker() {
+	for s.processNextGatewayWorkItem() {
+	}
+}
+
+func (s *CNIServer) processNextGatewayWorkItem() bool {
+	obj, shutdown := s.gatewayQueue.Get()
+	if shutdown {
+		return false
+	}
+	defer s.gatewayQueue.Done(obj)
+	key, ok := obj.(string)
+	if !ok {
+		s.gatewayQueue.Forget(obj)
+		utilruntime.HandleError(fmt.Errorf("expected string in queue but got %#v", obj))
+		return true
+	}
+	err := s.handleSyncGateway(key)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("error syncing gateway of '%s': %s", key, err))
+		s.gatewayQueue.AddRateLimited(key)
+		return true
+	}
+	s.gatewayQueue.Forget(obj)
+	return true
+}
+
+// handleSyncGateway 替换本节点上网关已经过时的 Pod 的默认路由, 有 Pod 更新失败时稍后重试.
+func (s *CNIServer) handleSyncGateway(key string) (err error) {
+	ns, name, err := cgcache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return nil
+	}
+	sip, err := s.sipLister.StaticIPs(ns).Get(name)
+	if err != nil {
+		if apimerrors.IsNotFound(err) {
+			return nil
+		}
+		return
+	}
+	if sip.DeletionTimestamp != nil {
+		return nil
+	}
+	stale := staticip.StaleGateways(sip, s.config.NodeName)
+	if len(stale) == 0 {
+		return nil
+	}
+
+	results := map[string]*staticip.GatewayResult{}
+	failed := 0
+	for ip, ownerPod := range stale {
+		result := &staticip.GatewayResult{
+			UID:         ownerPod.UID,
+			ContainerID: ownerPod.ContainerID,
+			Gateway:     staticip.GatewayOf(sip, ip),
+		}
+		if ownerPod.NetNs == "" {
+			// 之前版本分配的 IP 没有记录 netns.
+			result.Err = fmt.Errorf("netns of pod %s is unknown, restart it to use the new gateway", ownerPod.Name)
+		} else {
+			result.Err = replaceDefaultRoute(ownerPod.NetNs, result.Gateway)
+		}
+		results[ip] = result
+
+		podRef := &corev1.ObjectReference{
+			Kind:       "Pod",
+			APIVersion: "v1",
+			Namespace:  ownerPod.Namespace,
+			Name:       ownerPod.Name,
+			UID:        ownerPod.UID,
+		}
+		if result.Err != nil {
+			failed++
+			klog.Errorf("failed to update gateway of pod %s/%s to %s: %s", ownerPod.Namespace, ownerPod.Name, result.Gateway, result.Err)
+			// 同样的错误只记录一次事件.
+			if ownerPod.GatewayError != result.Err.Error() {
+				s.handler.recorder.Eventf(
+					podRef, corev1.EventTypeWarning, util.EventGatewayUpdateFailed,
+					"failed to change gateway of ip %s from %s to %s: %s", ip, ownerPod.Gateway, result.Gateway, result.Err,
+				)
+			}
+			continue
+		}
+		klog.Infof("update gateway of pod %s/%s to %s", ownerPod.Namespace, ownerPod.Name, result.Gateway)
+		s.handler.recorder.Eventf(
+			podRef, corev1.EventTypeNormal, util.EventGatewayUpdated,
+			"changed gateway of ip %s from %s to %s", ip, ownerPod.Gateway, result.Gateway,
+		)
+	}
+	err = s.handler.sipHelper.UpdatePodGateways(sip, results)
+	if err != nil {
+		return
+	}
+	if failed != 0 {
+		s.gatewayQueue.AddAfter(key, gatewayRetryInterval)
+	}
+	return nil
+}
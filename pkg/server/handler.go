@@ -1,25 +1,63 @@
 package server
 
 import (
+	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/emicklei/go-restful"
+	corev1 "k8s.io/api/core/v1"
+	apimerrors "k8s.io/apimachinery/pkg/api/errors"
 	apimmetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	apimtypes "k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/dynamic"
 	cgkuber "k8s.io/client-go/kubernetes"
+	cgscheme "k8s.io/client-go/kubernetes/scheme"
+	cgcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	cgrecord "k8s.io/client-go/tools/record"
 	"k8s.io/klog"
 
+	ipkv1 "github.com/generals-space/crd-ipkeeper/pkg/apis/ipkeeper/v1"
 	crdClientset "github.com/generals-space/crd-ipkeeper/pkg/client/clientset/versioned"
+	crdScheme "github.com/generals-space/crd-ipkeeper/pkg/client/clientset/versioned/scheme"
+	crdLister "github.com/generals-space/crd-ipkeeper/pkg/client/listers/ipkeeper/v1"
 	"github.com/generals-space/crd-ipkeeper/pkg/restapi"
 	"github.com/generals-space/crd-ipkeeper/pkg/staticip"
+	"github.com/generals-space/crd-ipkeeper/pkg/util"
 )
 
+const serverAgentName = "ipkeeper-cni-server"
+
 // CNIServerHandler ...
 type CNIServerHandler struct {
 	Config     *Configuration
 	kubeClient cgkuber.Interface
 	crdClient  crdClientset.Interface
 	sipHelper  *staticip.Helper
+	// sipLister 由 NewCNIServer() 设置, 与 gateway.go 共用同一个 informer.
+	sipLister crdLister.StaticIPLister
+	// recorder 在 Pod, workload 与 StaticIP 上记录 IP 的分配情况及无法分配的原因
+	recorder cgrecord.EventRecorder
+}
+
+func makeRecorder(kubeClient cgkuber.Interface) (recorder cgrecord.EventRecorder) {
+	eventBroadcaster := cgrecord.NewBroadcaster()
+	eventBroadcaster.StartLogging(klog.Infof)
+	eventBroadcaster.StartRecordingToSink(
+		&cgcorev1.EventSinkImpl{
+			Interface: kubeClient.CoreV1().Events(""),
+		},
+	)
+	recorder = eventBroadcaster.NewRecorder(
+		cgscheme.Scheme,
+		corev1.EventSource{
+			Component: serverAgentName,
+		},
+	)
+	return
 }
 
 // newCNIServerHandler 挂载 cni server 的 rest api 接口.
@@ -27,12 +65,16 @@ func newCNIServerHandler(
 	config *Configuration,
 	kubeClient cgkuber.Interface,
 	crdClient crdClientset.Interface,
+	dynamicClient dynamic.Interface,
 ) *CNIServerHandler {
+	// recorder 需要在 StaticIP 上记录事件, 与 controller 一样要先注册 StaticIP 类型.
+	utilruntime.Must(crdScheme.AddToScheme(cgscheme.Scheme))
 	return &CNIServerHandler{
 		Config:     config,
 		kubeClient: kubeClient,
 		crdClient:  crdClient,
-		sipHelper:  staticip.New(kubeClient, crdClient),
+		sipHelper:  staticip.New(kubeClient, crdClient, dynamicClient, config.OwnerKinds),
+		recorder:   makeRecorder(kubeClient),
 	}
 }
 
@@ -46,7 +88,9 @@ func (csh *CNIServerHandler) handleAdd(req *restful.Request, resp *restful.Respo
 	}
 	klog.Infof("parsed request %v", podReq)
 
-	var ipAddr, gateway string
+	var alloc *staticip.AllocatedIP
+	// noIPPool 为 true 表示 Pod 及其 owner 没有声明 IP 池, 只有此时才交给后续的 cni 插件处理.
+	noIPPool := false
 	// 这里为什么要重试10次呢 ???
 	for i := 0; i < 10; i++ {
 		pod, err := csh.kubeClient.
@@ -60,29 +104,56 @@ func (csh *CNIServerHandler) handleAdd(req *restful.Request, resp *restful.Respo
 		}
 		// 理论上, 在运行至此处时, Pod/Deployment 资源对应的 StaticIP 早已事先创建了.
 		sip, err := csh.sipHelper.GetPodOwnerSIP(pod)
+		// Pod 及其 owner 没有声明 IP 池(或注解已被移除)时不分配 IP.
+		if _, ok := err.(*staticip.NoIPPoolError); ok {
+			klog.Infof("%s", err)
+			noIPPool = true
+			break
+		}
 		if err != nil {
 			klog.Errorf("get sip from owner failed %v", err)
 			resp.WriteHeaderAndEntity(http.StatusInternalServerError, err)
 			return
 		}
-		ipAddr, gateway, err = csh.sipHelper.AccquireIP(sip, pod)
+		// 单个 Pod 对应的 StaticIP 可能还未被 controller 创建.
+		if sip == nil {
+			time.Sleep(2 * time.Second)
+			continue
+		}
+		alloc, err = csh.sipHelper.AccquireIP(sip, pod, podReq.ContainerID, podReq.NetNs)
 		// ipAddr, gateway, err = csh.getAndOccupyOneIPByOwner(pod)
+		if reqErr, ok := err.(*staticip.RequestedIPError); ok {
+			csh.recorder.Eventf(
+				pod, corev1.EventTypeWarning, util.EventRequestedIPUnavailable, "%s", reqErr,
+			)
+		}
+		if _, ok := err.(*staticip.PoolExhaustedError); ok {
+			staticip.RecordEvent(
+				csh.recorder, sip, pod, corev1.EventTypeWarning, util.EventPoolExhausted,
+				"no IP avaliable for pod %s in staticip %s", pod.Name, sip.Name,
+			)
+		}
 		if err != nil {
 			klog.Errorf("get ipAddr and gateway from owner failed %v", err)
 			resp.WriteHeaderAndEntity(http.StatusInternalServerError, err)
 			return
 		}
 
-		if ipAddr == "" || gateway == "" {
+		if (alloc.IPAddress == "" || alloc.Gateway == "") &&
+			(alloc.IPAddress6 == "" || alloc.Gateway6 == "") {
 			// wait controller assign an address
 			time.Sleep(2 * time.Second)
 			continue
 		}
+		staticip.RecordEvent(
+			csh.recorder, sip, pod, corev1.EventTypeNormal, util.EventAddressAssigned,
+			"assigned ip %s to pod %s", joinIPs(alloc.IPAddress, alloc.IPAddress6), pod.Name,
+		)
 		break
 	}
 
-	// 如果 ipAddr 还是空, 说明此Pod/Deploy/DaemonSet没有声明固定IP的注解, 直接返回.
-	if ipAddr == "" {
+	// 此Pod/Deploy/DaemonSet没有声明固定IP的注解, 直接返回.
+	if noIPPool {
 		resp.WriteHeaderAndEntity(
 			http.StatusOK,
 			restapi.PodResponse{
@@ -91,10 +162,18 @@ func (csh *CNIServerHandler) handleAdd(req *restful.Request, resp *restful.Respo
 		)
 		return
 	}
+	// 声明了 IP 池, 但重试之后 StaticIP 仍未创建(或仍没有分配到 IP),
+	// 此时返回失败由 kubelet 稍后重建 sandbox, 而不是让 Pod 使用后续 cni 插件分配的随机 IP.
+	if alloc == nil || (alloc.IPAddress == "" && alloc.IPAddress6 == "") {
+		err = fmt.Errorf("no ip assigned to pod %s/%s yet", podReq.PodNamespace, podReq.PodName)
+		klog.Errorf("%s", err)
+		resp.WriteHeaderAndEntity(http.StatusInternalServerError, err)
+		return
+	}
 
-	klog.Infof("create container ip %s", ipAddr)
+	klog.Infof("create container ip %s %s", alloc.IPAddress, alloc.IPAddress6)
 
-	err = csh.setVethPair(podReq, ipAddr, gateway)
+	err = csh.setVethPair(podReq, alloc)
 	if err != nil {
 		klog.Errorf("set veth pair failed %s", err)
 		resp.WriteHeaderAndEntity(http.StatusInternalServerError, err)
@@ -103,15 +182,180 @@ func (csh *CNIServerHandler) handleAdd(req *restful.Request, resp *restful.Respo
 	resp.WriteHeaderAndEntity(
 		http.StatusOK,
 		restapi.PodResponse{
-			IPAddress: ipAddr,
-			Gateway:   gateway,
+			IPAddress:  alloc.IPAddress,
+			Gateway:    alloc.Gateway,
+			IPAddress6: alloc.IPAddress6,
+			Gateway6:   alloc.Gateway6,
 		},
 	)
 	return
 }
 
-// handleDel 处理Pod移除的事件
+// joinIPs 将双栈的两个 IP 以逗号连接, 忽略其中为空的那个.
+func joinIPs(ips ...string) string {
+	result := []string{}
+	for _, ip := range ips {
+		if ip != "" {
+			result = append(result, ip)
+		}
+	}
+	return strings.Join(result, ",")
+}
+
+// handleDel 处理Pod移除的事件, 删除宿主机端的veth, 并释放 sandbox 占用的 IP.
+// kubelet 可能对同一个 sandbox 重复发起 DEL, Pod 对象也可能已经被删除, 这些情况下都返回成功.
+// Pod 仍在正常运行时说明只是 sandbox 被重建, 此时保留其 IP, 新的 sandbox 在 ADD 时会继续使用.
+// 正常情况下 IP 由 controller 在 Pod 删除时释放, 这里只是让 IP 尽早归还, 不依赖 controller 能否收到删除事件.
 func (csh *CNIServerHandler) handleDel(req *restful.Request, resp *restful.Response) {
+	podReq := &restapi.PodRequest{}
+	err := req.ReadEntity(podReq)
+	if err != nil {
+		klog.Errorf("parse del request failed %v", err)
+		resp.WriteHeaderAndEntity(http.StatusBadRequest, err)
+		return
+	}
+	klog.Infof("parsed request %v", podReq)
+
+	err = delHostVeth(podReq.ContainerID)
+	if err != nil {
+		klog.Errorf("delete host veth failed %s", err)
+		resp.WriteHeaderAndEntity(http.StatusInternalServerError, err)
+		return
+	}
+
+	pod, err := csh.kubeClient.
+		CoreV1().
+		Pods(podReq.PodNamespace).
+		Get(podReq.PodName, apimmetav1.GetOptions{})
+	if err != nil {
+		if !apimerrors.IsNotFound(err) {
+			klog.Errorf("get pod %s/%s failed %v", podReq.PodNamespace, podReq.PodName, err)
+			resp.WriteHeaderAndEntity(http.StatusInternalServerError, err)
+			return
+		}
+		pod = nil
+	}
+	// 同名的 Pod 可能已经被重建(如 StatefulSet), 此时不能以新 Pod 的 UID 释放.
+	if pod != nil && podReq.PodUID != "" && string(pod.UID) != podReq.PodUID {
+		pod = nil
+	}
+	if pod != nil && pod.DeletionTimestamp == nil &&
+		pod.Status.Phase != corev1.PodSucceeded && pod.Status.Phase != corev1.PodFailed {
+		klog.Infof("pod %s/%s is still running, keep its ip for the next sandbox", pod.Namespace, pod.Name)
+		resp.WriteHeader(http.StatusNoContent)
+		return
+	}
+	uid := apimtypes.UID(podReq.PodUID)
+	if pod != nil {
+		uid = pod.UID
+	}
+
+	owners, err := csh.sandboxOwners(podReq, uid)
+	if err != nil {
+		klog.Errorf("find staticips of pod %s/%s failed %v", podReq.PodNamespace, podReq.PodName, err)
+		resp.WriteHeaderAndEntity(http.StatusInternalServerError, err)
+		return
+	}
+	for _, owner := range owners {
+		target := pod
+		if target == nil {
+			// ReleaseIP() 只使用 Pod 的 UID 与名称, Pod 对象不存在时以 OwnerPod 代替.
+			target = &corev1.Pod{
+				ObjectMeta: apimmetav1.ObjectMeta{
+					Namespace: owner.ownerPod.Namespace,
+					Name:      owner.ownerPod.Name,
+					UID:       owner.ownerPod.UID,
+				},
+			}
+		}
+		released, err := csh.sipHelper.ReleaseIP(owner.sip, target, podReq.ContainerID)
+		if err != nil {
+			resp.WriteHeaderAndEntity(http.StatusInternalServerError, err)
+			return
+		}
+		if len(released) == 0 {
+			continue
+		}
+		klog.Infof("release ip %s of pod %s/%s", strings.Join(released, ","), target.Namespace, target.Name)
+		staticip.RecordEvent(
+			csh.recorder, owner.sip, pod, corev1.EventTypeNormal, util.EventAddressReleased,
+			"released ip %s of pod %s", strings.Join(released, ","), target.Name,
+		)
+	}
 	resp.WriteHeader(http.StatusNoContent)
 	return
 }
+
+// sandboxOwner sandbox 占用的 IP 所在的 StaticIP, 以及记录在其中的 Pod.
+type sandboxOwner struct {
+	sip      *ipkv1.StaticIP
+	ownerPod *ipkv1.OwnerPod
+}
+
+// sandboxOwners 在 Pod 所在命名空间的 StaticIP 中查找 podReq 对应的 sandbox 占用的 IP.
+// Pod 对象可能已经不存在, 所以不能通过 owner 查找 StaticIP, 而是遍历 IPMap, Evicting 与 Draining,
+// uid 为空(Pod 已不存在, 且 kubelet 没有传入 UID)时按 Pod 名称匹配.
+// 缓存中没有找到时再从 apiserver 查找一次, 刚刚分配的 IP 可能还没有同步到缓存中.
+func (csh *CNIServerHandler) sandboxOwners(
+	podReq *restapi.PodRequest,
+	uid apimtypes.UID,
+) (owners []*sandboxOwner, err error) {
+	sips, err := csh.sipLister.StaticIPs(podReq.PodNamespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	owners = findSandboxOwners(sips, podReq, uid)
+	if len(owners) != 0 {
+		return
+	}
+	sipList, err := csh.crdClient.IpkeeperV1().StaticIPs(podReq.PodNamespace).List(apimmetav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	sips = []*ipkv1.StaticIP{}
+	for i := range sipList.Items {
+		sips = append(sips, &sipList.Items[i])
+	}
+	return findSandboxOwners(sips, podReq, uid), nil
+}
+
+// findSandboxOwners 在 sips 中查找 podReq 对应的 sandbox 占用的 IP, 见 csh.sandboxOwners().
+func findSandboxOwners(
+	sips []*ipkv1.StaticIP,
+	podReq *restapi.PodRequest,
+	uid apimtypes.UID,
+) (owners []*sandboxOwner) {
+	owners = []*sandboxOwner{}
+	for _, sip := range sips {
+		for _, ipMap := range []map[string]*ipkv1.OwnerPod{
+			sip.Status.IPMap, sip.Status.Evicting, sip.Status.Draining,
+		} {
+			ownerPod := findSandbox(ipMap, podReq, uid)
+			if ownerPod != nil {
+				owners = append(owners, &sandboxOwner{sip: sip, ownerPod: ownerPod})
+				break
+			}
+		}
+	}
+	return
+}
+
+// findSandbox 在 ipMap 中查找 podReq 对应的 sandbox, 匹配规则与 staticip.releaseIP() 相同.
+func findSandbox(ipMap map[string]*ipkv1.OwnerPod, podReq *restapi.PodRequest, uid apimtypes.UID) *ipkv1.OwnerPod {
+	for _, ownerPod := range ipMap {
+		if ownerPod == nil {
+			continue
+		}
+		if uid != "" && ownerPod.UID != uid {
+			continue
+		}
+		if uid == "" && ownerPod.Name != podReq.PodName {
+			continue
+		}
+		if podReq.ContainerID != "" && ownerPod.ContainerID != "" && ownerPod.ContainerID != podReq.ContainerID {
+			continue
+		}
+		return ownerPod
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"testing"
+
+	apimmetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	cgcache "k8s.io/client-go/tools/cache"
+
+	ipkv1 "github.com/generals-space/crd-ipkeeper/pkg/apis/ipkeeper/v1"
+	crdfake "github.com/generals-space/crd-ipkeeper/pkg/client/clientset/versioned/fake"
+	crdLister "github.com/generals-space/crd-ipkeeper/pkg/client/listers/ipkeeper/v1"
+	"github.com/generals-space/crd-ipkeeper/pkg/restapi"
+)
+
+// TestSandboxOwnersFallback 缓存中还没有 sandbox 的分配记录时, 从 apiserver 中查找.
+func TestSandboxOwnersFallback(t *testing.T) {
+	sip := &ipkv1.StaticIP{
+		ObjectMeta: apimmetav1.ObjectMeta{Name: "deploy-test", Namespace: "default"},
+		Status: ipkv1.StaticIPStatus{
+			IPMap: map[string]*ipkv1.OwnerPod{
+				"172.16.0.1/24": {Namespace: "default", Name: "test-0", UID: "uid-0", ContainerID: "sandbox-1"},
+				"172.16.0.2/24": nil,
+			},
+		},
+	}
+	// 缓存中的 StaticIP 还是分配之前的版本.
+	cached := sip.DeepCopy()
+	cached.Status.IPMap["172.16.0.1/24"] = nil
+	indexer := cgcache.NewIndexer(cgcache.MetaNamespaceKeyFunc, cgcache.Indexers{})
+	indexer.Add(cached)
+	csh := &CNIServerHandler{
+		crdClient: crdfake.NewSimpleClientset(sip),
+		sipLister: crdLister.NewStaticIPLister(indexer),
+	}
+	podReq := &restapi.PodRequest{PodName: "test-0", PodNamespace: "default", ContainerID: "sandbox-1"}
+
+	owners, err := csh.sandboxOwners(podReq, "uid-0")
+	if err != nil {
+		t.Fatalf("failed to find sandbox owners: %s", err)
+	}
+	if len(owners) != 1 || owners[0].ownerPod.Name != "test-0" {
+		t.Fatalf("expected to find test-0 from apiserver, got %v", owners)
+	}
+	// 其他 sandbox 的 DEL 不会匹配.
+	podReq.ContainerID = "sandbox-0"
+	owners, err = csh.sandboxOwners(podReq, "uid-0")
+	if err != nil || len(owners) != 0 {
+		t.Fatalf("expected no owner for another sandbox, got %v, %v", owners, err)
+	}
+}
@@ -4,12 +4,19 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"time"
 
 	restful "github.com/emicklei/go-restful"
+	utilwait "k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
 	cgkuber "k8s.io/client-go/kubernetes"
+	cgcache "k8s.io/client-go/tools/cache"
+	cgworkqueue "k8s.io/client-go/util/workqueue"
 	"k8s.io/klog"
 
 	crdClientset "github.com/generals-space/crd-ipkeeper/pkg/client/clientset/versioned"
+	crdInformers "github.com/generals-space/crd-ipkeeper/pkg/client/informers/externalversions"
+	crdLister "github.com/generals-space/crd-ipkeeper/pkg/client/listers/ipkeeper/v1"
 	"github.com/generals-space/crd-ipkeeper/pkg/restapi"
 )
 
@@ -21,6 +28,12 @@ type CNIServer struct {
 	// 两个 client 都是给 handler 用的
 	kubeClient cgkuber.Interface
 	crdClient  crdClientset.Interface
+
+	// 每个节点都需要监听 StaticIP 的网关变化, 不参与 controller 的 leader 选举, 见 gateway.go.
+	crdInformerFactory crdInformers.SharedInformerFactory
+	sipLister          crdLister.StaticIPLister
+	sipSynced          cgcache.InformerSynced
+	gatewayQueue       cgworkqueue.RateLimitingInterface
 }
 
 // NewCNIServer ...
@@ -28,23 +41,56 @@ func NewCNIServer(
 	config *Configuration,
 	kubeClient cgkuber.Interface,
 	crdClient crdClientset.Interface,
+	dynamicClient dynamic.Interface,
 ) *CNIServer {
 	cniServer := &CNIServer{
-		config:     config,
-		handler:    newCNIServerHandler(
+		config: config,
+		handler: newCNIServerHandler(
 			config,
 			kubeClient,
 			crdClient,
+			dynamicClient,
 		),
 		kubeClient: kubeClient,
 		crdClient:  crdClient,
+		gatewayQueue: cgworkqueue.NewNamedRateLimitingQueue(
+			cgworkqueue.DefaultControllerRateLimiter(),
+			"SyncGateway",
+		),
 	}
+	cniServer.crdInformerFactory = crdInformers.NewSharedInformerFactory(
+		crdClient, time.Second*30,
+	)
+	sipInformer := cniServer.crdInformerFactory.Ipkeeper().V1().StaticIPs()
+	cniServer.sipLister = sipInformer.Lister()
+	// Pod 对象已经不存在时, DEL 需要从 StaticIP 中查找 sandbox 占用的 IP.
+	cniServer.handler.sipLister = cniServer.sipLister
+	cniServer.sipSynced = sipInformer.Informer().HasSynced
+	sipInformer.Informer().AddEventHandler(
+		cgcache.ResourceEventHandlerFuncs{
+			AddFunc:    cniServer.enqueueSyncGateway,
+			UpdateFunc: cniServer.enqueueUpdateGateway,
+		},
+	)
 	cniServer.createHandler()
 	return cniServer
 }
 
-// Run 启动Unix http服务器.
-func (s *CNIServer) Run() {
+// Run 启动Unix http服务器, 以及更新本节点 Pod 默认路由的 worker.
+// @param stopCh: 同 controller.Run(), 收到退出信号时关闭.
+func (s *CNIServer) Run(stopCh <-chan struct{}) {
+	defer s.gatewayQueue.ShutDown()
+	// cni server 运行在每个节点上, 不启用 owner 资源的缓存(见 StartOwnerInformers()),
+	// 否则每个节点都要对各类 owner 资源建立全集群的 watch, ADD 时直接请求 apiserver 即可.
+	s.crdInformerFactory.Start(stopCh)
+	// DEL 请求需要从缓存中查找 StaticIP, 缓存同步完成之前不能开始处理请求.
+	klog.Info("waiting for staticip cache to sync")
+	if !cgcache.WaitForCacheSync(stopCh, s.sipSynced) {
+		klog.Errorf("failed to wait for staticip cache to sync")
+		return
+	}
+	go utilwait.Until(s.runGatewayWorker, time.Second, stopCh)
+
 	unixListener, err := net.Listen("unix", s.config.BindSocket)
 	if err != nil {
 		klog.Errorf("bind socket to %s failed %v", s.config.BindSocket, err)
@@ -68,8 +114,7 @@ func (s *CNIServer) createHandler() {
 	ws.Route(
 		ws.POST("/add").To(s.handler.handleAdd).Reads(restapi.PodRequest{}),
 	)
-	// 处理Pod移除的事件, 从cni网桥拨出宿主机端的veth等操作.
-	// ...不过我觉得根本没必要, 所以 s.handler.handleDel() 其实是个空函数.
+	// 处理Pod移除的事件, 释放 sandbox 占用的 IP, 并删除宿主机端的veth.
 	ws.Route(
 		ws.POST("/del").To(s.handler.handleDel).Reads(restapi.PodRequest{}),
 	)
@@ -3,45 +3,86 @@ package server
 import (
 	"fmt"
 	"net"
+	"syscall"
 
 	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
 	"github.com/generals-space/crd-ipkeeper/pkg/restapi"
+	"github.com/generals-space/crd-ipkeeper/pkg/staticip"
 	"github.com/vishvananda/netlink"
+	"k8s.io/klog"
 )
 
 func generateVethName(containerID string) (string, string) {
 	return fmt.Sprintf("%s_h", containerID[0:12]), fmt.Sprintf("%s_c", containerID[0:12])
 }
 
+// delHostVeth 删除 containerID 对应的宿主机端veth, 容器端会随之一同删除.
+// 设备不存在(sandbox 的 netns 已被销毁, 或是重复的 DEL 请求)时直接返回.
+func delHostVeth(containerID string) (err error) {
+	if len(containerID) < 12 {
+		return nil
+	}
+	hostVethName, _ := generateVethName(containerID)
+	hostVeth, err := netlink.LinkByName(hostVethName)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return fmt.Errorf("failed to find host veth %s: %s", hostVethName, err)
+	}
+	err = netlink.LinkDel(hostVeth)
+	if err != nil {
+		return fmt.Errorf("failed to delete host veth %s: %s", hostVethName, err)
+	}
+	return nil
+}
+
 // setVethPair 创建并设置veth pair对, 一端连接cni网桥, 一端放入pod容器.
 // err结果以fmt.Errorf()形式返回, 此函数中并不输出.
-func (csh *CNIServerHandler) setVethPair(podReq *restapi.PodRequest, ipAddr, gateway string) (err error) {
+// kubelet 对同一个 sandbox 重复发起 ADD 时, 如果 veth 已经创建且容器内的 eth0 已经有了分配的地址, 则直接返回.
+func (csh *CNIServerHandler) setVethPair(podReq *restapi.PodRequest, alloc *staticip.AllocatedIP) (err error) {
 	// 此处我们手动创建veth对, 为了避免与已有设备名称冲突, 这里我们根据containerID生成.
 	// 之后将属于容器的veth端移入container, 再将其重命名为eth0(kubelet要求必须要为eth0).
 	hostVethName, containerVethName := generateVethName(podReq.ContainerID)
+	configured, err := sandboxConfigured(hostVethName, podReq.NetNs, alloc)
+	if err != nil {
+		return err
+	}
+	if configured {
+		klog.Infof("veth %s of pod %s has been configured, skip", hostVethName, podReq.PodName)
+		return nil
+	}
+	// 设备存在但没有配置完成, 只可能是同一个 sandbox 之前的 ADD 中途失败留下的, 删除后重建.
+	err = delHostVeth(podReq.ContainerID)
+	if err != nil {
+		return err
+	}
+
 	veth := netlink.Veth{
 		LinkAttrs: netlink.LinkAttrs{
 			Name: hostVethName,
 		},
 		PeerName: containerVethName,
 	}
+	err = netlink.LinkAdd(&veth)
+	if err != nil {
+		return fmt.Errorf("failed to create veth pair for pod %s %v", podReq.PodName, err)
+	}
+	// 只清理本次创建的设备, LinkAdd 失败时同名的设备不是这里创建的.
 	defer func() {
 		// Remove veth link in case any error during creating pod network.
 		if err != nil {
 			netlink.LinkDel(&veth)
 		}
 	}()
-	err = netlink.LinkAdd(&veth)
-	if err != nil {
-		return fmt.Errorf("failed to create veth pair for pod %s %v", podReq.PodName, err)
-	}
 
 	err = setHostVeth(hostVethName, podReq.CNI0)
 	if err != nil {
 		return err
 	}
 
-	err = setContainerVeth(containerVethName, ipAddr, gateway, podReq.NetNs)
+	err = setContainerVeth(containerVethName, alloc, podReq.NetNs)
 	if err != nil {
 		return err
 	}
@@ -49,6 +90,56 @@ func (csh *CNIServerHandler) setVethPair(podReq *restapi.PodRequest, ipAddr, gat
 	return nil
 }
 
+// sandboxConfigured 判断 sandbox 的网络是否已经由之前的 ADD 配置完成:
+// 宿主机端的 veth 存在, 且 netns 中的 eth0 上已经有 alloc 中的全部地址.
+func sandboxConfigured(hostVethName, netnsPath string, alloc *staticip.AllocatedIP) (configured bool, err error) {
+	_, err = netlink.LinkByName(hostVethName)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to find host veth %s: %s", hostVethName, err)
+	}
+	err = ns.WithNetNSPath(netnsPath, func(_ ns.NetNS) error {
+		containerVeth, err := netlink.LinkByName("eth0")
+		if err != nil {
+			if _, ok := err.(netlink.LinkNotFoundError); ok {
+				return nil
+			}
+			return fmt.Errorf("can not find container nic eth0: %s", err)
+		}
+		addrs, err := netlink.AddrList(containerVeth, netlink.FAMILY_ALL)
+		if err != nil {
+			return fmt.Errorf("failed to list addresses of container eth0: %s", err)
+		}
+		for _, ipAddr := range []string{alloc.IPAddress, alloc.IPAddress6} {
+			if ipAddr == "" {
+				continue
+			}
+			ip, _, err := net.ParseCIDR(ipAddr)
+			if err != nil {
+				return fmt.Errorf("can not parse ip address %s: %s", ipAddr, err)
+			}
+			found := false
+			for _, addr := range addrs {
+				if addr.IP.Equal(ip) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil
+			}
+		}
+		configured = true
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return
+}
+
 // setHostVeth 设置宿主机上的设备, 将属于宿主机的那一端接入cni0网桥并启动等.
 func setHostVeth(vethName, cni0 string) (err error) {
 	// 将属于宿主机的那一端接入cni0网桥.
@@ -72,7 +163,8 @@ func setHostVeth(vethName, cni0 string) (err error) {
 }
 
 // setContainerVeth 容器内部的操作.
-func setContainerVeth(vethName, ipAddr, gateway, netnsPath string) error {
+// 双栈时 IPv4 与 IPv6 地址都会添加到 eth0 上, 并分别设置默认路由.
+func setContainerVeth(vethName string, alloc *staticip.AllocatedIP, netnsPath string) error {
 	containerVeth, err := netlink.LinkByName(vethName)
 	if err != nil {
 		return fmt.Errorf("can not find container nic %s %v", vethName, err)
@@ -91,33 +183,95 @@ func setContainerVeth(vethName, ipAddr, gateway, netnsPath string) error {
 		// 把veth pair在容器端的设备名修改为eth0, 否则kubelet会重建此Pod.
 		err = netlink.LinkSetName(containerVeth, "eth0")
 		if err != nil {
-			return fmt.Errorf("failed to rename container veth %s: %s", ipAddr, err)
+			return fmt.Errorf("failed to rename container veth %s: %s", vethName, err)
 		}
-		addr, err := netlink.ParseAddr(ipAddr)
-		if err != nil {
-			return fmt.Errorf("can not parse ip address %s: %s", ipAddr, err)
+		if alloc.IPAddress6 != "" {
+			// 容器内可能默认禁用了 IPv6, 需要先开启.
+			// 同时关闭 DAD, 否则地址在检测完成前处于 tentative 状态, 无法立即使用.
+			for _, key := range []string{
+				"net/ipv6/conf/all/disable_ipv6",
+				"net/ipv6/conf/eth0/disable_ipv6",
+			} {
+				if _, err = sysctl.Sysctl(key, "0"); err != nil {
+					return fmt.Errorf("failed to enable ipv6 by %s: %s", key, err)
+				}
+			}
+			if _, err = sysctl.Sysctl("net/ipv6/conf/eth0/accept_dad", "0"); err != nil {
+				return fmt.Errorf("failed to disable ipv6 dad: %s", err)
+			}
 		}
-		err = netlink.AddrAdd(containerVeth, addr)
-		if err != nil {
-			return fmt.Errorf("can not add address %s to container eth0: %s", ipAddr, err)
+		for _, ipAddr := range []string{alloc.IPAddress, alloc.IPAddress6} {
+			if ipAddr == "" {
+				continue
+			}
+			addr, err := netlink.ParseAddr(ipAddr)
+			if err != nil {
+				return fmt.Errorf("can not parse ip address %s: %s", ipAddr, err)
+			}
+			if addr.IP.To4() == nil {
+				addr.Flags = syscall.IFA_F_NODAD
+			}
+			err = netlink.AddrAdd(containerVeth, addr)
+			if err != nil {
+				return fmt.Errorf("can not add address %s to container eth0: %s", ipAddr, err)
+			}
 		}
 
 		err = netlink.LinkSetUp(containerVeth)
 		if err != nil {
-			return fmt.Errorf("can not set container eth0 %s up %s", ipAddr, err)
+			return fmt.Errorf("can not set container eth0 up %s", err)
 		}
 		// 设置默认路由, 此操作应该是cni插件中的ipam部分完成的, 这里我们需要手动添加.
-		_, defNet, _ := net.ParseCIDR("0.0.0.0/0")
-		err = netlink.RouteAdd(&netlink.Route{
+		routes := []struct{ dst, gateway string }{
+			{"0.0.0.0/0", alloc.Gateway},
+			{"::/0", alloc.Gateway6},
+		}
+		for _, route := range routes {
+			if route.gateway == "" {
+				continue
+			}
+			_, defNet, _ := net.ParseCIDR(route.dst)
+			err = netlink.RouteAdd(&netlink.Route{
+				LinkIndex: containerVeth.Attrs().Index,
+				Scope:     netlink.SCOPE_UNIVERSE,
+				Dst:       defNet,
+				Gw:        net.ParseIP(route.gateway),
+			})
+			if err != nil {
+				return fmt.Errorf("failed to add route via %s: %s", route.gateway, err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// replaceDefaultRoute 将 netnsPath 中 eth0 上与 gateway 同一地址族的默认路由替换为经由 gateway.
+// 修改 IP 池的网关后, 已经运行的 Pod 不需要重建, 见 gateway.go.
+func replaceDefaultRoute(netnsPath, gateway string) error {
+	gw := net.ParseIP(gateway)
+	if gw == nil {
+		return fmt.Errorf("invalid gateway %s", gateway)
+	}
+	dst := "0.0.0.0/0"
+	if gw.To4() == nil {
+		dst = "::/0"
+	}
+	_, defNet, _ := net.ParseCIDR(dst)
+	return ns.WithNetNSPath(netnsPath, func(_ ns.NetNS) error {
+		containerVeth, err := netlink.LinkByName("eth0")
+		if err != nil {
+			return fmt.Errorf("can not find container nic eth0: %s", err)
+		}
+		err = netlink.RouteReplace(&netlink.Route{
 			LinkIndex: containerVeth.Attrs().Index,
 			Scope:     netlink.SCOPE_UNIVERSE,
 			Dst:       defNet,
-			Gw:        net.ParseIP(gateway),
+			Gw:        gw,
 		})
 		if err != nil {
-			return fmt.Errorf("failed to add route for %s: %s", ipAddr, err)
+			return fmt.Errorf("failed to replace route via %s: %s", gateway, err)
 		}
-
 		return nil
 	})
 }
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+
+	"github.com/generals-space/crd-ipkeeper/pkg/restapi"
+	"github.com/generals-space/crd-ipkeeper/pkg/staticip"
+)
+
+// newTestBridge 创建测试用的网桥与同名的 netns, 需要 root 权限及 ip 命令, 否则跳过测试.
+// 返回的 cleanup 删除网桥与 netns.
+func newTestBridge(t *testing.T, name string) (netns ns.NetNS, cleanup func()) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating links requires root")
+	}
+	err := netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: name}})
+	if err != nil {
+		t.Skipf("failed to create bridge %s: %s", name, err)
+	}
+	bridge, err := netlink.LinkByName(name)
+	if err != nil {
+		t.Fatalf("failed to find bridge %s: %s", name, err)
+	}
+	if out, err := exec.Command("ip", "netns", "add", name).CombinedOutput(); err != nil {
+		netlink.LinkDel(bridge)
+		t.Skipf("failed to create netns %s: %s %s", name, err, out)
+	}
+	netns, err = ns.GetNS("/var/run/netns/" + name)
+	if err != nil {
+		t.Fatalf("failed to open netns %s: %s", name, err)
+	}
+	cleanup = func() {
+		netns.Close()
+		exec.Command("ip", "netns", "del", name).Run()
+		netlink.LinkDel(bridge)
+	}
+	return
+}
+
+// containerAddrs 返回 netns 中 eth0 上的地址.
+func containerAddrs(t *testing.T, netns ns.NetNS) (addrs []netlink.Addr) {
+	err := netns.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName("eth0")
+		if err != nil {
+			return err
+		}
+		addrs, err = netlink.AddrList(link, netlink.FAMILY_V4)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("failed to list addresses of eth0: %s", err)
+	}
+	return
+}
+
+// TestSetVethPairRepeatedAdd 对同一个 sandbox 重复 ADD 时不能删除或重建已经配置好的 veth.
+func TestSetVethPairRepeatedAdd(t *testing.T) {
+	netns, cleanup := newTestBridge(t, "ipktest0")
+	defer cleanup()
+
+	podReq := &restapi.PodRequest{
+		PodName:      "test-0",
+		PodNamespace: "default",
+		ContainerID:  "0123456789abcdef0123456789abcdef",
+		NetNs:        netns.Path(),
+		CNI0:         "ipktest0",
+	}
+	defer delHostVeth(podReq.ContainerID)
+	alloc := &staticip.AllocatedIP{IPAddress: "10.254.0.5/24", Gateway: "10.254.0.1"}
+	hostVethName, _ := generateVethName(podReq.ContainerID)
+	csh := &CNIServerHandler{}
+
+	if err := csh.setVethPair(podReq, alloc); err != nil {
+		t.Fatalf("first add failed: %s", err)
+	}
+	hostVeth, err := netlink.LinkByName(hostVethName)
+	if err != nil {
+		t.Fatalf("host veth is missing after first add: %s", err)
+	}
+
+	if err = csh.setVethPair(podReq, alloc); err != nil {
+		t.Fatalf("repeated add failed: %s", err)
+	}
+	again, err := netlink.LinkByName(hostVethName)
+	if err != nil {
+		t.Fatalf("host veth is removed by repeated add: %s", err)
+	}
+	if again.Attrs().Index != hostVeth.Attrs().Index {
+		t.Errorf("host veth is recreated by repeated add, index %d => %d", hostVeth.Attrs().Index, again.Attrs().Index)
+	}
+	addrs := containerAddrs(t, netns)
+	if len(addrs) != 1 || addrs[0].IPNet.String() != "10.254.0.5/24" {
+		t.Errorf("expected eth0 to keep 10.254.0.5/24, got %v", addrs)
+	}
+}
+
+// TestSetVethPairLeftover 之前的 ADD 中途失败留下的 veth 需要删除重建, 而不是返回 EEXIST.
+func TestSetVethPairLeftover(t *testing.T) {
+	netns, cleanup := newTestBridge(t, "ipktest1")
+	defer cleanup()
+
+	podReq := &restapi.PodRequest{
+		PodName:      "test-1",
+		PodNamespace: "default",
+		ContainerID:  "abcdef0123456789abcdef0123456789",
+		NetNs:        netns.Path(),
+		CNI0:         "ipktest1",
+	}
+	defer delHostVeth(podReq.ContainerID)
+	hostVethName, containerVethName := generateVethName(podReq.ContainerID)
+	err := netlink.LinkAdd(&netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{Name: hostVethName},
+		PeerName:  containerVethName,
+	})
+	if err != nil {
+		t.Fatalf("failed to create leftover veth: %s", err)
+	}
+
+	alloc := &staticip.AllocatedIP{IPAddress: "10.254.1.5/24", Gateway: "10.254.1.1"}
+	csh := &CNIServerHandler{}
+	if err = csh.setVethPair(podReq, alloc); err != nil {
+		t.Fatalf("add over leftover veth failed: %s", err)
+	}
+	addrs := containerAddrs(t, netns)
+	if len(addrs) != 1 || addrs[0].IPNet.String() != "10.254.1.5/24" {
+		t.Errorf("expected eth0 to have 10.254.1.5/24, got %v", addrs)
+	}
+}
@@ -0,0 +1,20 @@
+package staticip
+
+import (
+	"k8s.io/apimachinery/pkg/api/equality"
+
+	ipkv1 "github.com/generals-space/crd-ipkeeper/pkg/apis/ipkeeper/v1"
+)
+
+// UpdateAdoption 将接管已有 Pod 的进度写入 sip 的 status, 没有变化时不会写回.
+// caller: pkg/controller/adopt.go -> handleAdoptDeploy()
+func (h *Helper) UpdateAdoption(sip *ipkv1.StaticIP, adoption *ipkv1.AdoptionStatus) (err error) {
+	_, err = mutateStatus(h.crdClient, sip, func(latest *ipkv1.StaticIP) (bool, error) {
+		if equality.Semantic.DeepEqual(latest.Status.Adoption, adoption) {
+			return false, nil
+		}
+		latest.Status.Adoption = adoption.DeepCopy()
+		return true, nil
+	})
+	return
+}
@@ -0,0 +1,67 @@
+package staticip
+
+import (
+	"fmt"
+	"time"
+
+	ipkv1 "github.com/generals-space/crd-ipkeeper/pkg/apis/ipkeeper/v1"
+)
+
+// ParseReleaseCooldown 解析 release_cooldown 注解(或 spec.releaseCooldown)中的冷却时间, 为空时返回 0.
+func ParseReleaseCooldown(cooldownStr string) (cooldown time.Duration, err error) {
+	if cooldownStr == "" {
+		return 0, nil
+	}
+	cooldown, err = time.ParseDuration(cooldownStr)
+	if err != nil {
+		return 0, fmt.Errorf("invalid release cooldown %s: %s", cooldownStr, err)
+	}
+	if cooldown < 0 {
+		return 0, fmt.Errorf("invalid release cooldown %s: should not be negative", cooldownStr)
+	}
+	return
+}
+
+// isReleasing 判断 ip 是否处于冷却期.
+func isReleasing(sip *ipkv1.StaticIP, ip string) bool {
+	_, ok := sip.Status.Releasing[ip]
+	return ok
+}
+
+// HasExpiredReleasing 判断 sip 中是否有冷却结束, 可以移回 Avaliable 的 IP.
+func HasExpiredReleasing(sip *ipkv1.StaticIP, now time.Time) bool {
+	cooldown, _ := ParseReleaseCooldown(sip.Spec.ReleaseCooldown)
+	for _, released := range sip.Status.Releasing {
+		if !released.Add(cooldown).After(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReclaimReleasing 将 sip 中冷却结束的 IP 移回 Avaliable, 遇到冲突时基于最新的 sip 重试.
+// caller: pkg/controller/handler_sip.go -> reclaimReleasingIPs()
+func (h *Helper) ReclaimReleasing(sip *ipkv1.StaticIP) (err error) {
+	_, err = mutateStatus(h.crdClient, sip, func(latest *ipkv1.StaticIP) (bool, error) {
+		return reclaimReleasing(latest, time.Now()), nil
+	})
+	return
+}
+
+// reclaimReleasing 只修改内存中的 sip 对象, 没有需要移回的 IP 时返回 false.
+// 冷却时间被改小甚至被移除时, 已经处于冷却期的 IP 按新的冷却时间计算.
+func reclaimReleasing(sip *ipkv1.StaticIP, now time.Time) (changed bool) {
+	cooldown, _ := ParseReleaseCooldown(sip.Spec.ReleaseCooldown)
+	for ip, released := range sip.Status.Releasing {
+		if released.Add(cooldown).After(now) {
+			continue
+		}
+		delete(sip.Status.Releasing, ip)
+		changed = true
+		// IP 可能已经不在 IP 池中了.
+		if ownerPod, ok := sip.Status.IPMap[ip]; ok && ownerPod == nil {
+			sip.Status.Avaliable = append(sip.Status.Avaliable, ip)
+		}
+	}
+	return
+}
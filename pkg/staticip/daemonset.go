@@ -0,0 +1,167 @@
+package staticip
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+
+	ipkv1 "github.com/generals-space/crd-ipkeeper/pkg/apis/ipkeeper/v1"
+)
+
+// ResolveNodeIPs 解析 node_ips 注解, 返回各节点绑定的 IP(与 IPMap 的 key 格式相同).
+// 注解格式为 "node1=192.168.1.10,node2=192.168.1.11", IP 可以不带掩码, 但必须属于 IP 池,
+// 每个节点的每种地址族最多只能有一个 IP, 每个 IP 也只能属于一个节点.
+// @param ips: ParseIPPool() 得到的 IP 列表
+func ResolveNodeIPs(nodeIPsStr string, ips []string) (nodeIPs map[string][]string, err error) {
+	poolIPs := map[string]string{}
+	for _, ip := range ips {
+		poolIPs[trimPrefixLen(ip)] = ip
+	}
+	nodeIPs = map[string][]string{}
+	owners := map[string]string{}
+	for _, item := range strings.Split(nodeIPsStr, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid node ip item %s: should be node=ip", item)
+		}
+		node := strings.TrimSpace(parts[0])
+		ip := net.ParseIP(trimPrefixLen(strings.TrimSpace(parts[1])))
+		if ip == nil {
+			return nil, fmt.Errorf("invalid node ip item %s: bad address", item)
+		}
+		ipStr, ok := poolIPs[normalizeIP(ip).String()]
+		if !ok {
+			return nil, fmt.Errorf("ip %s of node %s is not in the ip pool", ip, node)
+		}
+		if owner, ok := owners[ipStr]; ok && owner != node {
+			return nil, fmt.Errorf("ip %s is assigned to both node %s and %s", ip, owner, node)
+		}
+		for _, other := range nodeIPs[node] {
+			if isIPv6(other) == isIPv6(ipStr) && other != ipStr {
+				return nil, fmt.Errorf("node %s has more than one ip of the same family", node)
+			}
+		}
+		if owners[ipStr] == node {
+			continue
+		}
+		owners[ipStr] = node
+		nodeIPs[node] = append(nodeIPs[node], ipStr)
+	}
+	return
+}
+
+// pickNodeIPs 为 DaemonSet 的 Pod 选取其所在节点的 IP, 每种地址族各一个, 优先级如下:
+// 1. node_ips 注解中为该节点显式声明的 IP;
+// 2. 该节点之前绑定过的 IP(NodeBindings);
+// 3. 未被声明或绑定到其他节点的空闲 IP(不包括处于冷却期的 IP);
+// 4. 以上都没有时, 才会使用已绑定到其他节点的空闲 IP, 并改为绑定到当前节点.
+// 选取结果会记录到 sip 的 NodeBindings 中, 由调用者负责写回.
+func pickNodeIPs(sip *ipkv1.StaticIP, pod *corev1.Pod) (alloc *AllocatedIP, err error) {
+	node := pod.Spec.NodeName
+	if node == "" {
+		return nil, fmt.Errorf("pod %s has not been scheduled to a node", pod.Name)
+	}
+	ips, err := ParseIPPool(sip.Spec.IPPool)
+	if err != nil {
+		return nil, err
+	}
+	explicit, err := ResolveNodeIPs(sip.Spec.NodeIPs, ips)
+	if err != nil {
+		return nil, err
+	}
+	// reserved 中是显式声明或已绑定的 IP, 及其所属的节点, 显式声明的优先.
+	reserved := map[string]string{}
+	explicitIPs := map[string]bool{}
+	for n, nodeIPs := range sip.Status.NodeBindings {
+		for _, ip := range nodeIPs {
+			reserved[ip] = n
+		}
+	}
+	for n, nodeIPs := range explicit {
+		for _, ip := range nodeIPs {
+			reserved[ip] = n
+			explicitIPs[ip] = true
+		}
+	}
+
+	alloc = &AllocatedIP{}
+	for _, v6 := range []bool{false, true} {
+		var chosen, fallback string
+		candidates := []string{}
+		candidates = append(candidates, explicit[node]...)
+		candidates = append(candidates, sip.Status.NodeBindings[node]...)
+		for _, ip := range candidates {
+			if isIPv6(ip) != v6 || reserved[ip] != node {
+				continue
+			}
+			ownerPod := sip.Status.IPMap[ip]
+			// DaemonSet 保证每个节点只有一个 Pod, 所以同一节点上的 Pod 占用的 IP 可以直接接管.
+			if ownerPod != nil && ownerPod.NodeName != node {
+				return nil, fmt.Errorf("ip %s of node %s is occupied by pod %s", ip, node, ownerPod.Name)
+			}
+			chosen = ip
+			break
+		}
+		if chosen == "" {
+			for _, ip := range ips {
+				if isIPv6(ip) != v6 || sip.Status.IPMap[ip] != nil || isReleasing(sip, ip) {
+					continue
+				}
+				if _, ok := reserved[ip]; !ok {
+					chosen = ip
+					break
+				}
+				// 显式声明的 IP 不会被其他节点使用.
+				if fallback == "" && !explicitIPs[ip] {
+					fallback = ip
+				}
+			}
+		}
+		if chosen == "" && fallback != "" {
+			klog.Infof("rebind ip %s from node %s to node %s", fallback, reserved[fallback], node)
+			removeBinding(sip, fallback)
+			chosen = fallback
+		}
+		if chosen == "" {
+			continue
+		}
+		if v6 {
+			alloc.IPAddress6 = chosen
+		} else {
+			alloc.IPAddress = chosen
+		}
+	}
+
+	if sip.Status.NodeBindings == nil {
+		sip.Status.NodeBindings = map[string][]string{}
+	}
+	bound := []string{}
+	for _, ip := range []string{alloc.IPAddress, alloc.IPAddress6} {
+		if ip != "" {
+			bound = append(bound, ip)
+		}
+	}
+	if len(bound) != 0 {
+		sip.Status.NodeBindings[node] = bound
+	}
+	return
+}
+
+// removeBinding 从 sip 的 NodeBindings 中移除 ip.
+func removeBinding(sip *ipkv1.StaticIP, ip string) {
+	for node, nodeIPs := range sip.Status.NodeBindings {
+		nodeIPs = removeString(nodeIPs, ip)
+		if len(nodeIPs) == 0 {
+			delete(sip.Status.NodeBindings, node)
+		} else {
+			sip.Status.NodeBindings[node] = nodeIPs
+		}
+	}
+}
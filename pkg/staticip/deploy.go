@@ -4,75 +4,174 @@ import (
 	"fmt"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	cgkuber "k8s.io/client-go/kubernetes"
-	"k8s.io/klog"
+	"k8s.io/client-go/util/retry"
 
 	ipkv1 "github.com/generals-space/crd-ipkeeper/pkg/apis/ipkeeper/v1"
 	crdClientset "github.com/generals-space/crd-ipkeeper/pkg/client/clientset/versioned"
 )
 
-// RenewStaticIP 对比 oldSIP/newSIP 的不同, 移除多余 Pod 并更新 oldSIP 为 newSIP 的状态.
+// RenewStaticIP 对比 oldSIP/newSIP 的不同, 并更新 oldSIP 为 newSIP 的状态.
+// 占用了被移除的 IP 的 Pod 不会在这里直接删除, 而是记录到 Evicting 中,
+// 由 controller 通过 Eviction 接口逐个驱逐, 以遵循 PodDisruptionBudget, 见 pkg/controller/evict.go.
+// ShrinkPolicy 为 drain 时则记录到 Draining 中, 等待 Pod 被自然替换, 见 drain.go.
+// spec 与 status 都基于最新获取的对象更新, 遇到冲突时重试, 以免覆盖期间 CNI server 分配与释放的 IP.
+// 返回后 oldSIP 为更新后的对象.
+// @return evicting: 需要驱逐的 Pod 数量
 // caller: handleUpdateDeploy()
 func RenewStaticIP(
-	kubeClient cgkuber.Interface,
 	crdClient crdClientset.Interface,
 	oldSIP, newSIP *ipkv1.StaticIP,
-) (err error) {
-	sip, pods, err := renewStaticIP(oldSIP, newSIP)
-	// 将更新 StaticIP 对象, 再移除多余的 pods
-	_, err = crdClient.IpkeeperV1().StaticIPs(newSIP.Namespace).Update(sip)
-	if err != nil {
-		return fmt.Errorf("failed to update static ip: %s", err)
-	}
-
-	for _, pod := range pods {
-		err = kubeClient.CoreV1().Pods(pod.Namespace).Delete(pod.Name, &metav1.DeleteOptions{})
+) (evicting int, err error) {
+	// spec 与 status 需要分别调用 Update() 与 UpdateStatus() 完成更新.
+	var sip *ipkv1.StaticIP
+	err = retry.RetryOnConflict(conflictBackoff, func() (err error) {
+		latest, err := crdClient.IpkeeperV1().StaticIPs(oldSIP.Namespace).Get(oldSIP.Name, metav1.GetOptions{})
 		if err != nil {
-			klog.Warningf("failed to delete redundant pod: %+v: %s", pod, err)
+			return err
 		}
+		latest.Spec = newSIP.Spec
+		sip, err = crdClient.IpkeeperV1().StaticIPs(oldSIP.Namespace).Update(latest)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to update static ip: %s", err)
+	}
+	sip, err = mutateStatus(crdClient, sip, func(latest *ipkv1.StaticIP) (bool, error) {
+		// renewStaticIP() 会修改 newSIP, 每次重试都需要使用新的副本.
+		renewed := renewStaticIP(latest, newSIP.DeepCopy())
+		renewed.Status.ObservedGeneration = renewed.Generation
+		checkConflict(crdClient, renewed)
+		return true, nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to update static ip status: %s", err)
+	}
+	sip.DeepCopyInto(oldSIP)
+	if sip.Status.Shrink != nil {
+		evicting = int(sip.Status.Shrink.Pending)
 	}
-
 	return
 }
 
 // renewStaticIP ...
 func renewStaticIP(
 	oldSIP, newSIP *ipkv1.StaticIP,
-) (sip *ipkv1.StaticIP, pods []*ipkv1.OwnerPod, err error) {
-	pods = []*ipkv1.OwnerPod{}
+) (sip *ipkv1.StaticIP) {
 	// 遍历 oldSIP 已经分配出去的 IP 列表,
 	// 若仍在 newSIP 的 IPMap 中, 则保留并赋值到 newSIP 的 ownerPod 中,
-	// 否则需要将那些已经占用了这些 IP 的 Pod 移除.
-	for _, ip := range oldSIP.Spec.Used {
-		ownerPod := oldSIP.Spec.IPMap[ip]
-		_, ok := newSIP.Spec.IPMap[ip]
+	// 否则按照 ShrinkPolicy 记录到 Evicting 或 Draining 中.
+	for _, ip := range oldSIP.Status.Used {
+		ownerPod := oldSIP.Status.IPMap[ip]
+		_, ok := newSIP.Status.IPMap[ip]
 
 		if ok {
 			// 如果已分配的 IP 仍属于新的 StaticIP 范围, 则加入到 Used 列表中,
-			newSIP.Spec.Used = append(newSIP.Spec.Used, ip)
-			newSIP.Spec.IPMap[ip] = ownerPod
+			// 之前版本分配的 IP 没有记录网关, 这里补上旧的网关, 网关变化时由节点更新 Pod 的默认路由.
+			if ownerPod != nil && ownerPod.Gateway == "" {
+				ownerPod.Gateway = GatewayOf(oldSIP, ip)
+			}
+			newSIP.Status.Used = append(newSIP.Status.Used, ip)
+			newSIP.Status.IPMap[ip] = ownerPod
 		} else if ownerPod != nil {
-			// 如果该 IP 已被移除, 则占用此 IP 的 Pod 也需要被移除.
-			// 不过移除的操作由主调函数完成.
-			pods = append(pods, ownerPod)
+			setRemoved(newSIP, ip, ownerPod)
 		}
 	}
+	// 上一次缩小时还没有驱逐完(或还没有被替换)的 Pod, 其 IP 重新加回 IP 池时不再需要驱逐.
+	// 否则按照新的 ShrinkPolicy 重新记录, 策略由 drain 改为 evict 时这些 Pod 也会被驱逐.
+	for _, removed := range []map[string]*ipkv1.OwnerPod{oldSIP.Status.Evicting, oldSIP.Status.Draining} {
+		for ip, ownerPod := range removed {
+			if current, ok := newSIP.Status.IPMap[ip]; ok && current == nil {
+				newSIP.Status.Used = append(newSIP.Status.Used, ip)
+				newSIP.Status.IPMap[ip] = ownerPod
+			} else {
+				setRemoved(newSIP, ip, ownerPod)
+			}
+		}
+	}
+	newSIP.Status.Shrink = renewShrink(oldSIP, newSIP)
 
 	// 还有要将 avaliable 减去 used 的部分, 并把未使用的 IP 也添加到 IPMap 中.
-	for ip, pod := range newSIP.Spec.IPMap {
+	// newSIP 的 Avaliable 在 NewStaticIP() 时包含了全部 IP, 这里需要重新生成.
+	newSIP.Status.Avaliable = []string{}
+	for ip, pod := range newSIP.Status.IPMap {
 		if pod != nil {
 			continue
 		}
-		newSIP.Spec.IPMap[ip] = nil
-		newSIP.Spec.Avaliable = append(newSIP.Spec.Avaliable, ip)
+		// 处于冷却期的 IP 仍留在 Releasing 中.
+		if released, ok := oldSIP.Status.Releasing[ip]; ok {
+			if newSIP.Status.Releasing == nil {
+				newSIP.Status.Releasing = map[string]metav1.Time{}
+			}
+			newSIP.Status.Releasing[ip] = released
+			continue
+		}
+		newSIP.Status.IPMap[ip] = nil
+		newSIP.Status.Avaliable = append(newSIP.Status.Avaliable, ip)
 	}
-
-	newSIP.Spec.Ratio = fmt.Sprintf("%d/%d", len(newSIP.Spec.Used), len(newSIP.Spec.IPMap))
+	// DaemonSet 各节点绑定的 IP 仍在新的 IP 池中时继续保留.
+	for node, nodeIPs := range oldSIP.Status.NodeBindings {
+		kept := []string{}
+		for _, ip := range nodeIPs {
+			if _, ok := newSIP.Status.IPMap[ip]; ok {
+				kept = append(kept, ip)
+			}
+		}
+		if len(kept) == 0 {
+			continue
+		}
+		if newSIP.Status.NodeBindings == nil {
+			newSIP.Status.NodeBindings = map[string][]string{}
+		}
+		newSIP.Status.NodeBindings[node] = kept
+	}
+	// StatefulSet 各序号绑定的 IP 同样只保留仍在新的 IP 池中的.
+	for ordinal, ordinalIPs := range oldSIP.Status.OrdinalBindings {
+		kept := []string{}
+		for _, ip := range ordinalIPs {
+			if _, ok := newSIP.Status.IPMap[ip]; ok {
+				kept = append(kept, ip)
+			}
+		}
+		if len(kept) == 0 {
+			continue
+		}
+		if newSIP.Status.OrdinalBindings == nil {
+			newSIP.Status.OrdinalBindings = map[string][]string{}
+		}
+		newSIP.Status.OrdinalBindings[ordinal] = kept
+	}
+	// 仍在新的 IP 池中的 IP 保留其释放时间, 供 round-robin 策略使用.
+	for ip, released := range oldSIP.Status.LastReleased {
+		if _, ok := newSIP.Status.IPMap[ip]; !ok {
+			continue
+		}
+		if newSIP.Status.LastReleased == nil {
+			newSIP.Status.LastReleased = map[string]metav1.Time{}
+		}
+		newSIP.Status.LastReleased[ip] = released
+	}
+	// 滚动更新的预留记录同样只保留仍在新的 IP 池中的 IP.
+	for ip, handover := range oldSIP.Status.Handover {
+		if _, ok := newSIP.Status.IPMap[ip]; !ok {
+			continue
+		}
+		if newSIP.Status.Handover == nil {
+			newSIP.Status.Handover = map[string]ipkv1.IPHandover{}
+		}
+		newSIP.Status.Handover[ip] = handover
+	}
+	// 保留原有的 conditions, 以免丢失 LastTransitionTime 等信息.
+	// 能够走到这里说明 owner 仍然声明了 IP 池, 之前被移除的注解又被加了回来时, 不再需要删除 StaticIP.
+	newSIP.Status.Conditions = oldSIP.Status.Conditions
+	RemoveCondition(&newSIP.Status, ipkv1.StaticIPRetiring)
+	newSIP.Status.Adoption = oldSIP.Status.Adoption
+	refreshStatus(newSIP)
 
 	// 因为本函数是为 Update 操作做准备, 而 Update 操作需要 StaticIP 对象
 	// 拥有 resourceVersion 字段, 所以这里将更新后的信息赋值给 oldSIP,
 	// 之后的 Update 操作也将使用 sip 作为目标对象.
 	sip = oldSIP
 	sip.Spec = newSIP.Spec
+	sip.Status = newSIP.Status
 	return
 }
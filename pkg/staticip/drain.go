@@ -0,0 +1,55 @@
+package staticip
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+
+	ipkv1 "github.com/generals-space/crd-ipkeeper/pkg/apis/ipkeeper/v1"
+)
+
+// IP 池缩小后处理占用了被移除的 IP 的 Pod 的策略, 见 StaticIPSpec.ShrinkPolicy 与 shrink_policy 注解.
+const (
+	// ShrinkPolicyEvict 通过 Eviction 接口逐个驱逐这些 Pod, 为默认策略, 见 evict.go.
+	ShrinkPolicyEvict = "evict"
+	// ShrinkPolicyDrain 这些 Pod 继续使用原来的 IP, 直到被自然替换, 期间 IP 记录在 Draining 中.
+	ShrinkPolicyDrain = "drain"
+)
+
+// ValidateShrinkPolicy 校验 shrink_policy 注解(或 spec.shrinkPolicy), 为空时使用 ShrinkPolicyEvict.
+func ValidateShrinkPolicy(policy string) (err error) {
+	switch policy {
+	case "", ShrinkPolicyEvict, ShrinkPolicyDrain:
+		return nil
+	}
+	return fmt.Errorf("unknown shrink policy %s, should be one of %s, %s", policy, ShrinkPolicyEvict, ShrinkPolicyDrain)
+}
+
+// setRemoved 按照 sip 的 ShrinkPolicy 将 ownerPod 占用的, 已经被移出 IP 池的 ip 记录到 Evicting 或 Draining 中.
+func setRemoved(sip *ipkv1.StaticIP, ip string, ownerPod *ipkv1.OwnerPod) {
+	if sip.Spec.ShrinkPolicy != ShrinkPolicyDrain {
+		setEvicting(sip, ip, ownerPod)
+		return
+	}
+	if sip.Status.Draining == nil {
+		sip.Status.Draining = map[string]*ipkv1.OwnerPod{}
+	}
+	sip.Status.Draining[ip] = ownerPod
+}
+
+// releaseDraining 移除 Draining 中 pod 占用的 IP, 只修改内存中的 sip 对象.
+// 与 releaseEvicting() 相同, 这些 IP 已经不属于 IP 池, 不需要放回 Avaliable.
+func releaseDraining(sip *ipkv1.StaticIP, pod *corev1.Pod, containerID string) (ips []string) {
+	ips = []string{}
+	for ip, ownerPod := range sip.Status.Draining {
+		if ownerPod == nil || ownerPod.UID != pod.UID {
+			continue
+		}
+		if containerID != "" && ownerPod.ContainerID != "" && ownerPod.ContainerID != containerID {
+			continue
+		}
+		delete(sip.Status.Draining, ip)
+		ips = append(ips, ip)
+	}
+	return
+}
@@ -0,0 +1,44 @@
+package staticip
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	cgrecord "k8s.io/client-go/tools/record"
+
+	ipkv1 "github.com/generals-space/crd-ipkeeper/pkg/apis/ipkeeper/v1"
+)
+
+// RecordEvent 在 pod, sip 所属的 workload 以及 sip 上记录同一事件,
+// 这样无论对其中哪一个执行 kubectl describe 都能看到 IP 的分配情况.
+// pod 为 nil 时(如 IP 池缩容)只记录在 workload 与 sip 上; sip 直属于 pod 时 workload 即 pod 本身, 不会重复记录.
+// sip 的 TypeMeta 为空时, recorder 需要从 scheme 中查找其类型, 所以调用者需要先将 ipkv1 注册到 recorder 的 scheme 中.
+func RecordEvent(
+	recorder cgrecord.EventRecorder,
+	sip *ipkv1.StaticIP,
+	pod *corev1.Pod,
+	eventtype, reason, messageFmt string,
+	args ...interface{},
+) {
+	if pod != nil {
+		recorder.Eventf(pod, eventtype, reason, messageFmt, args...)
+	}
+	if ref := workloadRef(sip); ref != nil && (pod == nil || ref.UID != pod.UID) {
+		recorder.Eventf(ref, eventtype, reason, messageFmt, args...)
+	}
+	recorder.Eventf(sip, eventtype, reason, messageFmt, args...)
+}
+
+// workloadRef 根据 sip 的 ownerReference 构建其 workload 的引用,
+// 不需要再获取 workload 对象本身, 对 CloneSet 等非内置类型同样适用.
+func workloadRef(sip *ipkv1.StaticIP) *corev1.ObjectReference {
+	ref := controllerRef(sip)
+	if ref == nil {
+		return nil
+	}
+	return &corev1.ObjectReference{
+		APIVersion: ref.APIVersion,
+		Kind:       ref.Kind,
+		Namespace:  sip.Namespace,
+		Name:       ref.Name,
+		UID:        ref.UID,
+	}
+}
@@ -0,0 +1,95 @@
+package staticip
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apimtypes "k8s.io/apimachinery/pkg/types"
+
+	ipkv1 "github.com/generals-space/crd-ipkeeper/pkg/apis/ipkeeper/v1"
+)
+
+// IP 池缩小后, 占用了被移除的 IP 的 Pod 需要重建. 这些 IP 从 IPMap 中移除后记录在 Evicting 中,
+// 由 controller 通过 Eviction 接口逐个驱逐, Pod 退出释放 IP 时再从 Evicting 中移除.
+
+// setEvicting 将 ownerPod 占用的 ip 记录为等待驱逐.
+func setEvicting(sip *ipkv1.StaticIP, ip string, ownerPod *ipkv1.OwnerPod) {
+	if sip.Status.Evicting == nil {
+		sip.Status.Evicting = map[string]*ipkv1.OwnerPod{}
+	}
+	sip.Status.Evicting[ip] = ownerPod
+}
+
+// EvictingPods 返回 sip 中等待驱逐的 Pod, 双栈时同一个 Pod 可能占用两个 IP, 这里按 UID 去重.
+func EvictingPods(sip *ipkv1.StaticIP) (pods map[apimtypes.UID]*ipkv1.OwnerPod) {
+	pods = map[apimtypes.UID]*ipkv1.OwnerPod{}
+	for _, ownerPod := range sip.Status.Evicting {
+		if ownerPod != nil {
+			pods[ownerPod.UID] = ownerPod
+		}
+	}
+	return
+}
+
+// renewShrink 根据 IP 池更新后 newSIP 中等待驱逐的 Pod 生成驱逐进度.
+// 上一次缩小还没有完成时继续累计, 否则重新开始计数.
+func renewShrink(oldSIP, newSIP *ipkv1.StaticIP) *ipkv1.ShrinkStatus {
+	pending := len(EvictingPods(newSIP))
+	if pending == 0 {
+		if oldSIP.Status.Shrink == nil {
+			return nil
+		}
+		shrink := oldSIP.Status.Shrink.DeepCopy()
+		shrink.Pending = 0
+		return shrink
+	}
+	shrink := &ipkv1.ShrinkStatus{}
+	if oldSIP.Status.Shrink != nil && len(oldSIP.Status.Evicting) != 0 {
+		shrink = oldSIP.Status.Shrink.DeepCopy()
+	}
+	shrink.Pending = int32(pending)
+	shrink.Message = fmt.Sprintf("%d pods are using ips removed from the pool, waiting for eviction", pending)
+	return shrink
+}
+
+// releaseEvicting 移除 Evicting 中 pod 占用的 IP, 只修改内存中的 sip 对象.
+// 这些 IP 已经不属于 IP 池, 所以不需要放回 Avaliable.
+func releaseEvicting(sip *ipkv1.StaticIP, pod *corev1.Pod, containerID string) (ips []string) {
+	ips = []string{}
+	for ip, ownerPod := range sip.Status.Evicting {
+		if ownerPod == nil || ownerPod.UID != pod.UID {
+			continue
+		}
+		if containerID != "" && ownerPod.ContainerID != "" && ownerPod.ContainerID != containerID {
+			continue
+		}
+		delete(sip.Status.Evicting, ip)
+		ips = append(ips, ip)
+	}
+	return
+}
+
+// UpdateShrink 移除 Evicting 中已经退出的 Pod, 并写入驱逐进度, 没有变化时不会写回.
+// @param gone: key 为 IP, val 为占用此 IP 的 Pod 的 UID, 只有 IP 仍被同一个 UID 占用时才会移除.
+// caller: pkg/controller/evict.go -> handleEvictSIP()
+func (h *Helper) UpdateShrink(
+	sip *ipkv1.StaticIP,
+	gone map[string]apimtypes.UID,
+	shrink *ipkv1.ShrinkStatus,
+) (err error) {
+	_, err = mutateStatus(h.crdClient, sip, func(latest *ipkv1.StaticIP) (changed bool, err error) {
+		for ip, uid := range gone {
+			if ownerPod := latest.Status.Evicting[ip]; ownerPod != nil && ownerPod.UID == uid {
+				delete(latest.Status.Evicting, ip)
+				changed = true
+			}
+		}
+		if !equality.Semantic.DeepEqual(latest.Status.Shrink, shrink) {
+			latest.Status.Shrink = shrink.DeepCopy()
+			changed = true
+		}
+		return changed, nil
+	})
+	return
+}
@@ -0,0 +1,123 @@
+package staticip
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apimmetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apimtypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+
+	ipkv1 "github.com/generals-space/crd-ipkeeper/pkg/apis/ipkeeper/v1"
+	"github.com/generals-space/crd-ipkeeper/pkg/util"
+)
+
+// StaticIP 通过 ownerReference 随 owner 一同被删除, 但此时 owner 的 Pod 可能还没有退出.
+// 如果 StaticIP 直接被删除, 同名 owner 重建后新的 StaticIP 会把这些 IP 再次分配出去,
+// 引用 IPPool 的 StaticIP 划分到的 IP 也会被归还, 分配给其他 StaticIP.
+// 所以 StaticIP 创建时都带有 finalizer, 由 controller 等到占用 IP 的 Pod 全部退出, IP 全部释放后才移除.
+
+// HasFinalizer 判断 sip 是否带有 util.StaticIPFinalizer.
+func HasFinalizer(sip *ipkv1.StaticIP) bool {
+	for _, finalizer := range sip.Finalizers {
+		if finalizer == util.StaticIPFinalizer {
+			return true
+		}
+	}
+	return false
+}
+
+// EnsureFinalizer 为之前版本创建的, 没有 finalizer 的 sip 添加 finalizer.
+// caller: pkg/controller/handler_sip.go -> handleSyncSIP()
+func (h *Helper) EnsureFinalizer(sip *ipkv1.StaticIP) (err error) {
+	return retry.RetryOnConflict(conflictBackoff, func() (err error) {
+		latest, err := h.crdClient.IpkeeperV1().StaticIPs(sip.Namespace).Get(sip.Name, apimmetav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if HasFinalizer(latest) || latest.DeletionTimestamp != nil {
+			return nil
+		}
+		latest.Finalizers = append(latest.Finalizers, util.StaticIPFinalizer)
+		_, err = h.crdClient.IpkeeperV1().StaticIPs(latest.Namespace).Update(latest)
+		return err
+	})
+}
+
+// FinalizeStaticIP 释放正在删除的 sip 中已经不存在的 Pod 占用的 IP, 并在 Terminating 状态中记录删除进度.
+// 所有 IP 都已释放时移除 finalizer, sip 随后会被 apiserver 删除.
+// @param gone: key 为 IP, val 为占用此 IP 的 Pod 的 UID, 只有 IP 仍被同一个 UID 占用时才会释放.
+// @return remaining: 仍占用 IP 的 Pod 数量
+// caller: pkg/controller/handler_sip.go -> handleSyncSIP()
+func (h *Helper) FinalizeStaticIP(
+	sip *ipkv1.StaticIP,
+	gone map[string]apimtypes.UID,
+) (remaining int, err error) {
+	_, err = mutateStatus(h.crdClient, sip, func(latest *ipkv1.StaticIP) (changed bool, err error) {
+		ips := []string{}
+		for ip, uid := range gone {
+			if ownerPod := latest.Status.IPMap[ip]; ownerPod != nil && ownerPod.UID == uid {
+				ips = append(ips, ip)
+			}
+			// IP 池缩小后还没有被驱逐(或还没有被替换)的 Pod.
+			for _, removed := range []map[string]*ipkv1.OwnerPod{latest.Status.Evicting, latest.Status.Draining} {
+				if ownerPod := removed[ip]; ownerPod != nil && ownerPod.UID == uid {
+					delete(removed, ip)
+					changed = true
+				}
+			}
+		}
+		if len(ips) != 0 {
+			markReleased(latest, ips)
+			changed = true
+		}
+		// 双栈时同一个 Pod 占用两个 IP.
+		pods := EvictingPods(latest)
+		for _, ipMap := range []map[string]*ipkv1.OwnerPod{latest.Status.IPMap, latest.Status.Draining} {
+			for _, ownerPod := range ipMap {
+				if ownerPod != nil {
+					pods[ownerPod.UID] = ownerPod
+				}
+			}
+		}
+		remaining = len(pods)
+		reason, message := "IPsReleased", "all ips are released"
+		if remaining != 0 {
+			reason, message = "WaitingForPods", fmt.Sprintf("waiting for %d pods to release their ips", remaining)
+		}
+		cond := GetCondition(&latest.Status, ipkv1.StaticIPTerminating)
+		if cond == nil || cond.Reason != reason || cond.Message != message {
+			SetCondition(&latest.Status, ipkv1.StaticIPTerminating, corev1.ConditionTrue, reason, message)
+			changed = true
+		}
+		return changed, nil
+	})
+	if err != nil || remaining != 0 {
+		return
+	}
+	klog.Infof("all ips of staticip %s/%s are released, remove its finalizer", sip.Namespace, sip.Name)
+	return 0, h.removeFinalizer(sip)
+}
+
+// removeFinalizer 移除 sip 的 util.StaticIPFinalizer.
+func (h *Helper) removeFinalizer(sip *ipkv1.StaticIP) (err error) {
+	return retry.RetryOnConflict(conflictBackoff, func() (err error) {
+		latest, err := h.crdClient.IpkeeperV1().StaticIPs(sip.Namespace).Get(sip.Name, apimmetav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		finalizers := []string{}
+		for _, finalizer := range latest.Finalizers {
+			if finalizer != util.StaticIPFinalizer {
+				finalizers = append(finalizers, finalizer)
+			}
+		}
+		if len(finalizers) == len(latest.Finalizers) {
+			return nil
+		}
+		latest.Finalizers = finalizers
+		_, err = h.crdClient.IpkeeperV1().StaticIPs(latest.Namespace).Update(latest)
+		return err
+	})
+}
@@ -0,0 +1,73 @@
+package staticip
+
+import (
+	apimtypes "k8s.io/apimachinery/pkg/types"
+
+	ipkv1 "github.com/generals-space/crd-ipkeeper/pkg/apis/ipkeeper/v1"
+)
+
+// 只修改了网关的 IP 池不需要重建 Pod, 各节点上的 cni server 发现 StaticIP 的网关变化后,
+// 直接进入 Pod 的 netns 替换默认路由, 并将结果记录到 IPMap 中对应 OwnerPod 的 Gateway 与 GatewayError 中.
+
+// GatewayResult 节点上更新一个 Pod 默认路由的结果.
+type GatewayResult struct {
+	UID         apimtypes.UID
+	ContainerID string
+	// Gateway 本次设置的网关
+	Gateway string
+	// Err 为 nil 表示更新成功
+	Err error
+}
+
+// GatewayOf 返回 ip 所属地址族在 sip 中声明的网关.
+func GatewayOf(sip *ipkv1.StaticIP, ip string) string {
+	if isIPv6(ip) {
+		return sip.Spec.Gateway6
+	}
+	return sip.Spec.Gateway
+}
+
+// StaleGateways 返回 sip 中运行在 nodeName 节点上, 且默认路由的网关与当前声明的网关不一致的 Pod.
+// key 为 IP, val 为占用此 IP 的 Pod, 应该使用的网关见 GatewayOf().
+// caller: pkg/server/gateway.go
+func StaleGateways(sip *ipkv1.StaticIP, nodeName string) (stale map[string]*ipkv1.OwnerPod) {
+	stale = map[string]*ipkv1.OwnerPod{}
+	for ip, ownerPod := range sip.Status.IPMap {
+		if ownerPod == nil || ownerPod.NodeName != nodeName {
+			continue
+		}
+		// 没有记录网关的是之前版本分配的 IP, 无从判断.
+		gateway := GatewayOf(sip, ip)
+		if gateway == "" || ownerPod.Gateway == "" || ownerPod.Gateway == gateway {
+			continue
+		}
+		stale[ip] = ownerPod
+	}
+	return
+}
+
+// UpdatePodGateways 将节点更新默认路由的结果写入 sip 的 IPMap, 没有变化时不会写回.
+// 只有 IP 仍被同一个 sandbox 占用时才会写入, 期间 Pod 被重建时新的 sandbox 已经使用了新的网关.
+// @param results: key 为 IP
+// caller: pkg/server/gateway.go
+func (h *Helper) UpdatePodGateways(sip *ipkv1.StaticIP, results map[string]*GatewayResult) (err error) {
+	_, err = mutateStatus(h.crdClient, sip, func(latest *ipkv1.StaticIP) (changed bool, err error) {
+		for ip, result := range results {
+			ownerPod := latest.Status.IPMap[ip]
+			if ownerPod == nil || ownerPod.UID != result.UID || ownerPod.ContainerID != result.ContainerID {
+				continue
+			}
+			gateway, gatewayErr := result.Gateway, ""
+			if result.Err != nil {
+				gateway, gatewayErr = ownerPod.Gateway, result.Err.Error()
+			}
+			if ownerPod.Gateway == gateway && ownerPod.GatewayError == gatewayErr {
+				continue
+			}
+			ownerPod.Gateway, ownerPod.GatewayError = gateway, gatewayErr
+			changed = true
+		}
+		return changed, nil
+	})
+	return
+}
@@ -0,0 +1,57 @@
+package staticip
+
+import (
+	apimtypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
+
+	ipkv1 "github.com/generals-space/crd-ipkeeper/pkg/apis/ipkeeper/v1"
+)
+
+// ReleaseOrphanIPs 释放 sip 中已经不存在的 Pod 占用的 IP, 遇到冲突时基于最新的 sip 重试.
+// @param orphans: key 为 IP, val 为占用此 IP 的 Pod 的 UID,
+// 只有 IP 仍被同一个 UID 占用时才会释放, 以免释放了在此期间重新分配给其他 Pod 的 IP.
+// @return reclaimed: 实际被释放的 IP 及其原来的 owner
+// caller: pkg/controller/gc.go -> collectOrphanIPs()
+func (h *Helper) ReleaseOrphanIPs(
+	sip *ipkv1.StaticIP,
+	orphans map[string]apimtypes.UID,
+) (reclaimed map[string]*ipkv1.OwnerPod, err error) {
+	result, err := mutateStatus(h.crdClient, sip, func(latest *ipkv1.StaticIP) (bool, error) {
+		reclaimed = map[string]*ipkv1.OwnerPod{}
+		ips := []string{}
+		for ip, uid := range orphans {
+			// Draining 与 Evicting 中的 IP 已经不属于 IP 池, 直接移除即可.
+			if ownerPod := latest.Status.Draining[ip]; ownerPod != nil && ownerPod.UID == uid {
+				delete(latest.Status.Draining, ip)
+				reclaimed[ip] = ownerPod
+				continue
+			}
+			if ownerPod := latest.Status.Evicting[ip]; ownerPod != nil && ownerPod.UID == uid {
+				delete(latest.Status.Evicting, ip)
+				reclaimed[ip] = ownerPod
+				continue
+			}
+			ownerPod := latest.Status.IPMap[ip]
+			if ownerPod == nil || ownerPod.UID != uid {
+				continue
+			}
+			reclaimed[ip] = ownerPod
+			ips = append(ips, ip)
+		}
+		if len(reclaimed) == 0 {
+			return false, nil
+		}
+		markReleased(latest, ips)
+		latest.Status.ReclaimedTotal += int64(len(reclaimed))
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result != nil {
+		if err := h.deleteIfRetired(result); err != nil {
+			klog.Warningf("failed to delete retired staticip %s: %s", sip.Name, err)
+		}
+	}
+	return
+}
@@ -0,0 +1,147 @@
+package staticip
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apimmetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	cglistersappsv1 "k8s.io/client-go/listers/apps/v1"
+	"k8s.io/klog"
+
+	ipkv1 "github.com/generals-space/crd-ipkeeper/pkg/apis/ipkeeper/v1"
+)
+
+// revisionAnnotation Deployment controller 记录在 ReplicaSet 上的版本号.
+const revisionAnnotation = "deployment.kubernetes.io/revision"
+
+// handoverTimeout 滚动更新时 IP 预留的有效期,
+// 超时后新 ReplicaSet 仍没有 Pod 来使用, 就不再为其保留, 以免滚动更新被中止或回滚后 IP 一直无法使用.
+const handoverTimeout = 5 * time.Minute
+
+// NewestRevisionHash 返回 Deployment 最新版本的 ReplicaSet 的 pod-template-hash.
+// 同一 Deployment 下的多个 ReplicaSet 即其各个版本, 版本号记录在 ReplicaSet 的 revision 注解中.
+// ReplicaSet 从 controller 的缓存中获取, 只按 ownerReference 的 UID 筛选出属于 deploy 的.
+// @param deploy: Deployment 对象, 可以是 *appsv1.Deployment 或 unstructured 对象
+func NewestRevisionHash(
+	rsLister cglistersappsv1.ReplicaSetLister,
+	deploy apimmetav1.Object,
+) (hash string, err error) {
+	rsList, err := rsLister.ReplicaSets(deploy.GetNamespace()).List(labels.Everything())
+	if err != nil {
+		return "", err
+	}
+	newest := int64(-1)
+	for _, rs := range rsList {
+		ref := apimmetav1.GetControllerOf(rs)
+		if ref == nil || ref.UID != deploy.GetUID() {
+			continue
+		}
+		revision, err := strconv.ParseInt(rs.Annotations[revisionAnnotation], 10, 64)
+		if err != nil {
+			continue
+		}
+		if revision > newest {
+			newest = revision
+			hash = rs.Labels[appsv1.DefaultDeploymentUniqueLabelKey]
+		}
+	}
+	if hash == "" {
+		return "", fmt.Errorf("failed to find the newest replicaset of deployment %s", deploy.GetName())
+	}
+	return
+}
+
+// ReserveForHandover Deployment 滚动更新时, 将正在退出的旧 Pod 占用的 IP 预留给新 ReplicaSet(hash)的 Pod,
+// 旧 Pod 释放这些 IP 后, 其他版本的 Pod 无法使用, 避免 IP 池刚好等于 replicas 时新 Pod 一直分配不到 IP.
+// 之前为更早版本预留的 IP 也一并改为预留给 hash, 因为那个版本已经不会再有新 Pod 了.
+// caller: pkg/controller/handler_pod.go -> handleTermPod()
+func (h *Helper) ReserveForHandover(sip *ipkv1.StaticIP, pod *corev1.Pod, hash string) (err error) {
+	_, err = mutateStatus(h.crdClient, sip, func(latest *ipkv1.StaticIP) (changed bool, err error) {
+		if latest.Status.Handover == nil {
+			latest.Status.Handover = map[string]ipkv1.IPHandover{}
+		}
+		now := apimmetav1.Now()
+		for ip, handover := range latest.Status.Handover {
+			if handover.PodTemplateHash != hash {
+				latest.Status.Handover[ip] = ipkv1.IPHandover{PodTemplateHash: hash, Since: now}
+				changed = true
+			}
+		}
+		for ip, ownerPod := range latest.Status.IPMap {
+			if ownerPod == nil || ownerPod.UID != pod.UID {
+				continue
+			}
+			if handover, ok := latest.Status.Handover[ip]; ok && handover.PodTemplateHash == hash {
+				continue
+			}
+			klog.Infof("reserve ip %s of terminating pod %s for replicaset %s", ip, pod.Name, hash)
+			latest.Status.Handover[ip] = ipkv1.IPHandover{PodTemplateHash: hash, Since: now}
+			changed = true
+		}
+		return changed, nil
+	})
+	return
+}
+
+// handoverFree 按滚动更新的预留记录筛选 pod 可以使用的空闲 IP.
+// 为 pod 所属版本预留的 IP 优先, 为其他版本预留的 IP 不可用, 过期的预留记录不生效.
+func handoverFree(sip *ipkv1.StaticIP, pod *corev1.Pod, free map[string]bool) map[string]bool {
+	if len(sip.Status.Handover) == 0 {
+		return free
+	}
+	hash := pod.Labels[appsv1.DefaultDeploymentUniqueLabelKey]
+	now := time.Now()
+	reserved := map[string]bool{}
+	unreserved := map[string]bool{}
+	for ip := range free {
+		handover, ok := sip.Status.Handover[ip]
+		if !ok || handover.Since.Add(handoverTimeout).Before(now) {
+			unreserved[ip] = true
+		} else if handover.PodTemplateHash == hash {
+			reserved[ip] = true
+		}
+	}
+	if len(reserved) != 0 {
+		return reserved
+	}
+	return unreserved
+}
+
+// reservedForOthers 判断 ip 是否正在为 pod 所属版本以外的 ReplicaSet 预留, 过期的预留记录不生效.
+func reservedForOthers(sip *ipkv1.StaticIP, pod *corev1.Pod, ip string) bool {
+	if sip.Spec.OwnerKind != "Deployment" {
+		return false
+	}
+	handover, ok := sip.Status.Handover[ip]
+	if !ok || handover.Since.Add(handoverTimeout).Before(time.Now()) {
+		return false
+	}
+	return handover.PodTemplateHash != pod.Labels[appsv1.DefaultDeploymentUniqueLabelKey]
+}
+
+// SurgeCapacity 返回 Deployment 滚动更新时最多同时存在的 Pod 数量, 即 replicas + maxSurge.
+// maxSurge 为百分比时向上取整, 与 Deployment controller 的计算方式相同.
+func SurgeCapacity(deploy *appsv1.Deployment) (capacity int, err error) {
+	replicas := 1
+	if deploy.Spec.Replicas != nil {
+		replicas = int(*deploy.Spec.Replicas)
+	}
+	if deploy.Spec.Strategy.Type == appsv1.RecreateDeploymentStrategyType {
+		return replicas, nil
+	}
+	// 未指定时 apiserver 会将 maxSurge 默认设置为 25%.
+	maxSurge := intstr.FromString("25%")
+	if ru := deploy.Spec.Strategy.RollingUpdate; ru != nil && ru.MaxSurge != nil {
+		maxSurge = *ru.MaxSurge
+	}
+	surge, err := intstr.GetValueFromIntOrPercent(&maxSurge, replicas, true)
+	if err != nil {
+		return 0, err
+	}
+	return replicas + surge, nil
+}
@@ -0,0 +1,145 @@
+package staticip
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+)
+
+// maxExpandSize 单次展开的 IP 数量上限, 避免误写成 /8 这种大网段时耗尽内存.
+const maxExpandSize = 65536
+
+// normalizeIP IPv4 地址统一使用 4 字节形式, 便于比较与递增.
+func normalizeIP(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip
+}
+
+// nextIP 返回 ip 的下一个地址, 对 IPv4 与 IPv6 都适用.
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// broadcastIP 返回网段中主机位全为 1 的地址, 即 IPv4 网段的广播地址.
+func broadcastIP(subnet *net.IPNet) net.IP {
+	ip := normalizeIP(subnet.IP)
+	broadcast := make(net.IP, len(ip))
+	for i := range ip {
+		broadcast[i] = ip[i] | ^subnet.Mask[i]
+	}
+	return broadcast
+}
+
+// expandRange 按顺序返回 [start, end] 之间的所有 IP.
+func expandRange(start, end net.IP) (ips []net.IP, err error) {
+	start, end = normalizeIP(start), normalizeIP(end)
+	if len(start) != len(end) {
+		return nil, fmt.Errorf("ip range %s-%s mixes ipv4 and ipv6", start, end)
+	}
+	if bytes.Compare(start, end) > 0 {
+		return nil, fmt.Errorf("ip range %s-%s is reversed", start, end)
+	}
+	for ip := start; bytes.Compare(ip, end) <= 0; ip = nextIP(ip) {
+		if len(ips) >= maxExpandSize {
+			return nil, fmt.Errorf("ip range %s-%s is too large", start, end)
+		}
+		ips = append(ips, ip)
+	}
+	return
+}
+
+// expandSubnet 按顺序返回网段中所有可分配的 IP, 不可分配的地址见 isReservedIP().
+func expandSubnet(subnet *net.IPNet) (ips []net.IP, err error) {
+	if isLargeSubnet(subnet) {
+		return nil, fmt.Errorf("subnet %s is too large", subnet)
+	}
+	walkSubnet(subnet, func(ip net.IP) bool {
+		ips = append(ips, ip)
+		return true
+	})
+	return
+}
+
+// isReservedIP 判断 ip 是否为网段中不可分配的地址:
+// IPv4 网段的网络地址与广播地址(/31, /32 除外), 以及 IPv6 网段的 Subnet-Router 任播地址(主机位全为 0, /127, /128 除外).
+// IPv6 的这个地址写成 "ip/掩码" 后与网段本身无法区分, 如 fd00::/64, 所以同样不参与分配.
+func isReservedIP(ip net.IP, subnet *net.IPNet) bool {
+	ones, bits := subnet.Mask.Size()
+	if bits-ones < 2 {
+		return false
+	}
+	ip = normalizeIP(ip)
+	if ip.Equal(normalizeIP(subnet.IP.Mask(subnet.Mask))) {
+		return true
+	}
+	return bits == 8*net.IPv4len && ip.Equal(broadcastIP(subnet))
+}
+
+// isLargeSubnet 网段中的 IP 数量超过 maxExpandSize, 无法一次全部展开.
+func isLargeSubnet(subnet *net.IPNet) bool {
+	ones, bits := subnet.Mask.Size()
+	return bits-ones > 16
+}
+
+// walkSubnet 按顺序遍历网段中可分配的 IP, 规则同 expandSubnet(), fn 返回 false 时停止遍历.
+// 不会一次展开整个网段, 可用于 IPv6 的 /64 这种无法展开的网段, 从中取出需要的若干个 IP.
+func walkSubnet(subnet *net.IPNet, fn func(ip net.IP) bool) {
+	start := normalizeIP(subnet.IP.Mask(subnet.Mask))
+	end := broadcastIP(subnet)
+	for ip := start; bytes.Compare(ip, end) <= 0; ip = nextIP(ip) {
+		if !isReservedIP(ip, subnet) && !fn(ip) {
+			return
+		}
+		// 已经是全 1 的地址, 再递增会回绕到全 0.
+		if ip.Equal(end) {
+			return
+		}
+	}
+}
+
+// hostCount 返回网段中可分配的 IP 数量, 规则同 expandSubnet(), 超过 math.MaxInt32 时返回 math.MaxInt32.
+func hostCount(subnet *net.IPNet) int {
+	ones, bits := subnet.Mask.Size()
+	if bits-ones >= 31 {
+		return math.MaxInt32
+	}
+	count := 1 << uint(bits-ones)
+	if bits-ones >= 2 {
+		count--
+		if bits == 8*net.IPv4len {
+			count--
+		}
+	}
+	return count
+}
+
+// parseIPOrRange 解析单个 IP(192.168.1.1) 或 IP 范围(192.168.1.1-192.168.1.10).
+func parseIPOrRange(str string) (ips []net.IP, err error) {
+	str = strings.TrimSpace(str)
+	if strings.Contains(str, "-") {
+		parts := strings.SplitN(str, "-", 2)
+		start := net.ParseIP(strings.TrimSpace(parts[0]))
+		end := net.ParseIP(strings.TrimSpace(parts[1]))
+		if start == nil || end == nil {
+			return nil, fmt.Errorf("invalid ip range: %s", str)
+		}
+		return expandRange(start, end)
+	}
+	ip := net.ParseIP(str)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip: %s", str)
+	}
+	return []net.IP{normalizeIP(ip)}, nil
+}
@@ -4,14 +4,21 @@ import (
 	"fmt"
 	"strings"
 
-	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apimerrors "k8s.io/apimachinery/pkg/api/errors"
 	apimmetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
 	cgkuber "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/klog"
 
 	ipkv1 "github.com/generals-space/crd-ipkeeper/pkg/apis/ipkeeper/v1"
 	crdClientset "github.com/generals-space/crd-ipkeeper/pkg/client/clientset/versioned"
+	crdLister "github.com/generals-space/crd-ipkeeper/pkg/client/listers/ipkeeper/v1"
 	"github.com/generals-space/crd-ipkeeper/pkg/util"
 )
 
@@ -19,82 +26,177 @@ import (
 type Helper struct {
 	kubeClient cgkuber.Interface
 	crdClient  crdClientset.Interface
+	// dynamicClient 与 restMapper 用于获取任意类型的 owner 资源, 见 h.resolveOwner()
+	dynamicClient dynamic.Interface
+	restMapper    *restmapper.DeferredDiscoveryRESTMapper
+	// ownerInformers 缓存 owner 资源, 为 nil 时直接请求 apiserver, 见 h.StartOwnerInformers()
+	ownerInformers dynamicinformer.DynamicSharedInformerFactory
+	ownerStopCh    <-chan struct{}
+	// ownerKinds 允许拥有 StaticIP 的资源类型
+	ownerKinds map[string]bool
+	// sipLister 为 nil 时 h.CheckOverlap() 直接请求 apiserver, 见 h.UseStaticIPLister()
+	sipLister crdLister.StaticIPLister
 }
 
 // New ...
+// @param ownerKinds: 允许拥有 StaticIP 的资源类型, 为空时使用 DefaultOwnerKinds.
 func New(
 	kubeClient cgkuber.Interface,
 	crdClient crdClientset.Interface,
+	dynamicClient dynamic.Interface,
+	ownerKinds []string,
 ) (helper *Helper) {
+	if len(ownerKinds) == 0 {
+		ownerKinds = DefaultOwnerKinds
+	}
+	kinds := map[string]bool{}
+	for _, kind := range ownerKinds {
+		kinds[kind] = true
+	}
 	return &Helper{
-		kubeClient: kubeClient,
-		crdClient:  crdClient,
+		kubeClient:    kubeClient,
+		crdClient:     crdClient,
+		dynamicClient: dynamicClient,
+		restMapper: restmapper.NewDeferredDiscoveryRESTMapper(
+			memory.NewMemCacheClient(kubeClient.Discovery()),
+		),
+		ownerKinds: kinds,
 	}
 }
 
-// generateSIPName ...
-// @param ownerKind: Pod, Deployment, Daemonset
+// generateSIPName 生成 owner 对应的 StaticIP 名称, 如 deploy-devops, sts-web, cloneset-web.
+// @param ownerKind: Pod, Deployment, StatefulSet, DaemonSet 等
 func (h *Helper) generateSIPName(ownerKind, ownerName string) (name string) {
-	var ownerShortKind string
-	if ownerKind == "Deployment" {
-		ownerShortKind = "deploy"
-	} else if ownerKind == "Pod" {
-		ownerShortKind = "pod"
-	}
-	return fmt.Sprintf("%s-%s", ownerShortKind, ownerName)
+	return fmt.Sprintf("%s-%s", shortKind(ownerKind), ownerName)
 }
 
 // NewStaticIP 根据传入的 owner 资源创建 StaticIP 对象.
 // owner Deployment, Pod 等对象.
 // ownerKind 目前没能找到通过 owner 获取 ownerKind 的方法, 暂时显式传入此参数.
-func (h *Helper) NewStaticIP(owner apimmetav1.Object, ownerKind string) (sip *ipkv1.StaticIP) {
+// 如果 owner 通过 pool_name 注解引用了 IPPool, 则 IP 列表与网关从该 IPPool 中划分.
+func (h *Helper) NewStaticIP(
+	owner apimmetav1.Object,
+	ownerKind string,
+) (sip *ipkv1.StaticIP, err error) {
 	ownerName := owner.GetName()
 	ownerNS := owner.GetNamespace()
 	ownerAnno := owner.GetAnnotations()
 
 	////////////////////////////
 	sipName := h.generateSIPName(ownerKind, ownerName)
+	gvk, err := ownerGVK(owner, ownerKind)
+	if err != nil {
+		return nil, err
+	}
 	sip = &ipkv1.StaticIP{
 		ObjectMeta: apimmetav1.ObjectMeta{
 			Name:      sipName,
 			Namespace: ownerNS,
+			// 占用 IP 的 Pod 全部退出后才能删除, 见 finalizer.go.
+			Finalizers: []string{util.StaticIPFinalizer},
 			OwnerReferences: []apimmetav1.OwnerReference{
 				// NewControllerRef() 第1个参数为所属对象 owner,
 				// 第2个参数为 owner 的 gvk 信息对象.
-				*apimmetav1.NewControllerRef(
-					owner,
-					// deploy.GroupVersionKind() 的打印结果为 "/, Kind=" (不是字符串类型)
-					// 而 xxx.WithKind("Deployment") 的打印结果为 "apps/v1, Kind=Deployment"
-					appsv1.SchemeGroupVersion.WithKind(ownerKind),
-				),
+				// 从 informer 得到的 deploy.GroupVersionKind() 的打印结果为 "/, Kind=",
+				// 所以内置类型的 gvk 需要从 knownOwnerGVKs 中查找, 见 ownerGVK().
+				*apimmetav1.NewControllerRef(owner, gvk),
 			},
 		},
 		Spec: ipkv1.StaticIPSpec{
-			Namespace: ownerNS,
-			OwnerKind: ownerKind,
-			Gateway:   ownerAnno[util.GatewayAnnotation],
+			Namespace:       ownerNS,
+			OwnerKind:       ownerKind,
+			Strategy:        ownerAnno[util.StrategyAnnotation],
+			ReleaseCooldown: ownerAnno[util.ReleaseCooldownAnnotation],
 		},
 	}
+	if _, err = GetStrategy(sip.Spec.Strategy); err != nil {
+		return nil, err
+	}
+	if _, err = ParseReleaseCooldown(sip.Spec.ReleaseCooldown); err != nil {
+		return nil, err
+	}
+	if poolName := ownerAnno[util.PoolNameAnnotation]; poolName != "" {
+		size, err := h.getPoolSize(owner, ownerKind)
+		if err != nil {
+			return nil, err
+		}
+		// 已经存在的 StaticIP 重新划分时, 优先保留正在使用的 IP.
+		existing, err := h.crdClient.IpkeeperV1().StaticIPs(ownerNS).Get(sipName, metav1.GetOptions{})
+		if apimerrors.IsNotFound(err) {
+			existing, err = nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get sip %s: %s", sipName, err)
+		}
+		ips, gateway, gateway6, err := h.carvePoolBlock(poolName, ownerNS+"/"+sipName, size, inUseIPs(existing))
+		if err != nil {
+			return nil, err
+		}
+		sip.Spec.PoolRef = poolName
+		sip.Spec.IPPool = strings.Join(ips, ",")
+		sip.Spec.Gateway = gateway
+		sip.Spec.Gateway6 = gateway6
+	} else {
+		if ownerKind == "Pod" {
+			sip.Spec.IPPool = ownerAnno[util.IPAddressAnnotation]
+		} else {
+			sip.Spec.IPPool = ownerAnno[util.IPPoolAnnotation]
+		}
+		// 双栈时 gateway 注解中以逗号分隔 IPv4 与 IPv6 网关.
+		sip.Spec.Gateway, sip.Spec.Gateway6, err = ParseGateways(ownerAnno[util.GatewayAnnotation])
+		if err != nil {
+			return nil, err
+		}
+		// IPv6 网段(如 fd00::/64)无法全部展开, 按需要的数量从中取出 IP 写入 spec.
+		if HasLargeSubnet(sip.Spec.IPPool) {
+			sip.Spec.IPPool, err = h.expandLargeSubnets(owner, ownerKind, sip.Spec.IPPool, sip.Spec.Gateway6)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	sip.Status.Avaliable, sip.Status.IPMap, err = h.InitIPMap(sip.Spec.IPPool)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range sip.Status.Avaliable {
+		if isIPv6(ip) && sip.Spec.Gateway6 == "" {
+			return nil, fmt.Errorf("ip pool of %s has ipv6 address %s but no ipv6 gateway", ownerName, ip)
+		}
+	}
 	if ownerKind == "Deployment" {
-		sip.Spec.IPPool = ownerAnno[util.IPPoolAnnotation]
-	} else if ownerKind == "Pod" {
-		sip.Spec.IPPool = ownerAnno[util.IPAddressAnnotation]
+		sip.Spec.ShrinkPolicy = ownerAnno[util.ShrinkPolicyAnnotation]
+		if err = ValidateShrinkPolicy(sip.Spec.ShrinkPolicy); err != nil {
+			return nil, err
+		}
 	}
-	sip.Spec.Avaliable, sip.Spec.IPMap = h.InitIPMap(sip.Spec.IPPool)
-	sip.Spec.Used = []string{}
-	sip.Spec.Ratio = fmt.Sprintf("%d/%d", len(sip.Spec.Used), len(sip.Spec.IPMap))
+	if ownerKind == "DaemonSet" {
+		sip.Spec.NodeIPs = ownerAnno[util.NodeIPsAnnotation]
+		_, err = ResolveNodeIPs(sip.Spec.NodeIPs, sip.Status.Avaliable)
+		if err != nil {
+			return nil, err
+		}
+	}
+	sip.Status.Used = []string{}
+	refreshStatus(sip)
+	SetCondition(&sip.Status, ipkv1.StaticIPReady, corev1.ConditionTrue, "PoolInitialized", "")
 
-	return sip
+	return sip, nil
 }
 
 // InitIPMap 创建 IP 与 Pod 的映射表.
-// 参数 IPsStr 为以逗号分隔的点分十进制IP字符串, 如 "192.168.0.1/24,192.168.0.2/24"
-func (h *Helper) InitIPMap(IPsStr string) (ipList []string, ipMap map[string]*ipkv1.OwnerPod) {
+// 参数 IPsStr 为以逗号分隔的点分十进制IP字符串, 如 "192.168.0.1/24,192.168.0.2/24",
+// 也可以使用网段, 范围与排除项, 具体格式见 ParseIPPool().
+func (h *Helper) InitIPMap(
+	IPsStr string,
+) (ipList []string, ipMap map[string]*ipkv1.OwnerPod, err error) {
+	ipList, err = ParseIPPool(IPsStr)
+	if err != nil {
+		return nil, nil, err
+	}
 	ipMap = map[string]*ipkv1.OwnerPod{}
-	ipList = []string{}
-	for _, v := range strings.Split(IPsStr, ",") {
+	for _, v := range ipList {
 		ipMap[v] = nil
-		ipList = append(ipList, v)
 	}
 	return
 }
@@ -114,7 +216,8 @@ func (h *Helper) GetStaticIP(
 }
 
 // CreateStaticIP 调用 crdClient 为目标资源(Pod/Deployment等)创建对应的 StaticIP 资源对象.
-// @param ownerKind: 可选值 Pod, Deployment
+// StaticIP 已经存在时不会报错, 只会在其 status 尚未初始化时完成初始化, 因此可以重复调用.
+// @param ownerKind: Pod, Deployment, StatefulSet, DaemonSet, 以及 --owner-kinds 中的其他类型
 // caller:
 // 1. pkg/controller/handler_pod.go -> handleAddPod()
 // 2. pkg/controller/handler_deploy.go -> handleAddDeploy()
@@ -122,20 +225,72 @@ func (h *Helper) CreateStaticIP(
 	owner apimmetav1.Object,
 	ownerKind string,
 ) (err error) {
-	sip := h.NewStaticIP(owner, ownerKind)
-	getOpt := &apimmetav1.GetOptions{}
-	_, err = h.crdClient.IpkeeperV1().StaticIPs(sip.Namespace).Get(sip.Name, *getOpt)
+	if !h.OwnerKindAllowed(ownerKind) {
+		return fmt.Errorf("doesn't support resource type: %s", ownerKind)
+	}
+	existing, err := h.GetStaticIP(owner, ownerKind)
 	if err == nil {
-		return fmt.Errorf("sip %s already exist, return", sip.Name)
+		// 上一次 Create() 成功, 但 UpdateStatus() 失败时, status 仍是空的.
+		return h.initStatus(existing)
+	}
+	if !apimerrors.IsNotFound(err) {
+		return fmt.Errorf("failed to get sip for %s: %s", owner.GetName(), err)
+	}
+	sip, err := h.NewStaticIP(owner, ownerKind)
+	if err != nil {
+		h.releaseCarvedBlock(owner, ownerKind)
+		return fmt.Errorf("failed to build sip for %s: %s", owner.GetName(), err)
 	}
 	// klog.Infof("try to create new sip: %s", sip.Name)
 
-	_, err = h.crdClient.IpkeeperV1().StaticIPs(sip.Namespace).Create(sip)
+	actualSIP, err := h.crdClient.IpkeeperV1().StaticIPs(sip.Namespace).Create(sip)
+	if apimerrors.IsAlreadyExists(err) {
+		// 同时有其他 worker 创建了同一个 StaticIP, 划分到的 IP 属于该 StaticIP, 不能归还.
+		return h.initStatus(sip)
+	}
 	if err != nil {
-		// if err.Error() == "already exists" {}
 		utilruntime.HandleError(err)
+		h.releaseCarvedBlock(owner, ownerKind)
 		return fmt.Errorf("failed to create new sip for %s: %s", owner.GetName(), err)
 	}
 	// klog.Infof("success to create new sip object: %+v", actualSIP)
+	return h.initStatus(actualSIP)
+}
+
+// releaseCarvedBlock 引用了 IPPool 的 owner 在 h.NewStaticIP() 中已经从 IPPool 划分了 IP,
+// StaticIP 没能创建时需要归还, 否则这些 IP 会一直记录在 IPPool 的 allocations 中.
+// caller: h.CreateStaticIP()
+func (h *Helper) releaseCarvedBlock(owner apimmetav1.Object, ownerKind string) {
+	if owner.GetAnnotations()[util.PoolNameAnnotation] == "" {
+		return
+	}
+	sipKey := owner.GetNamespace() + "/" + h.generateSIPName(ownerKind, owner.GetName())
+	if err := h.ReleasePoolBlock(sipKey); err != nil {
+		klog.Warningf("failed to release ippool block of %s: %s", sipKey, err)
+	}
+}
+
+// initStatus 根据 spec 中的 IP 池初始化 sip 的 status, 已经初始化过(IPMap 不为空)时什么也不做.
+// status 是子资源, Create() 时会被 apiserver 忽略, 需要再调用 UpdateStatus() 完成初始化.
+// caller: h.CreateStaticIP()
+func (h *Helper) initStatus(sip *ipkv1.StaticIP) (err error) {
+	_, err = mutateStatus(h.crdClient, sip, func(latest *ipkv1.StaticIP) (bool, error) {
+		if latest.Status.IPMap != nil || latest.Status.ObservedGeneration != 0 {
+			return false, nil
+		}
+		avaliable, ipMap, err := h.InitIPMap(latest.Spec.IPPool)
+		if err != nil {
+			return false, err
+		}
+		latest.Status.Avaliable, latest.Status.IPMap = avaliable, ipMap
+		latest.Status.Used = []string{}
+		latest.Status.ObservedGeneration = latest.Generation
+		SetCondition(&latest.Status, ipkv1.StaticIPReady, corev1.ConditionTrue, "PoolInitialized", "")
+		checkConflict(h.crdClient, latest)
+		return true, nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to init status for sip %s: %s", sip.Name, err)
+	}
 	return
 }
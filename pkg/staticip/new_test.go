@@ -0,0 +1,103 @@
+package staticip
+
+import (
+	"fmt"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apimmetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	cgtesting "k8s.io/client-go/testing"
+
+	ipkv1 "github.com/generals-space/crd-ipkeeper/pkg/apis/ipkeeper/v1"
+	crdfake "github.com/generals-space/crd-ipkeeper/pkg/client/clientset/versioned/fake"
+	"github.com/generals-space/crd-ipkeeper/pkg/util"
+)
+
+func newTestDeploy() *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: apimmetav1.ObjectMeta{
+			Name:      "test",
+			Namespace: "default",
+			Annotations: map[string]string{
+				util.IPPoolAnnotation:  "172.16.0.1-172.16.0.3/24",
+				util.GatewayAnnotation: "172.16.0.254",
+			},
+		},
+	}
+}
+
+// TestCreateStaticIPInitStatus 上一次创建 StaticIP 后没能初始化 status 时, 再次调用会补上, 而不是报错.
+func TestCreateStaticIPInitStatus(t *testing.T) {
+	deploy := newTestDeploy()
+	// Create() 成功而 UpdateStatus() 失败时, StaticIP 只有 spec.
+	sip := &ipkv1.StaticIP{
+		ObjectMeta: apimmetav1.ObjectMeta{Name: "deploy-test", Namespace: "default"},
+		Spec: ipkv1.StaticIPSpec{
+			Namespace: "default",
+			OwnerKind: "Deployment",
+			IPPool:    "172.16.0.1-172.16.0.3/24",
+			Gateway:   "172.16.0.254",
+		},
+	}
+	client := crdfake.NewSimpleClientset(sip)
+	h := &Helper{crdClient: client, ownerKinds: map[string]bool{"Deployment": true}}
+
+	for i := 0; i < 2; i++ {
+		if err := h.CreateStaticIP(deploy, "Deployment"); err != nil {
+			t.Fatalf("create staticip again failed: %s", err)
+		}
+		latest, err := client.IpkeeperV1().StaticIPs("default").Get("deploy-test", apimmetav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("failed to get sip: %s", err)
+		}
+		if len(latest.Status.IPMap) != 3 || len(latest.Status.Avaliable) != 3 || latest.Status.Ratio != "0/3" {
+			t.Fatalf("status is not initialized: %+v", latest.Status)
+		}
+	}
+}
+
+// TestCreateStaticIP 正常创建时 status 同样完成初始化.
+func TestCreateStaticIP(t *testing.T) {
+	client := crdfake.NewSimpleClientset()
+	h := &Helper{crdClient: client, ownerKinds: map[string]bool{"Deployment": true}}
+	if err := h.CreateStaticIP(newTestDeploy(), "Deployment"); err != nil {
+		t.Fatalf("failed to create staticip: %s", err)
+	}
+	latest, err := client.IpkeeperV1().StaticIPs("default").Get("deploy-test", apimmetav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get sip: %s", err)
+	}
+	if len(latest.Status.IPMap) != 3 || len(latest.Status.Used) != 0 {
+		t.Fatalf("status is not initialized: %+v", latest.Status)
+	}
+}
+
+// TestCreateStaticIPReleaseBlock StaticIP 创建失败时, 已经从 IPPool 划分的 IP 需要归还.
+func TestCreateStaticIPReleaseBlock(t *testing.T) {
+	pool := &ipkv1.IPPool{
+		ObjectMeta: apimmetav1.ObjectMeta{Name: "pool"},
+		Spec:       ipkv1.IPPoolSpec{Subnet: "172.16.0.0/24", Gateway: "172.16.0.1"},
+	}
+	client := crdfake.NewSimpleClientset(pool)
+	client.PrependReactor("create", "staticips", func(action cgtesting.Action) (bool, runtime.Object, error) {
+		return true, nil, fmt.Errorf("apiserver is unavailable")
+	})
+	h := &Helper{crdClient: client, ownerKinds: map[string]bool{"Deployment": true}}
+	deploy := newTestDeploy()
+	deploy.Annotations = map[string]string{
+		util.PoolNameAnnotation: "pool",
+		util.PoolSizeAnnotation: "2",
+	}
+
+	if err := h.CreateStaticIP(deploy, "Deployment"); err == nil {
+		t.Fatalf("expected create to fail")
+	}
+	latest, err := client.IpkeeperV1().IPPools().Get("pool", apimmetav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get ippool: %s", err)
+	}
+	if len(latest.Status.Allocations) != 0 {
+		t.Errorf("block is leaked: %v", latest.Status.Allocations)
+	}
+}
@@ -0,0 +1,198 @@
+package staticip
+
+import (
+	"fmt"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apimerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	apimmetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/klog"
+
+	"github.com/generals-space/crd-ipkeeper/pkg/util"
+)
+
+// maxOwnerDepth 沿 ownerReferences 向上查找的最大层数, 避免异常的引用关系导致死循环.
+const maxOwnerDepth = 5
+
+// DefaultOwnerKinds 默认允许拥有 StaticIP 的资源类型.
+var DefaultOwnerKinds = []string{"Pod", "Deployment", "StatefulSet", "DaemonSet", "Job", "CronJob"}
+
+// watchedKinds 由 controller 直接监听的资源类型, 其 StaticIP 在资源创建时即同步创建.
+// 其他类型(如 Job, CronJob, CloneSet)的 StaticIP 在其第一个 Pod 创建时才会创建.
+var watchedKinds = map[string]bool{
+	"Deployment":  true,
+	"StatefulSet": true,
+	"DaemonSet":   true,
+}
+
+// knownOwnerGVKs 内置资源类型的 gvk 信息.
+// 从 informer 中得到的对象 TypeMeta 为空, 无法从对象本身获取 gvk, 需要从这里查找.
+var knownOwnerGVKs = map[string]schema.GroupVersionKind{
+	"Pod":         corev1.SchemeGroupVersion.WithKind("Pod"),
+	"Deployment":  appsv1.SchemeGroupVersion.WithKind("Deployment"),
+	"StatefulSet": appsv1.SchemeGroupVersion.WithKind("StatefulSet"),
+	"DaemonSet":   appsv1.SchemeGroupVersion.WithKind("DaemonSet"),
+	"ReplicaSet":  appsv1.SchemeGroupVersion.WithKind("ReplicaSet"),
+	"Job":         batchv1.SchemeGroupVersion.WithKind("Job"),
+	"CronJob":     batchv1beta1.SchemeGroupVersion.WithKind("CronJob"),
+}
+
+// OwnerKindAllowed 判断 ownerKind 类型的资源是否允许拥有 StaticIP, 见 --owner-kinds 参数.
+func (h *Helper) OwnerKindAllowed(ownerKind string) bool {
+	return h.ownerKinds[ownerKind]
+}
+
+// ownerGVK 返回 owner 的 gvk 信息, 用于构建 StaticIP 的 ownerReference.
+// 通过 dynamic client 得到的对象自带 gvk, 内置类型的对象则从 knownOwnerGVKs 中查找.
+func ownerGVK(owner apimmetav1.Object, ownerKind string) (gvk schema.GroupVersionKind, err error) {
+	if obj, ok := owner.(runtime.Object); ok {
+		gvk = obj.GetObjectKind().GroupVersionKind()
+		if !gvk.Empty() && gvk.Kind != "" {
+			return gvk, nil
+		}
+	}
+	gvk, ok := knownOwnerGVKs[ownerKind]
+	if !ok {
+		return gvk, fmt.Errorf("unknown group version of kind %s", ownerKind)
+	}
+	return gvk, nil
+}
+
+// controllerRef 返回 obj 的 controller 引用, 没有时返回第一个 ownerReference.
+func controllerRef(obj apimmetav1.Object) *apimmetav1.OwnerReference {
+	if ref := apimmetav1.GetControllerOf(obj); ref != nil {
+		return ref
+	}
+	refs := obj.GetOwnerReferences()
+	if len(refs) == 0 {
+		return nil
+	}
+	return &refs[0]
+}
+
+// resolveOwner 沿 ownerReferences 向上查找 pod 的 controller, 如 Pod -> ReplicaSet -> Deployment, Pod -> CloneSet 等,
+// 返回其中 --owner-kinds 允许的最上层资源. 如只允许 Job 而不允许 CronJob 时, 返回 CronJob 创建的 Job.
+// 上层资源都通过 dynamic client 获取, 因此任意类型的 controller 都可以支持.
+// 上层资源已被删除, 或是没有权限获取(如未授权的 Argo Workflow 等 CRD)时停止向上查找,
+// 其他错误只有在已经找到声明了 IP 池的 owner 时才返回, 否则同样停止查找.
+// 链路上没有允许的资源类型时 owner 为 nil.
+func (h *Helper) resolveOwner(
+	pod *corev1.Pod,
+) (owner apimmetav1.Object, ownerKind string, err error) {
+	var current apimmetav1.Object = pod
+	for i := 0; i < maxOwnerDepth; i++ {
+		ref := controllerRef(current)
+		if ref == nil {
+			return owner, ownerKind, nil
+		}
+		current, err = h.getOwnerObject(pod.Namespace, ref)
+		if err != nil {
+			unreachable := ownerUnreachable(err)
+			err = fmt.Errorf("failed to get %s %s of pod %s: %s", ref.Kind, ref.Name, pod.Name, err)
+			if !unreachable && owner != nil && util.HasIPPoolAnnotations(owner.GetAnnotations()) {
+				return nil, "", err
+			}
+			klog.Warningf("stop resolving owner: %s", err)
+			return owner, ownerKind, nil
+		}
+		if h.OwnerKindAllowed(ref.Kind) {
+			owner, ownerKind = current, ref.Kind
+		}
+	}
+	klog.Warningf("owner chain of pod %s is too deep, stop at depth %d", pod.Name, maxOwnerDepth)
+	return owner, ownerKind, nil
+}
+
+// ownerUnreachable 判断获取上层资源失败的原因是否为资源已被删除, 没有权限或资源类型不存在.
+func ownerUnreachable(err error) bool {
+	return apimerrors.IsNotFound(err) || apimerrors.IsForbidden(err) || meta.IsNoMatchError(err)
+}
+
+// StartOwnerInformers 启用上层资源的缓存, 之后 h.getOwnerObject() 优先从 informer 中获取资源.
+// 各资源类型的 informer 在第一次查找到该类型时才会创建, 并在 stopCh 关闭时退出.
+// 需要在开始处理 Pod 之前调用, 重复调用时不做任何操作.
+// 每个 informer 都会 watch 全集群的同类资源, 因此只在 controller 中启用, 运行在每个节点上的 cni server 不启用.
+// caller: pkg/controller/controller.go -> run()
+func (h *Helper) StartOwnerInformers(stopCh <-chan struct{}) {
+	if h.ownerInformers != nil {
+		return
+	}
+	h.ownerInformers = dynamicinformer.NewDynamicSharedInformerFactory(h.dynamicClient, 0)
+	h.ownerStopCh = stopCh
+}
+
+// getOwnerObject 获取 ref 所指向的资源对象.
+// 启用了缓存时优先从 informer 中获取, informer 尚未同步完成, 或是还没有收到新创建的资源时,
+// 再通过 dynamic client 直接请求 apiserver.
+// 从缓存中得到的对象为共享的只读对象, 不能修改.
+func (h *Helper) getOwnerObject(
+	namespace string,
+	ref *apimmetav1.OwnerReference,
+) (obj *unstructured.Unstructured, err error) {
+	gv, err := schema.ParseGroupVersion(ref.APIVersion)
+	if err != nil {
+		return nil, err
+	}
+	mapping, err := h.restMapper.RESTMapping(gv.WithKind(ref.Kind).GroupKind(), gv.Version)
+	if err != nil {
+		// 可能是新安装的 CRD, 清空 discovery 缓存后再试一次.
+		h.restMapper.Reset()
+		mapping, err = h.restMapper.RESTMapping(gv.WithKind(ref.Kind).GroupKind(), gv.Version)
+		if err != nil {
+			return nil, err
+		}
+	}
+	namespaced := mapping.Scope.Name() == meta.RESTScopeNameNamespace
+	if h.ownerInformers != nil {
+		informer := h.ownerInformers.ForResource(mapping.Resource)
+		// 只会启动新创建的 informer.
+		h.ownerInformers.Start(h.ownerStopCh)
+		if informer.Informer().HasSynced() {
+			var cached runtime.Object
+			if namespaced {
+				cached, err = informer.Lister().ByNamespace(namespace).Get(ref.Name)
+			} else {
+				cached, err = informer.Lister().Get(ref.Name)
+			}
+			if err == nil {
+				return cached.(*unstructured.Unstructured), nil
+			}
+			if !apimerrors.IsNotFound(err) {
+				return nil, err
+			}
+		}
+	}
+	var client dynamic.ResourceInterface = h.dynamicClient.Resource(mapping.Resource)
+	if namespaced {
+		client = h.dynamicClient.Resource(mapping.Resource).Namespace(namespace)
+	}
+	return client.Get(ref.Name, apimmetav1.GetOptions{})
+}
+
+// ownerShortKinds 内置资源类型在 StaticIP 名称中使用的简称, 其他类型使用小写的 kind.
+var ownerShortKinds = map[string]string{
+	"Pod":         "pod",
+	"Deployment":  "deploy",
+	"StatefulSet": "sts",
+	"DaemonSet":   "ds",
+	"Job":         "job",
+	"CronJob":     "cronjob",
+}
+
+// shortKind 返回 ownerKind 在 StaticIP 名称中使用的简称.
+func shortKind(ownerKind string) string {
+	if short, ok := ownerShortKinds[ownerKind]; ok {
+		return short
+	}
+	return strings.ToLower(ownerKind)
+}
@@ -0,0 +1,180 @@
+package staticip
+
+import (
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apimerrors "k8s.io/apimachinery/pkg/api/errors"
+	apimmetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	apimtypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/discovery/cached/memory"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	cgscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/restmapper"
+	cgtesting "k8s.io/client-go/testing"
+
+	"github.com/generals-space/crd-ipkeeper/pkg/util"
+)
+
+// newOwnerTestHelper 创建使用 fake dynamic client 的 Helper, discovery 中包含 apps, batch 与一个未授权的 CRD.
+func newOwnerTestHelper(ownerKinds []string, objs ...runtime.Object) (*Helper, *dynamicfake.FakeDynamicClient) {
+	kubeClient := kubefake.NewSimpleClientset()
+	kubeClient.Resources = []*apimmetav1.APIResourceList{
+		{
+			GroupVersion: "apps/v1",
+			APIResources: []apimmetav1.APIResource{
+				{Name: "replicasets", Kind: "ReplicaSet", Namespaced: true},
+				{Name: "deployments", Kind: "Deployment", Namespaced: true},
+			},
+		},
+		{
+			GroupVersion: "batch/v1",
+			APIResources: []apimmetav1.APIResource{{Name: "jobs", Kind: "Job", Namespaced: true}},
+		},
+		{
+			GroupVersion: "batch/v1beta1",
+			APIResources: []apimmetav1.APIResource{{Name: "cronjobs", Kind: "CronJob", Namespaced: true}},
+		},
+		{
+			GroupVersion: "argoproj.io/v1alpha1",
+			APIResources: []apimmetav1.APIResource{{Name: "workflows", Kind: "Workflow", Namespaced: true}},
+		},
+	}
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(cgscheme.Scheme, objs...)
+	dynamicClient.PrependReactor("get", "workflows", func(action cgtesting.Action) (bool, runtime.Object, error) {
+		gr := schema.GroupResource{Group: "argoproj.io", Resource: "workflows"}
+		return true, nil, apimerrors.NewForbidden(gr, "wf", nil)
+	})
+	kinds := map[string]bool{}
+	for _, kind := range ownerKinds {
+		kinds[kind] = true
+	}
+	h := &Helper{
+		kubeClient:    kubeClient,
+		dynamicClient: dynamicClient,
+		restMapper: restmapper.NewDeferredDiscoveryRESTMapper(
+			memory.NewMemCacheClient(kubeClient.Discovery()),
+		),
+		ownerKinds: kinds,
+	}
+	return h, dynamicClient
+}
+
+func ownerRef(apiVersion, kind, name string) []apimmetav1.OwnerReference {
+	controller := true
+	return []apimmetav1.OwnerReference{
+		{APIVersion: apiVersion, Kind: kind, Name: name, UID: apimtypes.UID("uid-" + name), Controller: &controller},
+	}
+}
+
+func newOwnedPod(refs []apimmetav1.OwnerReference) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: apimmetav1.ObjectMeta{Name: "test-0", Namespace: "default", OwnerReferences: refs},
+	}
+}
+
+func TestGetPodOwner(t *testing.T) {
+	annotations := map[string]string{
+		util.IPPoolAnnotation:  "172.16.0.1-172.16.0.3/24",
+		util.GatewayAnnotation: "172.16.0.254",
+	}
+	deploy := &appsv1.Deployment{
+		ObjectMeta: apimmetav1.ObjectMeta{Name: "web", Namespace: "default", Annotations: annotations},
+	}
+	rs := &appsv1.ReplicaSet{
+		ObjectMeta: apimmetav1.ObjectMeta{
+			Name: "web-1", Namespace: "default", OwnerReferences: ownerRef("apps/v1", "Deployment", "web"),
+		},
+	}
+	orphanRS := &appsv1.ReplicaSet{ObjectMeta: apimmetav1.ObjectMeta{Name: "orphan", Namespace: "default"}}
+	cronJob := &batchv1beta1.CronJob{
+		ObjectMeta: apimmetav1.ObjectMeta{Name: "cron", Namespace: "default"},
+	}
+	job := &batchv1.Job{
+		ObjectMeta: apimmetav1.ObjectMeta{
+			Name: "cron-1", Namespace: "default", Annotations: annotations,
+			OwnerReferences: ownerRef("batch/v1beta1", "CronJob", "cron"),
+		},
+	}
+	wfJob := &batchv1.Job{
+		ObjectMeta: apimmetav1.ObjectMeta{
+			Name: "wf-1", Namespace: "default",
+			OwnerReferences: ownerRef("argoproj.io/v1alpha1", "Workflow", "wf"),
+		},
+	}
+
+	tests := []struct {
+		name       string
+		ownerKinds []string
+		refs       []apimmetav1.OwnerReference
+		// expected 为空时期望得到 NoIPPoolError.
+		expected string
+	}{
+		{"deployment through replicaset", DefaultOwnerKinds, ownerRef("apps/v1", "ReplicaSet", "web-1"), "Deployment/web"},
+		{"orphaned replicaset is ignored", DefaultOwnerKinds, ownerRef("apps/v1", "ReplicaSet", "orphan"), ""},
+		{"orphaned replicaset is allowed", []string{"ReplicaSet"}, ownerRef("apps/v1", "ReplicaSet", "orphan"), "ReplicaSet/orphan"},
+		{"highest allowed kind", []string{"Job"}, ownerRef("batch/v1", "Job", "cron-1"), "Job/cron-1"},
+		{"disallowed kind", []string{"Deployment"}, ownerRef("batch/v1", "Job", "cron-1"), ""},
+		{"forbidden owner", DefaultOwnerKinds, ownerRef("argoproj.io/v1alpha1", "Workflow", "wf"), ""},
+		{"forbidden owner above an allowed one", DefaultOwnerKinds, ownerRef("batch/v1", "Job", "wf-1"), "Job/wf-1"},
+		{"missing owner", DefaultOwnerKinds, ownerRef("apps/v1", "ReplicaSet", "gone"), ""},
+		{"unknown kind", DefaultOwnerKinds, ownerRef("example.com/v1", "Unknown", "x"), ""},
+	}
+	for _, test := range tests {
+		h, _ := newOwnerTestHelper(test.ownerKinds, deploy, rs, orphanRS, cronJob, job, wfJob)
+		owner, ownerKind, err := h.GetPodOwner(newOwnedPod(test.refs))
+		if test.expected == "" {
+			if _, ok := err.(*NoIPPoolError); !ok {
+				t.Errorf("%s: expected NoIPPoolError, got %v, %v", test.name, owner, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+			continue
+		}
+		if got := ownerKind + "/" + owner.GetName(); got != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, got)
+		}
+	}
+}
+
+// TestGetPodOwnerTransientError 获取上层资源出现其他错误时, 只有已经找到声明了 IP 池的 owner 才返回错误.
+func TestGetPodOwnerTransientError(t *testing.T) {
+	job := &batchv1.Job{
+		ObjectMeta: apimmetav1.ObjectMeta{
+			Name: "cron-1", Namespace: "default",
+			OwnerReferences: ownerRef("batch/v1beta1", "CronJob", "cron"),
+		},
+	}
+	h, client := newOwnerTestHelper(DefaultOwnerKinds, job)
+	client.PrependReactor("get", "cronjobs", func(action cgtesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apimerrors.NewServiceUnavailable("apiserver is unavailable")
+	})
+	pod := newOwnedPod(ownerRef("batch/v1", "Job", "cron-1"))
+
+	// job 没有注解, 不影响 Pod 启动.
+	if _, err := h.GetPodOwnerSIP(pod); err == nil {
+		t.Errorf("expected the job without annotations to be ignored")
+	} else if _, ok := err.(*NoIPPoolError); !ok {
+		t.Errorf("expected NoIPPoolError, got %s", err)
+	}
+
+	job.Annotations = map[string]string{util.PoolNameAnnotation: "pool"}
+	h, client = newOwnerTestHelper(DefaultOwnerKinds, job)
+	client.PrependReactor("get", "cronjobs", func(action cgtesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apimerrors.NewServiceUnavailable("apiserver is unavailable")
+	})
+	owner, _, err := h.GetPodOwner(pod)
+	if err == nil {
+		t.Errorf("expected an error since the cronjob above an annotated job is unknown, got %s", owner.GetName())
+	} else if _, ok := err.(*NoIPPoolError); ok {
+		t.Errorf("expected a fatal error, got %s", err)
+	}
+}
@@ -0,0 +1,281 @@
+package staticip
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ParseIPPool 解析 ip_pool/ip_address 注解, 返回 "ip/掩码" 形式的 IP 列表,
+// 结果已去重, 并保持声明时的顺序.
+// 注解以逗号分隔, 每一项可以是:
+// 1. 单个 IP: 192.168.1.10/24
+// 2. 网段: 192.168.1.0/26, 即主机位全为 0 时, 展开为网段内的所有 IP
+// 3. 范围: 192.168.1.10-192.168.1.80/24
+// 4. 排除项: !192.168.1.1 或 !192.168.1.1-192.168.1.5, 从结果中移除
+// IPv4 的网络地址与广播地址会被自动跳过.
+func ParseIPPool(poolStr string) (ips []string, err error) {
+	ips, _, err = parseIPPool(poolStr)
+	return
+}
+
+// parseIPPool 同 ParseIPPool, 另外返回池中重复声明的 IP, 供 admission webhook 校验使用.
+func parseIPPool(poolStr string) (ips, dups []string, err error) {
+	ips = []string{}
+	dups = []string{}
+	seen := map[string]bool{}
+	excludes := map[string]bool{}
+
+	for _, item := range strings.Split(poolStr, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if strings.HasPrefix(item, "!") {
+			excludeIPs, err := parseExclude(strings.TrimPrefix(item, "!"))
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, ip := range excludeIPs {
+				excludes[ip.String()] = true
+			}
+			continue
+		}
+
+		itemIPs, prefix, err := parsePoolItem(item)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, ip := range itemIPs {
+			ipStr := fmt.Sprintf("%s/%d", ip, prefix)
+			// 同一个 IP 即使掩码不同也视为重复, 只保留第一次出现的.
+			if seen[ip.String()] {
+				dups = append(dups, ipStr)
+				continue
+			}
+			seen[ip.String()] = true
+			ips = append(ips, ipStr)
+		}
+	}
+
+	result := []string{}
+	for _, ipStr := range ips {
+		ip, _, _ := net.ParseCIDR(ipStr)
+		if excludes[normalizeIP(ip).String()] {
+			continue
+		}
+		result = append(result, ipStr)
+	}
+	if len(result) == 0 {
+		return nil, nil, fmt.Errorf("no avaliable IP in pool: %q", poolStr)
+	}
+	return result, dups, nil
+}
+
+// ExpandIPPool 将 ip_pool 注解中无法全部展开的 IPv6 网段(如 fd00::/64)替换为从中按顺序取出的 size 个 IP,
+// 跳过排除项, 池中其他项声明的 IP 以及 reserved 中的 IP(即网关), 其他项保持原样.
+// StaticIP 的 spec 中保存的是替换后的结果, 之后各处都可以直接通过 ParseIPPool() 解析.
+// caller: h.NewStaticIP(), 以及校验注解时以 size 为 1 调用
+func ExpandIPPool(poolStr string, size int, reserved ...string) (expanded string, err error) {
+	items := []string{}
+	for _, item := range strings.Split(poolStr, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	skip := map[string]bool{}
+	for _, ipStr := range reserved {
+		if ip := net.ParseIP(ipStr); ip != nil {
+			skip[normalizeIP(ip).String()] = true
+		}
+	}
+	large := map[int]*net.IPNet{}
+	for i, item := range items {
+		if subnet := largeSubnetItem(item); subnet != nil {
+			large[i] = subnet
+			continue
+		}
+		var itemIPs []net.IP
+		if strings.HasPrefix(item, "!") {
+			itemIPs, err = parseExclude(strings.TrimPrefix(item, "!"))
+		} else {
+			itemIPs, _, err = parsePoolItem(item)
+		}
+		if err != nil {
+			return "", err
+		}
+		for _, ip := range itemIPs {
+			skip[ip.String()] = true
+		}
+	}
+	if len(large) == 0 {
+		return poolStr, nil
+	}
+
+	for i := range items {
+		subnet, ok := large[i]
+		if !ok {
+			continue
+		}
+		prefix, _ := subnet.Mask.Size()
+		subnetIPs := []string{}
+		walkSubnet(subnet, func(ip net.IP) bool {
+			if len(subnetIPs) >= size {
+				return false
+			}
+			if !skip[ip.String()] {
+				skip[ip.String()] = true
+				subnetIPs = append(subnetIPs, fmt.Sprintf("%s/%d", ip, prefix))
+			}
+			return true
+		})
+		items[i] = strings.Join(subnetIPs, ",")
+	}
+	return strings.Join(items, ","), nil
+}
+
+// HasLargeSubnet 判断 IP 池中是否有需要通过 ExpandIPPool() 按数量划分的 IPv6 网段.
+func HasLargeSubnet(poolStr string) bool {
+	for _, item := range strings.Split(poolStr, ",") {
+		if largeSubnetItem(strings.TrimSpace(item)) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// largeSubnetItem 如果 item 是无法全部展开的 IPv6 网段, 则返回该网段, 否则返回 nil.
+// 过大的 IPv4 网段通常是写错了掩码, 仍由 parsePoolItem() 报错.
+func largeSubnetItem(item string) *net.IPNet {
+	if strings.HasPrefix(item, "!") || strings.Contains(item, "-") {
+		return nil
+	}
+	ip, subnet, err := net.ParseCIDR(item)
+	if err != nil || ip.To4() != nil || !ip.Equal(subnet.IP) || !isLargeSubnet(subnet) {
+		return nil
+	}
+	return subnet
+}
+
+// parseExclude 解析排除项, 掩码部分可有可无.
+func parseExclude(item string) (ips []net.IP, err error) {
+	if idx := strings.LastIndex(item, "/"); idx != -1 {
+		item = item[:idx]
+	}
+	ips, err = parseIPOrRange(item)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exclude item !%s: %s", item, err)
+	}
+	return
+}
+
+// parsePoolItem 解析单个 IP, 网段或范围, 返回其中可分配的 IP 及掩码位数.
+func parsePoolItem(item string) (ips []net.IP, prefix int, err error) {
+	idx := strings.LastIndex(item, "/")
+	if idx == -1 {
+		return nil, 0, fmt.Errorf("invalid item %s: missing prefix length, such as /24", item)
+	}
+	addrPart, prefixPart := item[:idx], item[idx+1:]
+	prefix, err = strconv.Atoi(prefixPart)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid item %s: bad prefix length %s", item, prefixPart)
+	}
+
+	if strings.Contains(addrPart, "-") {
+		parts := strings.SplitN(addrPart, "-", 2)
+		startIP, subnet, err := parseIPWithPrefix(parts[0], prefix)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid item %s: %s", item, err)
+		}
+		endIP, endSubnet, err := parseIPWithPrefix(parts[1], prefix)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid item %s: %s", item, err)
+		}
+		if !subnet.IP.Equal(endSubnet.IP) {
+			return nil, 0, fmt.Errorf("invalid item %s: range crosses subnet %s", item, subnet)
+		}
+		rangeIPs, err := expandRange(startIP, endIP)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid item %s: %s", item, err)
+		}
+		return skipReservedIPs(rangeIPs, subnet), prefix, nil
+	}
+
+	ip, subnet, err := parseIPWithPrefix(addrPart, prefix)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid item %s: %s", item, err)
+	}
+	// 主机位全为 0 时视为网段, 否则是单个 IP.
+	ones, bits := subnet.Mask.Size()
+	if ip.Equal(subnet.IP) && ones < bits {
+		subnetIPs, err := expandSubnet(subnet)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid item %s: %s", item, err)
+		}
+		return subnetIPs, prefix, nil
+	}
+	ips = skipReservedIPs([]net.IP{ip}, subnet)
+	if len(ips) == 0 {
+		return nil, 0, fmt.Errorf("invalid item %s: broadcast address can not be assigned", item)
+	}
+	return ips, prefix, nil
+}
+
+// parseIPWithPrefix 解析 IP 地址, 并结合掩码位数得到所在的网段.
+func parseIPWithPrefix(ipStr string, prefix int) (ip net.IP, subnet *net.IPNet, err error) {
+	ipStr = strings.TrimSpace(ipStr)
+	ip, subnet, err = net.ParseCIDR(fmt.Sprintf("%s/%d", ipStr, prefix))
+	if err != nil {
+		return nil, nil, fmt.Errorf("bad address %s/%d", ipStr, prefix)
+	}
+	return normalizeIP(ip), subnet, nil
+}
+
+// skipReservedIPs 移除网段中不可分配的地址, 见 isReservedIP().
+func skipReservedIPs(ips []net.IP, subnet *net.IPNet) (result []net.IP) {
+	for _, ip := range ips {
+		if isReservedIP(ip, subnet) {
+			continue
+		}
+		result = append(result, ip)
+	}
+	return
+}
+
+// ParseGateways 解析 gateway 注解. 双栈时以逗号分隔 IPv4 与 IPv6 网关,
+// 如 "192.168.0.1,fd00::1", 两者顺序不限, 但每个地址族最多只能有一个.
+func ParseGateways(gatewayStr string) (gateway, gateway6 string, err error) {
+	for _, item := range strings.Split(gatewayStr, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		ip := net.ParseIP(item)
+		if ip == nil {
+			return "", "", fmt.Errorf("invalid gateway: %s", item)
+		}
+		if ip.To4() != nil {
+			if gateway != "" {
+				return "", "", fmt.Errorf("duplicate ipv4 gateway: %s", gatewayStr)
+			}
+			gateway = ip.String()
+		} else {
+			if gateway6 != "" {
+				return "", "", fmt.Errorf("duplicate ipv6 gateway: %s", gatewayStr)
+			}
+			gateway6 = ip.String()
+		}
+	}
+	return
+}
+
+// isIPv6 判断 IP 字符串是否为 IPv6 地址, 可带有掩码, 如 fd00::10/64.
+func isIPv6(ipStr string) bool {
+	if idx := strings.Index(ipStr, "/"); idx != -1 {
+		ipStr = ipStr[:idx]
+	}
+	ip := net.ParseIP(ipStr)
+	return ip != nil && ip.To4() == nil
+}
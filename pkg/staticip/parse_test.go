@@ -0,0 +1,112 @@
+package staticip
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseIPPool(t *testing.T) {
+	tests := []struct {
+		name     string
+		pool     string
+		expected []string
+		dups     []string
+	}{
+		{
+			name:     "single ips",
+			pool:     "192.168.1.10/24, 192.168.1.11/24",
+			expected: []string{"192.168.1.10/24", "192.168.1.11/24"},
+		},
+		{
+			name:     "cidr skips network and broadcast",
+			pool:     "192.168.1.0/29",
+			expected: []string{"192.168.1.1/29", "192.168.1.2/29", "192.168.1.3/29", "192.168.1.4/29", "192.168.1.5/29", "192.168.1.6/29"},
+		},
+		{
+			name:     "/31 and /32 have no network or broadcast",
+			pool:     "192.168.1.0/31,192.168.2.0/32",
+			expected: []string{"192.168.1.0/31", "192.168.1.1/31", "192.168.2.0/32"},
+		},
+		{
+			name:     "range",
+			pool:     "192.168.1.10-192.168.1.13/24",
+			expected: []string{"192.168.1.10/24", "192.168.1.11/24", "192.168.1.12/24", "192.168.1.13/24"},
+		},
+		{
+			name:     "range skips network address",
+			pool:     "192.168.1.0-192.168.1.2/24",
+			expected: []string{"192.168.1.1/24", "192.168.1.2/24"},
+		},
+		{
+			name:     "range inside a larger subnet keeps x.x.x.0 and x.x.x.255",
+			pool:     "192.168.0.254-192.168.1.1/23",
+			expected: []string{"192.168.0.254/23", "192.168.0.255/23", "192.168.1.0/23", "192.168.1.1/23"},
+		},
+		{
+			name:     "range skips broadcast address",
+			pool:     "192.168.1.253-192.168.1.255/24",
+			expected: []string{"192.168.1.253/24", "192.168.1.254/24"},
+		},
+		{
+			name:     "exclusions of single ip and range, before or after the items",
+			pool:     "!192.168.1.1,192.168.1.0/29,!192.168.1.3-192.168.1.4/29",
+			expected: []string{"192.168.1.2/29", "192.168.1.5/29", "192.168.1.6/29"},
+		},
+		{
+			name:     "keep declaring order",
+			pool:     "192.168.1.20/24,192.168.1.10-192.168.1.11/24",
+			expected: []string{"192.168.1.20/24", "192.168.1.10/24", "192.168.1.11/24"},
+		},
+		{
+			name:     "duplicates keep the first one",
+			pool:     "192.168.1.10-192.168.1.12/24,192.168.1.11/24,192.168.1.12/25",
+			expected: []string{"192.168.1.10/24", "192.168.1.11/24", "192.168.1.12/24"},
+			dups:     []string{"192.168.1.11/24", "192.168.1.12/25"},
+		},
+		{
+			name:     "ipv6 cidr skips subnet-router address",
+			pool:     "fd00::/126,fd00::10-fd00::11/64",
+			expected: []string{"fd00::1/126", "fd00::2/126", "fd00::3/126", "fd00::10/64", "fd00::11/64"},
+		},
+	}
+	for _, test := range tests {
+		ips, dups, err := parseIPPool(test.pool)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(ips, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, ips)
+		}
+		if test.dups == nil {
+			test.dups = []string{}
+		}
+		if !reflect.DeepEqual(dups, test.dups) {
+			t.Errorf("%s: expected duplicates %v, got %v", test.name, test.dups, dups)
+		}
+	}
+}
+
+func TestParseIPPoolInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		pool string
+	}{
+		{"missing prefix", "192.168.1.10"},
+		{"bad prefix", "192.168.1.10/abc"},
+		{"bad address", "192.168.1.300/24"},
+		{"reversed range", "192.168.1.20-192.168.1.10/24"},
+		{"range crosses subnet", "192.168.1.250-192.168.2.10/24"},
+		{"range mixes families", "192.168.1.10-fd00::1/24"},
+		{"broadcast address", "192.168.1.255/24"},
+		{"ipv4 subnet too large", "10.0.0.0/8"},
+		{"bad exclusion", "192.168.1.0/29,!192.168.1"},
+		{"everything excluded", "192.168.1.10/24,!192.168.1.10"},
+		{"empty pool", " , "},
+	}
+	for _, test := range tests {
+		if ips, err := ParseIPPool(test.pool); err == nil {
+			t.Errorf("%s: expected %q to be rejected, got %v", test.name, test.pool, ips)
+		}
+	}
+}
@@ -2,10 +2,9 @@ package staticip
 
 import (
 	"fmt"
-	"strings"
 
-	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	apimerrors "k8s.io/apimachinery/pkg/api/errors"
 	apimmetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/klog"
 
@@ -13,60 +12,51 @@ import (
 	"github.com/generals-space/crd-ipkeeper/pkg/util"
 )
 
+// NoIPPoolError Pod 及其 owner 都没有声明 IP 池, 或是 owner 的 IP 池注解已被移除,
+// 也可能是 owner 不属于 --owner-kinds 允许的资源类型.
+// CNI server 遇到此错误时不为 Pod 分配 IP, 而不是返回失败.
+type NoIPPoolError struct {
+	Kind string
+	Name string
+}
+
+func (e *NoIPPoolError) Error() string {
+	return fmt.Sprintf("the %s %s doesn't have ip pool annotation, ignore", e.Kind, e.Name)
+}
+
 // GetPodOwner 获取 Pod 的 owner 对象, 及其资源类型, 如果没有则返回其自身.
+// deployment 通过 rs 管理 Pod, 而 statefulset, daemonset 等是直接管理的,
+// 这里统一沿 ownerReferences 向上查找, 见 h.resolveOwner().
+// 只有 --owner-kinds 中允许的资源类型才会被返回, 没有时返回 NoIPPoolError.
 func (h *Helper) GetPodOwner(
 	pod *corev1.Pod,
 ) (owner apimmetav1.Object, ownerKind string, err error) {
 	// 如果 Pod 没有 owner, 则返回 Pod 本身.
 	if pod.OwnerReferences == nil {
-		if pod.Annotations[util.IPAddressAnnotation] != "" &&
-			pod.Annotations[util.GatewayAnnotation] != "" {
+		if h.OwnerKindAllowed("Pod") &&
+			(pod.Annotations[util.PoolNameAnnotation] != "" ||
+				(pod.Annotations[util.IPAddressAnnotation] != "" &&
+					pod.Annotations[util.GatewayAnnotation] != "")) {
 			return pod, "Pod", nil
 		}
-		return nil, "", fmt.Errorf("the pod %s doesn't have ipaddr annotation, ignore", pod.Name)
+		return nil, "", &NoIPPoolError{Kind: "Pod", Name: pod.Name}
 	}
 
-	ownerRef := pod.OwnerReferences[0]
-
-	// deployment 通过 rs 管理 Pod, 但是 daemonset 却是直接管理的, 这两者要注意区分.
-	if ownerRef.Kind == "ReplicaSet" {
-		rs, err := h.kubeClient.
-			AppsV1().
-			ReplicaSets(pod.Namespace).
-			Get(ownerRef.Name, apimmetav1.GetOptions{})
-
-		if err != nil {
-			klog.Errorf("failed to get replicaset for pod: %s", err)
-			return nil, "", err
-		}
-		if rs.OwnerReferences == nil {
-			// 如果 rs 没有引用者
-		} else {
-			rsOwner := rs.OwnerReferences[0]
-			// 目前已知的 rs 的引用者只有 deployment
-			if rsOwner.Kind == "Deployment" {
-				deploy, err := h.kubeClient.
-					AppsV1().
-					Deployments(pod.Namespace).
-					Get(rsOwner.Name, apimmetav1.GetOptions{})
-
-				if err != nil {
-					klog.Errorf("failed to get deploy for pod: %s", err)
-					return nil, "", err
-				}
-				return deploy, "Deployment", nil
-			}
-		}
-	} else if ownerKind == "DaemonSet" {
-		//
+	owner, ownerKind, err = h.resolveOwner(pod)
+	if err != nil {
+		klog.Errorf("failed to get owner for pod: %s", err)
+		return nil, "", err
 	}
-
-	return nil, "", fmt.Errorf("doesn't support resource type: %s", ownerRef.Kind)
+	if owner == nil {
+		ref := controllerRef(pod)
+		return nil, "", &NoIPPoolError{Kind: ref.Kind, Name: ref.Name}
+	}
+	return owner, ownerKind, nil
 }
 
 // GetPodOwnerSIP 返回目标 Pod 对象对应的 StaticIP 对象.
-// 如果是单 Pod 资源(没有 Owner), 可能在调用时相应的 StaticIP 对象还未能创建,
-// 此时 err 为 nil, sip 也为 nil, 需要注意.
+// 如果是单 Pod 资源(没有 Owner), 或是 controller 没有直接监听的资源类型(如 CloneSet),
+// 可能在调用时相应的 StaticIP 对象还未能创建, 此时 err 为 nil, sip 也为 nil, 需要注意.
 func (h *Helper) GetPodOwnerSIP(
 	pod *corev1.Pod,
 ) (sip *ipkv1.StaticIP, err error) {
@@ -74,38 +64,57 @@ func (h *Helper) GetPodOwnerSIP(
 	if err != nil {
 		return
 	}
-	if kind == "Deployment" {
-		deploy := owner.(*appsv1.Deployment)
-		sipName := h.generateSIPName("Deployment", deploy.Name)
-		sip, err = h.crdClient.
-			IpkeeperV1().
-			StaticIPs(deploy.Namespace).
-			Get(sipName, apimmetav1.GetOptions{})
-		if err != nil {
-			if !strings.HasSuffix(err.Error(), "not found") {
-				klog.Errorf("failed to get staticip for pod: %s", err)
-			}
-			return nil, err
-		}
-	} else if kind == "Pod" {
-		// 由于这个函数是在处理 Deployment/Pod 资源的 Add 方法中被调用的,
-		// 但由于单个 Pod 的 Add 方法被触发时, 还没有到创建 pause 容器与申请 IP 那一步,
-		// 所以单个 Pod 资源在执行到这里(get sip)的时候一定会出错.
-		pod := owner.(*corev1.Pod)
-		sipName := h.generateSIPName("Pod", pod.Name)
-		sip, err = h.crdClient.
-			IpkeeperV1().
-			StaticIPs(pod.Namespace).
-			Get(sipName, apimmetav1.GetOptions{})
-		if err != nil {
-			// 如果 Pod 没有 owner
-			if !strings.HasSuffix(err.Error(), "not found") {
-				klog.Errorf("failed to get staticip for pod: %s", err)
-			} else {
-				err = nil
-			}
-			return nil, err
+	// 单个 Pod 的注解已经在 h.GetPodOwner() 中检查过了.
+	if kind != "Pod" && !util.HasIPPoolAnnotations(owner.GetAnnotations()) {
+		return nil, &NoIPPoolError{Kind: kind, Name: owner.GetName()}
+	}
+	sip, err = h.getOwnerSIP(owner, kind)
+	// owner 被删除后又以相同名称重建时, 旧的 StaticIP 可能还在等待 Pod 退出,
+	// 此时不能从中分配 IP, 返回错误让 kubelet 稍后重试.
+	if sip != nil && sip.DeletionTimestamp != nil {
+		return nil, fmt.Errorf("staticip %s is being deleted", sip.Name)
+	}
+	return
+}
+
+// FindPodOwnerSIP 与 h.GetPodOwnerSIP() 相同, 但不要求 owner 仍然声明了 IP 池.
+// owner 的 IP 池注解被移除后, 已经分配出去的 IP 仍由 Pod 使用, 释放时需要通过此方法找到 StaticIP.
+// StaticIP 不存在时 err 与 sip 均为 nil.
+func (h *Helper) FindPodOwnerSIP(
+	pod *corev1.Pod,
+) (sip *ipkv1.StaticIP, err error) {
+	owner, kind, err := h.GetPodOwner(pod)
+	if err != nil {
+		return
+	}
+	sip, err = h.getOwnerSIP(owner, kind)
+	if apimerrors.IsNotFound(err) {
+		return nil, nil
+	}
+	return
+}
+
+// getOwnerSIP 获取 owner 对应的 StaticIP 对象.
+func (h *Helper) getOwnerSIP(
+	owner apimmetav1.Object,
+	kind string,
+) (sip *ipkv1.StaticIP, err error) {
+	// 由于这个函数是在处理 Deployment/Pod 资源的 Add 方法中被调用的,
+	// 但由于单个 Pod 的 Add 方法被触发时, 还没有到创建 pause 容器与申请 IP 那一步,
+	// 所以单个 Pod 资源在执行到这里(get sip)的时候一定会出错.
+	sipName := h.generateSIPName(kind, owner.GetName())
+	sip, err = h.crdClient.
+		IpkeeperV1().
+		StaticIPs(owner.GetNamespace()).
+		Get(sipName, apimmetav1.GetOptions{})
+	if err != nil {
+		if !apimerrors.IsNotFound(err) {
+			klog.Errorf("failed to get staticip for pod: %s", err)
+		} else if !watchedKinds[kind] {
+			// 交由 controller 在处理 Pod 的 Add 事件时创建.
+			err = nil
 		}
+		return nil, err
 	}
 	return
 }
@@ -0,0 +1,406 @@
+package staticip
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apimmetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+
+	ipkv1 "github.com/generals-space/crd-ipkeeper/pkg/apis/ipkeeper/v1"
+	"github.com/generals-space/crd-ipkeeper/pkg/util"
+)
+
+// poolExcludes 返回 IPPool 中不参与分配的 IP: 网关与 Excludes 中声明的 IP.
+func poolExcludes(pool *ipkv1.IPPool) (excludes map[string]bool, err error) {
+	excludes = map[string]bool{}
+	for _, gwStr := range []string{pool.Spec.Gateway, pool.Spec.Gateway6} {
+		if gw := net.ParseIP(gwStr); gw != nil {
+			excludes[normalizeIP(gw).String()] = true
+		}
+	}
+	for _, str := range pool.Spec.Excludes {
+		excludeIPs, err := parseIPOrRange(str)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exclude %s in ippool %s: %s", str, pool.Name, err)
+		}
+		for _, ip := range excludeIPs {
+			excludes[ip.String()] = true
+		}
+	}
+	return
+}
+
+// poolSubnets 返回 IPPool 中声明的网段, 双栈时 IPv4 网段在前.
+// IPv6 网段(如 /64)通常无法全部展开, 划分时按需遍历, 见 walkSubnet(); IPv4 网段过大时视为配置错误.
+func poolSubnets(pool *ipkv1.IPPool) (subnets []*net.IPNet, err error) {
+	for _, subnetStr := range []string{pool.Spec.Subnet, pool.Spec.Subnet6} {
+		if subnetStr == "" {
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(subnetStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subnet %s in ippool %s: %s", subnetStr, pool.Name, err)
+		}
+		if subnet.IP.To4() != nil && isLargeSubnet(subnet) {
+			return nil, fmt.Errorf("subnet %s in ippool %s is too large", subnetStr, pool.Name)
+		}
+		subnets = append(subnets, subnet)
+	}
+	if len(subnets) == 0 {
+		return nil, fmt.Errorf("ippool %s has no subnet", pool.Name)
+	}
+	return
+}
+
+// poolContains 判断 ipStr 是否为 subnets 中可分配的 IP.
+func poolContains(subnets []*net.IPNet, excludes map[string]bool, ipStr string) bool {
+	ip := net.ParseIP(ipStr)
+	if ip == nil || excludes[ipStr] {
+		return false
+	}
+	for _, subnet := range subnets {
+		if subnet.Contains(ip) && !isReservedIP(ip, subnet) {
+			return true
+		}
+	}
+	return false
+}
+
+// poolTotal 返回 IPPool 中可分配的 IP 总数, 超过 math.MaxInt32 时返回 math.MaxInt32.
+func poolTotal(subnets []*net.IPNet, excludes map[string]bool) (total int) {
+	for _, subnet := range subnets {
+		count := hostCount(subnet)
+		if count == math.MaxInt32 {
+			return math.MaxInt32
+		}
+		for ipStr := range excludes {
+			ip := net.ParseIP(ipStr)
+			if subnet.Contains(ip) && !isReservedIP(ip, subnet) {
+				count--
+			}
+		}
+		total += count
+	}
+	if total > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return
+}
+
+// getPoolSize 获取 owner 需要从 IPPool 中划分的 IP 数量.
+// 优先使用 pool_size 注解, 否则 Deployment 取 replicas + maxSurge(见 SurgeCapacity()),
+// 以便滚动更新时多出来的 Pod 也能分配到 IP, StatefulSet 取其 replicas 值,
+// DaemonSet 取集群的节点数量, 其他类型为 1.
+func (h *Helper) getPoolSize(owner apimmetav1.Object, ownerKind string) (size int, err error) {
+	if sizeStr := owner.GetAnnotations()[util.PoolSizeAnnotation]; sizeStr != "" {
+		size, err = strconv.Atoi(sizeStr)
+		if err != nil || size <= 0 {
+			return 0, fmt.Errorf("invalid %s annotation: %s", util.PoolSizeAnnotation, sizeStr)
+		}
+		return
+	}
+	if ownerKind == "Deployment" {
+		deploy, err := toDeployment(owner)
+		if err != nil {
+			return 0, err
+		}
+		return SurgeCapacity(deploy)
+	}
+	if replicas := GetReplicas(owner, ownerKind); replicas != nil {
+		return int(*replicas), nil
+	}
+	// DaemonSet 在每个节点上都有一个 Pod, 按节点数量划分.
+	if ownerKind == "DaemonSet" {
+		nodeList, err := h.kubeClient.CoreV1().Nodes().List(apimmetav1.ListOptions{})
+		if err != nil {
+			return 0, fmt.Errorf("failed to list nodes: %s", err)
+		}
+		if len(nodeList.Items) > 0 {
+			return len(nodeList.Items), nil
+		}
+	}
+	return 1, nil
+}
+
+// toDeployment 将 owner 转换为 Deployment 对象.
+// 通过 h.resolveOwner() 得到的 owner 都是 unstructured 对象, 需要先转换才能读取其滚动更新策略.
+func toDeployment(owner apimmetav1.Object) (deploy *appsv1.Deployment, err error) {
+	switch obj := owner.(type) {
+	case *appsv1.Deployment:
+		return obj, nil
+	case *unstructured.Unstructured:
+		deploy = &appsv1.Deployment{}
+		err = runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, deploy)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert deployment %s: %s", obj.GetName(), err)
+		}
+		return deploy, nil
+	}
+	return nil, fmt.Errorf("unexpected deployment type %T", owner)
+}
+
+// expandLargeSubnets 按 owner 需要的 IP 数量(同 getPoolSize())划分 IP 池中的 IPv6 大网段,
+// 跳过 IPv6 网关以及其他 StaticIP 已经声明的 IP, 见 ExpandIPPool().
+// caller: h.NewStaticIP(), h.ValidateOwner()
+func (h *Helper) expandLargeSubnets(
+	owner apimmetav1.Object,
+	ownerKind, poolStr, gateway6 string,
+) (expanded string, err error) {
+	size, err := h.getPoolSize(owner, ownerKind)
+	if err != nil {
+		return "", err
+	}
+	sipList, err := h.crdClient.IpkeeperV1().StaticIPs("").List(apimmetav1.ListOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to list staticips: %s", err)
+	}
+	sipName := h.generateSIPName(ownerKind, owner.GetName())
+	reserved := []string{gateway6}
+	for _, other := range sipList.Items {
+		if other.Namespace == owner.GetNamespace() && other.Name == sipName {
+			continue
+		}
+		for ip := range other.Status.IPMap {
+			reserved = append(reserved, trimPrefixLen(ip))
+		}
+	}
+	return ExpandIPPool(poolStr, size, reserved...)
+}
+
+// GetReplicas 返回 Deployment, StatefulSet 等资源的 replicas 值, 没有此字段时返回 nil.
+// 通过 dynamic client 得到的任意类型的资源, 从其 spec.replicas 字段读取,
+// Job 与 CronJob 则取其同时运行的 Pod 数量, 即 parallelism 字段.
+func GetReplicas(owner apimmetav1.Object, ownerKind string) (replicas *int32) {
+	switch obj := owner.(type) {
+	case *appsv1.Deployment:
+		return obj.Spec.Replicas
+	case *appsv1.StatefulSet:
+		return obj.Spec.Replicas
+	case *unstructured.Unstructured:
+		fields := []string{"spec", "replicas"}
+		if ownerKind == "Job" {
+			fields = []string{"spec", "parallelism"}
+		} else if ownerKind == "CronJob" {
+			fields = []string{"spec", "jobTemplate", "spec", "parallelism"}
+		}
+		num, found, err := unstructured.NestedInt64(obj.Object, fields...)
+		if err != nil || !found {
+			return nil
+		}
+		replicas = new(int32)
+		*replicas = int32(num)
+		return replicas
+	}
+	return nil
+}
+
+// updatePoolUsage 根据 status.allocations 重新计算 IPPool 的 IP 总数与剩余数量.
+// 已经不属于此 IPPool(如 spec 被修改后)的 IP 不计入已划分的数量.
+func updatePoolUsage(pool *ipkv1.IPPool, subnets []*net.IPNet, excludes map[string]bool) {
+	allocated := map[string]bool{}
+	for _, block := range pool.Status.Allocations {
+		for _, ip := range block {
+			if poolContains(subnets, excludes, ip) {
+				allocated[ip] = true
+			}
+		}
+	}
+	pool.Status.Total = poolTotal(subnets, excludes)
+	pool.Status.Free = 0
+	if pool.Status.Total > len(allocated) {
+		pool.Status.Free = pool.Status.Total - len(allocated)
+	}
+}
+
+// carvePoolBlock 从名为 poolName 的 IPPool 中为 sipKey(StaticIP 的 namespace/name)
+// 划分 size 个 IP, 返回 "ip/掩码" 形式的 IP 列表与网关地址.
+// 双栈的 IPPool 会划分 size 个 IPv4 与 size 个 IPv6 地址.
+// 如果 sipKey 之前已经划分过, 则在原有的基础上扩充或缩减, 因此可以重复调用.
+// 缩减时优先保留 inUse 中(正在被 Pod 使用)的 IP, 以免 replicas 减少时驱逐仍在运行的 Pod.
+// caller: h.NewStaticIP()
+func (h *Helper) carvePoolBlock(
+	poolName, sipKey string,
+	size int,
+	inUse map[string]bool,
+) (ips []string, gateway, gateway6 string, err error) {
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		pool, err := h.crdClient.IpkeeperV1().IPPools().Get(poolName, apimmetav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		subnets, err := poolSubnets(pool)
+		if err != nil {
+			return err
+		}
+		excludes, err := poolExcludes(pool)
+		if err != nil {
+			return err
+		}
+
+		// 已经被其他 StaticIP 占用的 IP
+		taken := map[string]bool{}
+		for key, block := range pool.Status.Allocations {
+			if key == sipKey {
+				continue
+			}
+			for _, ip := range block {
+				taken[ip] = true
+			}
+		}
+		// 各地址族分别划分 size 个 IP,
+		// 先保留之前已划分的, 且仍然属于此 IPPool 的 IP, 再按顺序从网段中补足.
+		// 这里只遍历到凑够 size 个为止, 不会展开整个网段.
+		block := []string{}
+		prefixes := map[string]int{}
+		for i, subnet := range subnets {
+			prefix, _ := subnet.Mask.Size()
+			previous := []string{}
+			for _, ipStr := range pool.Status.Allocations[sipKey] {
+				if taken[ipStr] || !poolContains(subnets[i:i+1], excludes, ipStr) {
+					continue
+				}
+				previous = append(previous, ipStr)
+			}
+			owned := keepInUse(previous, size, inUse)
+			familyBlock := []string{}
+			for _, ipStr := range previous {
+				if owned[ipStr] {
+					familyBlock = append(familyBlock, ipStr)
+				}
+			}
+			walkSubnet(subnet, func(ip net.IP) bool {
+				if len(familyBlock) >= size {
+					return false
+				}
+				ipStr := ip.String()
+				if !excludes[ipStr] && !taken[ipStr] && !owned[ipStr] {
+					familyBlock = append(familyBlock, ipStr)
+				}
+				return true
+			})
+			if len(familyBlock) < size {
+				return fmt.Errorf("ippool %s doesn't have %d free IPs for %s", poolName, size, sipKey)
+			}
+			for _, ip := range familyBlock {
+				prefixes[ip] = prefix
+			}
+			block = append(block, familyBlock...)
+		}
+
+		if pool.Status.Allocations == nil {
+			pool.Status.Allocations = map[string][]string{}
+		}
+		pool.Status.Allocations[sipKey] = block
+		updatePoolUsage(pool, subnets, excludes)
+		_, err = h.crdClient.IpkeeperV1().IPPools().UpdateStatus(pool)
+		if err != nil {
+			return err
+		}
+
+		ips = []string{}
+		for _, ip := range block {
+			ips = append(ips, fmt.Sprintf("%s/%d", ip, prefixes[ip]))
+		}
+		gateway = pool.Spec.Gateway
+		gateway6 = pool.Spec.Gateway6
+		return nil
+	})
+	return
+}
+
+// keepInUse 从之前划分到的 previous 中选出最多 size 个继续保留的 IP,
+// 先选 inUse 中的, 再按顺序选其余的.
+func keepInUse(previous []string, size int, inUse map[string]bool) (kept map[string]bool) {
+	kept = map[string]bool{}
+	for _, used := range []bool{true, false} {
+		for _, ipStr := range previous {
+			if len(kept) >= size {
+				return
+			}
+			if inUse[ipStr] == used {
+				kept[ipStr] = true
+			}
+		}
+	}
+	return
+}
+
+// inUseIPs 返回 sip 中正在被 Pod 使用的 IP(不含掩码), 包括 IP 池缩小后等待驱逐或替换的 IP.
+// sip 为 nil 时返回空集合.
+func inUseIPs(sip *ipkv1.StaticIP) (inUse map[string]bool) {
+	inUse = map[string]bool{}
+	if sip == nil {
+		return
+	}
+	for ip, ownerPod := range sip.Status.IPMap {
+		if ownerPod != nil {
+			inUse[trimPrefixLen(ip)] = true
+		}
+	}
+	for _, removed := range []map[string]*ipkv1.OwnerPod{sip.Status.Evicting, sip.Status.Draining} {
+		for ip := range removed {
+			inUse[trimPrefixLen(ip)] = true
+		}
+	}
+	return
+}
+
+// ReleasePoolBlock 将 sipKey(StaticIP 的 namespace/name) 从各 IPPool 中划分到的 IP 归还.
+// caller: pkg/controller/handler_sip.go -> handleDelSIP(), pkg/controller/gc.go -> collectStaleBlocks()
+func (h *Helper) ReleasePoolBlock(sipKey string) (err error) {
+	poolList, err := h.crdClient.IpkeeperV1().IPPools().List(apimmetav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list ippools: %s", err)
+	}
+	for _, pool := range poolList.Items {
+		if _, ok := pool.Status.Allocations[sipKey]; !ok {
+			continue
+		}
+		poolName := pool.Name
+		err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			pool, err := h.crdClient.IpkeeperV1().IPPools().Get(poolName, apimmetav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			if _, ok := pool.Status.Allocations[sipKey]; !ok {
+				return nil
+			}
+			delete(pool.Status.Allocations, sipKey)
+			// spec 不合法时只归还 IP, 不更新数量.
+			if subnets, err := poolSubnets(pool); err == nil {
+				if excludes, err := poolExcludes(pool); err == nil {
+					updatePoolUsage(pool, subnets, excludes)
+				}
+			}
+			_, err = h.crdClient.IpkeeperV1().IPPools().UpdateStatus(pool)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to release block of %s from ippool %s: %s", sipKey, poolName, err)
+		}
+		klog.Infof("released block of %s from ippool %s", sipKey, poolName)
+	}
+	return nil
+}
+
+// PoolBlockOwners 返回所有 IPPool 中划分了 IP 的 StaticIP, 格式同 ReleasePoolBlock() 的 sipKey.
+func (h *Helper) PoolBlockOwners() (sipKeys []string, err error) {
+	poolList, err := h.crdClient.IpkeeperV1().IPPools().List(apimmetav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ippools: %s", err)
+	}
+	sipKeys = []string{}
+	for _, pool := range poolList.Items {
+		for sipKey := range pool.Status.Allocations {
+			sipKeys = append(sipKeys, sipKey)
+		}
+	}
+	return
+}
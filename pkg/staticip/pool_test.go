@@ -0,0 +1,186 @@
+package staticip
+
+import (
+	"reflect"
+	"testing"
+
+	apimmetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	ipkv1 "github.com/generals-space/crd-ipkeeper/pkg/apis/ipkeeper/v1"
+	crdfake "github.com/generals-space/crd-ipkeeper/pkg/client/clientset/versioned/fake"
+)
+
+// TestCarvePoolBlockIPv6 /64 的 IPv6 网段只按需划分, 跳过网关与其他 StaticIP 已经划分到的 IP.
+func TestCarvePoolBlockIPv6(t *testing.T) {
+	pool := &ipkv1.IPPool{
+		ObjectMeta: apimmetav1.ObjectMeta{Name: "dual"},
+		Spec: ipkv1.IPPoolSpec{
+			Subnet:   "172.16.0.0/24",
+			Gateway:  "172.16.0.1",
+			Subnet6:  "fd00::/64",
+			Gateway6: "fd00::1",
+		},
+		Status: ipkv1.IPPoolStatus{
+			Allocations: map[string][]string{"default/other": {"172.16.0.2", "fd00::"}},
+		},
+	}
+	h := &Helper{crdClient: crdfake.NewSimpleClientset(pool)}
+
+	ips, gateway, gateway6, err := h.carvePoolBlock("dual", "default/deploy-test", 2, nil)
+	if err != nil {
+		t.Fatalf("failed to carve block: %s", err)
+	}
+	expected := []string{"172.16.0.3/24", "172.16.0.4/24", "fd00::2/64", "fd00::3/64"}
+	if !reflect.DeepEqual(ips, expected) {
+		t.Errorf("expected %v, got %v", expected, ips)
+	}
+	if gateway != "172.16.0.1" || gateway6 != "fd00::1" {
+		t.Errorf("unexpected gateways %s, %s", gateway, gateway6)
+	}
+
+	latest, err := h.crdClient.IpkeeperV1().IPPools().Get("dual", apimmetav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get ippool: %s", err)
+	}
+	// 总数超出 int32 时取上限.
+	if latest.Status.Total != 1<<31-1 || latest.Status.Free != latest.Status.Total-5 {
+		t.Errorf("unexpected total %d and free %d", latest.Status.Total, latest.Status.Free)
+	}
+}
+
+// TestCarvePoolBlockShrink 缩减划分到的 IP 时优先保留正在被 Pod 使用的 IP.
+func TestCarvePoolBlockShrink(t *testing.T) {
+	pool := &ipkv1.IPPool{
+		ObjectMeta: apimmetav1.ObjectMeta{Name: "pool"},
+		Spec: ipkv1.IPPoolSpec{
+			Subnet:  "172.16.0.0/24",
+			Gateway: "172.16.0.1",
+		},
+		Status: ipkv1.IPPoolStatus{
+			Allocations: map[string][]string{
+				"default/deploy-test": {"172.16.0.2", "172.16.0.3", "172.16.0.4"},
+			},
+		},
+	}
+	h := &Helper{crdClient: crdfake.NewSimpleClientset(pool)}
+
+	sip := &ipkv1.StaticIP{
+		Status: ipkv1.StaticIPStatus{
+			IPMap: map[string]*ipkv1.OwnerPod{
+				"172.16.0.2/24": nil,
+				"172.16.0.3/24": nil,
+				"172.16.0.4/24": {Name: "test-1"},
+			},
+		},
+	}
+	ips, _, _, err := h.carvePoolBlock("pool", "default/deploy-test", 2, inUseIPs(sip))
+	if err != nil {
+		t.Fatalf("failed to carve block: %s", err)
+	}
+	expected := []string{"172.16.0.2/24", "172.16.0.4/24"}
+	if !reflect.DeepEqual(ips, expected) {
+		t.Errorf("expected %v, got %v", expected, ips)
+	}
+}
+
+// TestGetPoolSizeUnstructuredDeployment 通过 dynamic client 得到的 Deployment 同样按 replicas + maxSurge 划分.
+func TestGetPoolSizeUnstructuredDeployment(t *testing.T) {
+	owner := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata":   map[string]interface{}{"name": "test", "namespace": "default"},
+		"spec": map[string]interface{}{
+			"replicas": int64(1),
+			"strategy": map[string]interface{}{
+				"type": "RollingUpdate",
+				"rollingUpdate": map[string]interface{}{
+					"maxSurge":       "25%",
+					"maxUnavailable": "25%",
+				},
+			},
+		},
+	}}
+	h := &Helper{}
+	size, err := h.getPoolSize(owner, "Deployment")
+	if err != nil {
+		t.Fatalf("failed to get pool size: %s", err)
+	}
+	if size != 2 {
+		t.Errorf("expected 2, got %d", size)
+	}
+}
+
+func TestExpandIPPool(t *testing.T) {
+	tests := []struct {
+		name     string
+		pool     string
+		size     int
+		reserved []string
+		expected string
+	}{
+		{
+			name:     "small subnets are kept",
+			pool:     "172.16.0.0/30,fd00::10-fd00::12/64",
+			size:     2,
+			expected: "172.16.0.0/30,fd00::10-fd00::12/64",
+		},
+		{
+			name:     "skip gateway, exclusions and declared ips",
+			pool:     "172.16.0.10/24,fd00::/64,!fd00::2,fd00::3/64",
+			size:     3,
+			reserved: []string{"fd00::1"},
+			expected: "172.16.0.10/24,fd00::4/64,fd00::5/64,fd00::6/64,!fd00::2,fd00::3/64",
+		},
+		{
+			name:     "single ipv6 address is kept",
+			pool:     "fd00::10/64",
+			size:     2,
+			expected: "fd00::10/64",
+		},
+	}
+	for _, test := range tests {
+		expanded, err := ExpandIPPool(test.pool, test.size, test.reserved...)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+			continue
+		}
+		if expanded != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, expanded)
+		}
+		if _, err = ParseIPPool(expanded); err != nil {
+			t.Errorf("%s: expanded pool can not be parsed: %s", test.name, err)
+		}
+	}
+}
+
+// TestReleasePoolBlock 归还 IP 后按照剩余的划分重新计算 Free, 而不是在原有的值上累加.
+func TestReleasePoolBlock(t *testing.T) {
+	pool := &ipkv1.IPPool{
+		ObjectMeta: apimmetav1.ObjectMeta{Name: "pool"},
+		Spec:       ipkv1.IPPoolSpec{Subnet: "172.16.0.0/29", Gateway: "172.16.0.1"},
+		Status: ipkv1.IPPoolStatus{
+			Total: 5,
+			Free:  5,
+			Allocations: map[string][]string{
+				"default/a": {"172.16.0.2", "172.16.0.3"},
+				"default/b": {"172.16.0.4"},
+			},
+		},
+	}
+	h := &Helper{crdClient: crdfake.NewSimpleClientset(pool)}
+	if err := h.ReleasePoolBlock("default/a"); err != nil {
+		t.Fatalf("failed to release block: %s", err)
+	}
+	latest, err := h.crdClient.IpkeeperV1().IPPools().Get("pool", apimmetav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get ippool: %s", err)
+	}
+	if _, ok := latest.Status.Allocations["default/a"]; ok {
+		t.Errorf("block of default/a is not released: %v", latest.Status.Allocations)
+	}
+	// 除去网关后共 5 个 IP, default/b 仍占用 1 个.
+	if latest.Status.Total != 5 || latest.Status.Free != 4 {
+		t.Errorf("expected total 5 and free 4, got %d and %d", latest.Status.Total, latest.Status.Free)
+	}
+}
@@ -0,0 +1,130 @@
+package staticip
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	ipkv1 "github.com/generals-space/crd-ipkeeper/pkg/apis/ipkeeper/v1"
+	"github.com/generals-space/crd-ipkeeper/pkg/util"
+)
+
+// RequestedIPError Pod 通过 requested_ip 注解申请的 IP 无法分配,
+// CNI server 会据此在 Pod 上记录事件, 而不是为其分配其他的 IP.
+type RequestedIPError struct {
+	IP     string
+	Reason string
+}
+
+func (e *RequestedIPError) Error() string {
+	return fmt.Sprintf("requested ip %s is unavailable: %s", e.IP, e.Reason)
+}
+
+// ResolveRequestedIPs 解析 requested_ip 注解, 返回 IP 池中对应的 IP(与 IPMap 的 key 格式相同).
+// 注解中的 IP 可以不带掩码, 双栈时以逗号分隔, 每种地址族最多一个, 且必须属于 IP 池.
+// @param ips: ParseIPPool() 得到的 IP 列表
+func ResolveRequestedIPs(requestedStr string, ips []string) (requested []string, err error) {
+	poolIPs := map[string]string{}
+	for _, ip := range ips {
+		poolIPs[trimPrefixLen(ip)] = ip
+	}
+	requested = []string{}
+	for _, item := range strings.Split(requestedStr, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		ip := net.ParseIP(trimPrefixLen(item))
+		if ip == nil {
+			return nil, fmt.Errorf("invalid requested ip %s", item)
+		}
+		ipStr, ok := poolIPs[normalizeIP(ip).String()]
+		if !ok {
+			return nil, fmt.Errorf("requested ip %s is not in the ip pool", item)
+		}
+		for _, other := range requested {
+			if isIPv6(other) == isIPv6(ipStr) {
+				return nil, fmt.Errorf("more than one ip of the same family is requested")
+			}
+		}
+		requested = append(requested, ipStr)
+	}
+	return
+}
+
+// pickRequestedIPs 按 Pod 的 requested_ip 注解选取 IP, 注解中没有的地址族仍按选取策略分配.
+// 申请的 IP 已被其他 Pod 占用, 处于冷却期, 或是在滚动更新中预留给了其他版本时返回 RequestedIPError,
+// 不会改为分配其他 IP.
+func pickRequestedIPs(sip *ipkv1.StaticIP, pod *corev1.Pod) (alloc *AllocatedIP, err error) {
+	ips, err := ParseIPPool(sip.Spec.IPPool)
+	if err != nil {
+		return nil, err
+	}
+	requestedStr := pod.Annotations[util.RequestedIPAnnotation]
+	requested, err := ResolveRequestedIPs(requestedStr, ips)
+	if err != nil {
+		return nil, &RequestedIPError{IP: requestedStr, Reason: err.Error()}
+	}
+	alloc = &AllocatedIP{}
+	for _, ip := range requested {
+		if ownerPod := sip.Status.IPMap[ip]; ownerPod != nil && ownerPod.UID != pod.UID {
+			return nil, &RequestedIPError{
+				IP:     ip,
+				Reason: fmt.Sprintf("occupied by pod %s/%s", ownerPod.Namespace, ownerPod.Name),
+			}
+		}
+		if isReleasing(sip, ip) {
+			return nil, &RequestedIPError{IP: ip, Reason: "still in release cooldown"}
+		}
+		if reservedForOthers(sip, pod, ip) {
+			return nil, &RequestedIPError{
+				IP:     ip,
+				Reason: fmt.Sprintf("reserved for replicaset %s", sip.Status.Handover[ip].PodTemplateHash),
+			}
+		}
+		if isIPv6(ip) {
+			alloc.IPAddress6 = ip
+		} else {
+			alloc.IPAddress = ip
+		}
+	}
+	// 只为注解中没有的地址族按选取策略分配.
+	if alloc.IPAddress != "" && alloc.IPAddress6 != "" {
+		return
+	}
+	strategy, err := sipStrategy(sip)
+	if err != nil {
+		return nil, err
+	}
+	if alloc.IPAddress == "" {
+		alloc.IPAddress = pickFreeIP(sip, pod, strategy, false)
+	}
+	if alloc.IPAddress6 == "" {
+		alloc.IPAddress6 = pickFreeIP(sip, pod, strategy, true)
+	}
+	return
+}
+
+// ValidateRequestedIP 校验 Pod 的 requested_ip 注解中的 IP 是否属于其 owner 的 IP 池.
+// owner 的 StaticIP 还未创建时(如单个 Pod)跳过校验, 在分配时再检查.
+func (h *Helper) ValidateRequestedIP(pod *corev1.Pod) (err error) {
+	requestedStr := pod.Annotations[util.RequestedIPAnnotation]
+	if requestedStr == "" {
+		return nil
+	}
+	sip, err := h.GetPodOwnerSIP(pod)
+	if err != nil {
+		return err
+	}
+	if sip == nil {
+		return nil
+	}
+	ips, err := ParseIPPool(sip.Spec.IPPool)
+	if err != nil {
+		return err
+	}
+	_, err = ResolveRequestedIPs(requestedStr, ips)
+	return err
+}
@@ -0,0 +1,67 @@
+package staticip
+
+import (
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apimmetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	ipkv1 "github.com/generals-space/crd-ipkeeper/pkg/apis/ipkeeper/v1"
+	"github.com/generals-space/crd-ipkeeper/pkg/util"
+)
+
+// TestPickRequestedIPsHandover 滚动更新中为其他版本预留的 IP 不能通过 requested_ip 申请,
+// 其余空闲 IP 都被预留时, 申请的 IP 只要可用就能分配, 不会因为没有其他空闲 IP 而失败.
+func TestPickRequestedIPsHandover(t *testing.T) {
+	tests := []struct {
+		name      string
+		requested string
+		hash      string
+		expected  string
+		wantErr   bool
+	}{
+		{
+			name:      "reserved for other replicaset",
+			requested: "172.16.0.1",
+			hash:      "old",
+			wantErr:   true,
+		},
+		{
+			name:      "reserved for own replicaset",
+			requested: "172.16.0.1",
+			hash:      "new",
+			expected:  "172.16.0.1/24",
+		},
+		{
+			name:      "others are all reserved",
+			requested: "172.16.0.2",
+			hash:      "old",
+			expected:  "172.16.0.2/24",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sip := newTestStaticIP(t, "172.16.0.1-172.16.0.2/24")
+			sip.Status.Handover = map[string]ipkv1.IPHandover{
+				"172.16.0.1/24": {PodTemplateHash: "new", Since: apimmetav1.Now()},
+			}
+			pod := newTestPod(1)
+			pod.Labels = map[string]string{appsv1.DefaultDeploymentUniqueLabelKey: tt.hash}
+			pod.Annotations = map[string]string{util.RequestedIPAnnotation: tt.requested}
+
+			alloc, err := pickRequestedIPs(sip, pod)
+			if tt.wantErr {
+				if _, ok := err.(*RequestedIPError); !ok {
+					t.Errorf("expected RequestedIPError, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to pick requested ip: %s", err)
+			}
+			if alloc.IPAddress != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, alloc.IPAddress)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package staticip
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	apimerrors "k8s.io/apimachinery/pkg/api/errors"
+	apimmetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+
+	ipkv1 "github.com/generals-space/crd-ipkeeper/pkg/apis/ipkeeper/v1"
+)
+
+// RetireStaticIP owner 的 IP 池注解被移除后, 将其 StaticIP 标记为 Retiring.
+// 已经分配出去的 IP 仍由 Pod 继续使用, 直到 Pod 被替换; 新的 Pod 不再分配 IP, 见 h.GetPodOwnerSIP().
+// 所有 IP 都被释放后 StaticIP 会被删除, 见 h.deleteIfRetired().
+// caller: pkg/controller/handler_deploy.go -> handleRetireDeploy()
+func (h *Helper) RetireStaticIP(sip *ipkv1.StaticIP) (err error) {
+	result, err := mutateStatus(h.crdClient, sip, func(latest *ipkv1.StaticIP) (bool, error) {
+		if IsRetiring(latest) {
+			return false, nil
+		}
+		SetCondition(
+			&latest.Status, ipkv1.StaticIPRetiring, corev1.ConditionTrue,
+			"IPPoolRemoved", "ip pool annotations are removed from owner, waiting for pods to release their IPs",
+		)
+		return true, nil
+	})
+	if err != nil {
+		return
+	}
+	if result == nil {
+		result = sip
+	}
+	return h.deleteIfRetired(result)
+}
+
+// IsRetiring 判断 sip 是否已被标记为 Retiring.
+func IsRetiring(sip *ipkv1.StaticIP) bool {
+	cond := GetCondition(&sip.Status, ipkv1.StaticIPRetiring)
+	return cond != nil && cond.Status == corev1.ConditionTrue
+}
+
+// deleteIfRetired 删除已被标记为 Retiring, 且所有 IP 都已释放的 sip.
+// 引用了 IPPool 的 StaticIP 被删除后, 划分到的 IP 由 controller 归还, 见 handleDelSIP().
+// 以 resourceVersion 作为删除的前提条件, 期间 sip 被修改时放弃删除, 由之后的释放操作再次检查.
+func (h *Helper) deleteIfRetired(sip *ipkv1.StaticIP) (err error) {
+	if !IsRetiring(sip) || len(sip.Status.Used) != 0 || len(sip.Status.Evicting) != 0 || len(sip.Status.Draining) != 0 {
+		return nil
+	}
+	klog.Infof("all ips of retiring staticip %s/%s are released, delete it", sip.Namespace, sip.Name)
+	err = h.crdClient.IpkeeperV1().StaticIPs(sip.Namespace).Delete(sip.Name, &apimmetav1.DeleteOptions{
+		Preconditions: &apimmetav1.Preconditions{ResourceVersion: &sip.ResourceVersion},
+	})
+	if apimerrors.IsNotFound(err) || apimerrors.IsConflict(err) {
+		return nil
+	}
+	return
+}
@@ -0,0 +1,169 @@
+package staticip
+
+import (
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apimmetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+
+	ipkv1 "github.com/generals-space/crd-ipkeeper/pkg/apis/ipkeeper/v1"
+	crdClientset "github.com/generals-space/crd-ipkeeper/pkg/client/clientset/versioned"
+)
+
+// GetCondition 从 status 中取出指定类型的 condition, 不存在时返回 nil.
+func GetCondition(
+	status *ipkv1.StaticIPStatus,
+	condType ipkv1.StaticIPConditionType,
+) *ipkv1.StaticIPCondition {
+	for i := range status.Conditions {
+		if status.Conditions[i].Type == condType {
+			return &status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// SetCondition 设置 status 中指定类型的 condition, 不存在时则新增.
+// 只有 Status 字段发生变化时才会更新 LastTransitionTime.
+func SetCondition(
+	status *ipkv1.StaticIPStatus,
+	condType ipkv1.StaticIPConditionType,
+	condStatus corev1.ConditionStatus,
+	reason, message string,
+) {
+	cond := GetCondition(status, condType)
+	if cond == nil {
+		status.Conditions = append(status.Conditions, ipkv1.StaticIPCondition{
+			Type:               condType,
+			Status:             condStatus,
+			LastTransitionTime: apimmetav1.Now(),
+			Reason:             reason,
+			Message:            message,
+		})
+		return
+	}
+	if cond.Status != condStatus {
+		cond.LastTransitionTime = apimmetav1.Now()
+	}
+	cond.Status = condStatus
+	cond.Reason = reason
+	cond.Message = message
+}
+
+// RemoveCondition 移除 status 中指定类型的 condition.
+func RemoveCondition(status *ipkv1.StaticIPStatus, condType ipkv1.StaticIPConditionType) {
+	conditions := []ipkv1.StaticIPCondition{}
+	for _, cond := range status.Conditions {
+		if cond.Type != condType {
+			conditions = append(conditions, cond)
+		}
+	}
+	status.Conditions = conditions
+}
+
+// refreshStatus 根据 Used 与 IPMap 重新计算 Ratio, 并同步 PoolExhausted 状态.
+// 双栈时任意一种地址耗尽都视为 PoolExhausted.
+// 已经为 True 时保留原有的 reason 与 message, 其中可能记录了没能分配到 IP 的 Pod, 见 h.setExhausted().
+// 在每次调用 UpdateStatus() 之前执行.
+func refreshStatus(sip *ipkv1.StaticIP) {
+	sip.Status.Ratio = fmt.Sprintf("%d/%d", len(sip.Status.Used), len(sip.Status.IPMap))
+	hasV4, hasV6 := ipFamilies(sip)
+	freeV4, freeV6 := 0, 0
+	for _, ip := range sip.Status.Avaliable {
+		if isIPv6(ip) {
+			freeV6++
+		} else {
+			freeV4++
+		}
+	}
+	if (hasV4 && freeV4 == 0) || (hasV6 && freeV6 == 0) {
+		if cond := GetCondition(&sip.Status, ipkv1.StaticIPPoolExhausted); cond != nil &&
+			cond.Status == corev1.ConditionTrue {
+			return
+		}
+		SetCondition(
+			&sip.Status, ipkv1.StaticIPPoolExhausted, corev1.ConditionTrue,
+			"NoAvaliableIP", fmt.Sprintf("all %d IPs in pool are in use", len(sip.Status.IPMap)),
+		)
+	} else {
+		SetCondition(
+			&sip.Status, ipkv1.StaticIPPoolExhausted, corev1.ConditionFalse,
+			"IPAvaliable", fmt.Sprintf("%d IPs avaliable", len(sip.Status.Avaliable)),
+		)
+	}
+}
+
+// updateStatus 刷新 sip 的统计信息, 并通过 /status 子资源接口写回.
+func updateStatus(
+	crdClient crdClientset.Interface,
+	sip *ipkv1.StaticIP,
+) (*ipkv1.StaticIP, error) {
+	refreshStatus(sip)
+	return crdClient.IpkeeperV1().StaticIPs(sip.Namespace).UpdateStatus(sip)
+}
+
+// conflictBackoff 写回 StaticIP 遇到 resourceVersion 冲突时的重试间隔.
+// 同一 Deployment 的多个 Pod 在不同节点上同时创建时冲突比较频繁, 所以重试次数比 retry.DefaultRetry 多,
+// 较大的 Jitter 可以错开同时冲突的各方.
+var conflictBackoff = wait.Backoff{
+	Steps:    12,
+	Duration: 10 * time.Millisecond,
+	Factor:   1.5,
+	Jitter:   1.0,
+	Cap:      time.Second,
+}
+
+// mutateStatus 重新获取最新的 sip, 在其上执行 mutate, 并将结果通过 UpdateStatus() 写回.
+// 调用者手中的 sip 可能已经过期, 所以每次尝试都会重新获取;
+// 写回遇到冲突时再次获取并执行 mutate, 直到成功或超过 conflictBackoff 的次数.
+// 传入的 sip 对象本身不会被修改, 即使中途失败也不会留下修改了一半的状态.
+// mutate 返回 false 时表示没有需要写回的修改, 此时返回的 sip 为 nil.
+func mutateStatus(
+	crdClient crdClientset.Interface,
+	sip *ipkv1.StaticIP,
+	mutate func(latest *ipkv1.StaticIP) (changed bool, err error),
+) (result *ipkv1.StaticIP, err error) {
+	err = retry.RetryOnConflict(conflictBackoff, func() (err error) {
+		latest, err := crdClient.IpkeeperV1().StaticIPs(sip.Namespace).Get(sip.Name, apimmetav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		changed, err := mutate(latest)
+		if err != nil || !changed {
+			return err
+		}
+		result, err = updateStatus(crdClient, latest)
+		return err
+	})
+	return
+}
+
+// checkConflict 检查 sip 的 IP 池中是否存在已属于其他 StaticIP 的 IP, 并设置 Conflict 状态.
+// 这里只做标记, 不会阻止 sip 的创建与更新.
+func checkConflict(
+	crdClient crdClientset.Interface,
+	sip *ipkv1.StaticIP,
+) {
+	sipList, err := crdClient.IpkeeperV1().StaticIPs("").List(apimmetav1.ListOptions{})
+	if err != nil {
+		klog.Warningf("failed to list staticips for conflict check: %s", err)
+		return
+	}
+	ips := []string{}
+	for ip := range sip.Status.IPMap {
+		ips = append(ips, ip)
+	}
+	conflicts := overlapIPs(sipList.Items, sip.Namespace, sip.Name, ips)
+	if len(conflicts) == 0 {
+		SetCondition(&sip.Status, ipkv1.StaticIPConflict, corev1.ConditionFalse, "NoConflict", "")
+		return
+	}
+	SetCondition(
+		&sip.Status, ipkv1.StaticIPConflict, corev1.ConditionTrue,
+		"IPOverlap", fmt.Sprintf("IPs already owned by other staticip: %v", conflicts),
+	)
+}
@@ -0,0 +1,172 @@
+package staticip
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	apimmetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	ipkv1 "github.com/generals-space/crd-ipkeeper/pkg/apis/ipkeeper/v1"
+)
+
+// IP 选取策略的名称, 见 StaticIPSpec.Strategy 与 strategy 注解.
+const (
+	// StrategyLowest 选取数值最小的空闲 IP, 为默认策略.
+	StrategyLowest = "lowest"
+	// StrategyRoundRobin 选取最久之前被释放的空闲 IP, 从未被使用过的 IP 优先,
+	// 这样刚释放的 IP 不会马上被其他 Pod 使用.
+	StrategyRoundRobin = "round-robin"
+	// StrategyHash 根据 Pod 名称的哈希值选取 IP, 被占用时顺延到下一个空闲 IP,
+	// 同名 Pod 重建后(如裸 Pod 或手动删除重建)大概率仍能得到相同的 IP.
+	StrategyHash = "hash"
+)
+
+// PickRequest 选取 IP 时需要的信息, 只包含同一地址族的 IP.
+// 不依赖集群与 StaticIP 对象, 便于单独测试各策略.
+type PickRequest struct {
+	// Pool IP 池中的全部 IP, 按数值从小到大排列
+	Pool []string
+	// Free Pool 中空闲的 IP
+	Free map[string]bool
+	// LastReleased 各 IP 最近一次被释放的时间
+	LastReleased map[string]apimmetav1.Time
+	// PodName 申请 IP 的 Pod 名称
+	PodName string
+}
+
+// Strategy IP 选取策略, 从 req.Free 中选出一个 IP, 没有空闲 IP 时返回空字符串.
+// 同样的输入必须得到同样的结果.
+type Strategy interface {
+	Pick(req *PickRequest) (ip string)
+}
+
+// strategies 所有可用的策略.
+var strategies = map[string]Strategy{
+	StrategyLowest:     lowestStrategy{},
+	StrategyRoundRobin: roundRobinStrategy{},
+	StrategyHash:       hashStrategy{},
+}
+
+// GetStrategy 根据名称获取选取策略, name 为空时使用 StrategyLowest.
+func GetStrategy(name string) (strategy Strategy, err error) {
+	if name == "" {
+		name = StrategyLowest
+	}
+	strategy, ok := strategies[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown ip strategy %s", name)
+	}
+	return strategy, nil
+}
+
+// lowestStrategy 见 StrategyLowest.
+type lowestStrategy struct{}
+
+func (lowestStrategy) Pick(req *PickRequest) (ip string) {
+	for _, candidate := range req.Pool {
+		if req.Free[candidate] {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// roundRobinStrategy 见 StrategyRoundRobin.
+type roundRobinStrategy struct{}
+
+func (roundRobinStrategy) Pick(req *PickRequest) (ip string) {
+	var oldest apimmetav1.Time
+	for _, candidate := range req.Pool {
+		if !req.Free[candidate] {
+			continue
+		}
+		// 从未释放过的 IP 时间为零值, 会排在最前面; 时间相同时取数值较小的.
+		released := req.LastReleased[candidate]
+		if ip == "" || released.Before(&oldest) {
+			ip, oldest = candidate, released
+		}
+	}
+	return
+}
+
+// hashStrategy 见 StrategyHash.
+type hashStrategy struct{}
+
+func (hashStrategy) Pick(req *PickRequest) (ip string) {
+	if len(req.Pool) == 0 {
+		return ""
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(req.PodName))
+	start := int(hash.Sum32() % uint32(len(req.Pool)))
+	for i := 0; i < len(req.Pool); i++ {
+		candidate := req.Pool[(start+i)%len(req.Pool)]
+		if req.Free[candidate] {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// pickFreeIPs 按 sip 的选取策略, 从每种地址族中各选出一个空闲的 IP.
+func pickFreeIPs(sip *ipkv1.StaticIP, pod *corev1.Pod) (alloc *AllocatedIP, err error) {
+	strategy, err := sipStrategy(sip)
+	if err != nil {
+		return nil, err
+	}
+	alloc = &AllocatedIP{}
+	alloc.IPAddress = pickFreeIP(sip, pod, strategy, false)
+	alloc.IPAddress6 = pickFreeIP(sip, pod, strategy, true)
+	return
+}
+
+// sipStrategy 返回 sip 使用的选取策略.
+// 设置了冷却时间且没有指定策略时, 优先选取冷却最久的 IP.
+func sipStrategy(sip *ipkv1.StaticIP) (strategy Strategy, err error) {
+	name := sip.Spec.Strategy
+	if name == "" && sip.Spec.ReleaseCooldown != "" {
+		name = StrategyRoundRobin
+	}
+	return GetStrategy(name)
+}
+
+// pickFreeIP 按 strategy 从 sip 中选出一个 v6 指定地址族的空闲 IP, 没有时返回空字符串.
+func pickFreeIP(sip *ipkv1.StaticIP, pod *corev1.Pod, strategy Strategy, v6 bool) string {
+	req := &PickRequest{
+		Pool:         []string{},
+		Free:         map[string]bool{},
+		LastReleased: sip.Status.LastReleased,
+		PodName:      pod.Name,
+	}
+	for ip, ownerPod := range sip.Status.IPMap {
+		if isIPv6(ip) != v6 {
+			continue
+		}
+		req.Pool = append(req.Pool, ip)
+		if ownerPod == nil && !isReleasing(sip, ip) {
+			req.Free[ip] = true
+		}
+	}
+	if sip.Spec.OwnerKind == "Deployment" {
+		req.Free = handoverFree(sip, pod, req.Free)
+	}
+	// IPMap 的遍历顺序是随机的, 排序后各策略的结果才是确定的.
+	sortIPs(req.Pool)
+	return strategy.Pick(req)
+}
+
+// sortIPs 将 IP 列表(可以带掩码)按数值从小到大排序.
+func sortIPs(ips []string) {
+	sort.Slice(ips, func(i, j int) bool {
+		a := normalizeIP(net.ParseIP(trimPrefixLen(ips[i])))
+		b := normalizeIP(net.ParseIP(trimPrefixLen(ips[j])))
+		if len(a) != len(b) {
+			return len(a) < len(b)
+		}
+		return bytes.Compare(a, b) < 0
+	})
+}
@@ -0,0 +1,173 @@
+package staticip
+
+import (
+	"hash/fnv"
+	"reflect"
+	"testing"
+	"time"
+
+	apimmetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// hashStart 返回 hash 策略对 podName 选取的起始位置, 与 hashStrategy 的算法一致.
+func hashStart(podName string, size int) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(podName))
+	return int(hash.Sum32() % uint32(size))
+}
+
+func freeSet(ips ...string) map[string]bool {
+	free := map[string]bool{}
+	for _, ip := range ips {
+		free[ip] = true
+	}
+	return free
+}
+
+func TestSortIPs(t *testing.T) {
+	tests := []struct {
+		name     string
+		ips      []string
+		expected []string
+	}{
+		{
+			name:     "ipv4 by value",
+			ips:      []string{"172.16.0.10/24", "172.16.0.9/24", "172.16.0.100/24", "10.0.0.1/8"},
+			expected: []string{"10.0.0.1/8", "172.16.0.9/24", "172.16.0.10/24", "172.16.0.100/24"},
+		},
+		{
+			name:     "ipv6 by value",
+			ips:      []string{"fd00::10/64", "fd00::a/64", "fd00::1:0/64", "fd00::9/64"},
+			expected: []string{"fd00::9/64", "fd00::a/64", "fd00::10/64", "fd00::1:0/64"},
+		},
+		{
+			name:     "ipv4 before ipv6",
+			ips:      []string{"fd00::1/64", "172.16.0.2/24", "2001:db8::1/64", "172.16.0.1/24"},
+			expected: []string{"172.16.0.1/24", "172.16.0.2/24", "2001:db8::1/64", "fd00::1/64"},
+		},
+	}
+	for _, test := range tests {
+		sortIPs(test.ips)
+		if !reflect.DeepEqual(test.ips, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, test.ips)
+		}
+	}
+}
+
+func TestStrategyPick(t *testing.T) {
+	v4Pool := []string{"172.16.0.1/24", "172.16.0.2/24", "172.16.0.9/24", "172.16.0.10/24"}
+	v6Pool := []string{"fd00::9/64", "fd00::a/64", "fd00::10/64"}
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	earlier := apimmetav1.NewTime(now.Add(-time.Hour))
+	later := apimmetav1.NewTime(now)
+	hashPod := "test-0"
+
+	tests := []struct {
+		name     string
+		strategy string
+		req      *PickRequest
+		expected string
+	}{
+		{
+			name:     "lowest picks the smallest free ipv4",
+			strategy: StrategyLowest,
+			req:      &PickRequest{Pool: v4Pool, Free: freeSet("172.16.0.10/24", "172.16.0.9/24")},
+			expected: "172.16.0.9/24",
+		},
+		{
+			name:     "lowest picks the smallest free ipv6",
+			strategy: StrategyLowest,
+			req:      &PickRequest{Pool: v6Pool, Free: freeSet("fd00::10/64", "fd00::a/64")},
+			expected: "fd00::a/64",
+		},
+		{
+			name:     "empty strategy name is lowest",
+			strategy: "",
+			req:      &PickRequest{Pool: v4Pool, Free: freeSet("172.16.0.2/24", "172.16.0.10/24")},
+			expected: "172.16.0.2/24",
+		},
+		{
+			name:     "lowest without free ip",
+			strategy: StrategyLowest,
+			req:      &PickRequest{Pool: v4Pool, Free: freeSet()},
+			expected: "",
+		},
+		{
+			name:     "round-robin prefers never released ips",
+			strategy: StrategyRoundRobin,
+			req: &PickRequest{
+				Pool:         v4Pool,
+				Free:         freeSet("172.16.0.1/24", "172.16.0.9/24", "172.16.0.10/24"),
+				LastReleased: map[string]apimmetav1.Time{"172.16.0.1/24": earlier, "172.16.0.9/24": later},
+			},
+			expected: "172.16.0.10/24",
+		},
+		{
+			name:     "round-robin picks the earliest released ip",
+			strategy: StrategyRoundRobin,
+			req: &PickRequest{
+				Pool: v6Pool,
+				Free: freeSet("fd00::9/64", "fd00::10/64"),
+				LastReleased: map[string]apimmetav1.Time{
+					"fd00::9/64": later, "fd00::a/64": earlier, "fd00::10/64": earlier,
+				},
+			},
+			expected: "fd00::10/64",
+		},
+		{
+			name:     "round-robin breaks ties by the smaller ip",
+			strategy: StrategyRoundRobin,
+			req: &PickRequest{
+				Pool: v4Pool,
+				Free: freeSet("172.16.0.2/24", "172.16.0.9/24", "172.16.0.10/24"),
+				LastReleased: map[string]apimmetav1.Time{
+					"172.16.0.2/24": later, "172.16.0.9/24": earlier, "172.16.0.10/24": earlier,
+				},
+			},
+			expected: "172.16.0.9/24",
+		},
+		{
+			name:     "hash picks the ip at the hashed position",
+			strategy: StrategyHash,
+			req: &PickRequest{
+				Pool: v4Pool, Free: freeSet(v4Pool...), PodName: hashPod,
+			},
+			expected: v4Pool[hashStart(hashPod, len(v4Pool))],
+		},
+		{
+			name:     "hash moves on to the next free ip and wraps around",
+			strategy: StrategyHash,
+			req: &PickRequest{
+				Pool:    v6Pool,
+				Free:    freeSet(v6Pool[(hashStart(hashPod, len(v6Pool))+2)%len(v6Pool)]),
+				PodName: hashPod,
+			},
+			expected: v6Pool[(hashStart(hashPod, len(v6Pool))+2)%len(v6Pool)],
+		},
+		{
+			name:     "hash with empty pool",
+			strategy: StrategyHash,
+			req:      &PickRequest{Pool: []string{}, Free: freeSet(), PodName: hashPod},
+			expected: "",
+		},
+	}
+	for _, test := range tests {
+		strategy, err := GetStrategy(test.strategy)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		// 同样的输入必须得到同样的结果.
+		for i := 0; i < 3; i++ {
+			if ip := strategy.Pick(test.req); ip != test.expected {
+				t.Errorf("%s: expected %q, got %q", test.name, test.expected, ip)
+				break
+			}
+		}
+	}
+}
+
+func TestGetStrategyUnknown(t *testing.T) {
+	if _, err := GetStrategy("random"); err == nil {
+		t.Errorf("expected unknown strategy to be rejected")
+	}
+}
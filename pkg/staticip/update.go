@@ -2,16 +2,46 @@ package staticip
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/klog"
 
 	crdv1 "github.com/generals-space/crd-ipkeeper/pkg/apis/ipkeeper/v1"
 	ipkv1 "github.com/generals-space/crd-ipkeeper/pkg/apis/ipkeeper/v1"
+	"github.com/generals-space/crd-ipkeeper/pkg/util"
 )
 
+// PoolExhaustedError sip 中已经没有可以分配给 Pod 的空闲 IP,
+// CNI server 会据此在 Pod, workload 与 StaticIP 上记录 PoolExhausted 事件.
+type PoolExhaustedError struct {
+	SIP string
+}
+
+func (e *PoolExhaustedError) Error() string {
+	return fmt.Sprintf("no more IP avaliable in sip: %s", e.SIP)
+}
+
+// AllocatedIP 分配给 Pod 的 IP 地址及网关.
+// 双栈时 IPv4 与 IPv6 地址各有一个, 单栈时另一组为空.
+type AllocatedIP struct {
+	// IPAddress 点分十进制+掩码字符串, 如`192.168.0.1/24`
+	IPAddress  string
+	Gateway    string
+	IPAddress6 string
+	Gateway6   string
+}
+
 // AccquireIP 从目标 sip 对象的 IPMap 中找到可用的 IP 并返回,
-// 同时修改 sip 对象的 Avaliable 和 Used 列表(但不更新, 更新操作由调用者完成).
+// 同时修改 sip 对象 status 中的 Avaliable 和 Used 列表, 并通过 UpdateStatus() 写回.
+// 如果 IP 池中同时存在 IPv4 与 IPv6 地址, 则每种地址各分配一个.
+// 多个节点同时为同一 StaticIP 的 Pod 申请 IP 时, 写回可能因 resourceVersion 冲突失败,
+// 所以这里总是基于最新的 sip 选取, 冲突时重新获取再选, 见 mutateStatus(). 传入的 sip 对象本身不会被修改.
+// kubelet 可能对同一个 sandbox 重复发起 ADD, 所以 pod 已经占用了 IP 时直接返回原有的 IP, 不会重新分配.
+// @param containerID: pause 容器的 ID, 会记录到 OwnerPod 中.
+// @param netns: pause 容器的 netns 路径, 会记录到 OwnerPod 中, 网关变化时用于更新 Pod 的默认路由, 见 gateway.go.
 // caller: pkg/server/handler.go -> CNIServerHandler.handleAdd()
 // 调用时机为在创建 pause 容器, 调用 cni ipam 插件申请的过程中,
 // 而不是在 controller 中通过监听 Pod 的 Add 事件,
@@ -19,85 +49,398 @@ import (
 func (h *Helper) AccquireIP(
 	sip *ipkv1.StaticIP,
 	pod *corev1.Pod,
-) (ipaddr, gateway string, err error) {
-	for ip, ownerPod := range sip.Spec.IPMap {
-		if ownerPod == nil {
-			ipaddr = ip
-			gateway = sip.Spec.Gateway
-			sip.Spec.IPMap[ip] = &crdv1.OwnerPod{
-				Namespace: pod.Namespace,
-				Name:      pod.Name,
-				UID:       pod.UID,
-			}
-			break
+	containerID, netns string,
+) (alloc *AllocatedIP, err error) {
+	_, err = mutateStatus(h.crdClient, sip, func(latest *ipkv1.StaticIP) (changed bool, err error) {
+		if latest.DeletionTimestamp != nil {
+			return false, fmt.Errorf("staticip %s is being deleted", latest.Name)
+		}
+		alloc, changed = existingIP(latest, pod, containerID, netns)
+		if alloc != nil {
+			return changed, nil
+		}
+		alloc, err = allocateIP(latest, pod, containerID, netns)
+		return err == nil, err
+	})
+	if err != nil {
+		// 调用者需要根据错误类型记录事件, 所以不做包装.
+		if _, ok := err.(*RequestedIPError); ok {
+			return nil, err
+		}
+		if _, ok := err.(*PoolExhaustedError); ok {
+			h.setExhausted(sip, pod)
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to occupy one IP from sip %s: %s", sip.Name, err)
+	}
+	return
+}
+
+// setExhausted 分配失败后将 sip 的 PoolExhausted 设置为 True, 并在 message 中记录没能分配到 IP 的 pod,
+// 这样 kubectl describe staticip 就能看到 Pod 为什么一直处于 ContainerCreating 状态.
+// 只是为了便于排查, 所以失败时不返回错误.
+func (h *Helper) setExhausted(sip *ipkv1.StaticIP, pod *corev1.Pod) {
+	_, err := mutateStatus(h.crdClient, sip, func(latest *ipkv1.StaticIP) (bool, error) {
+		message := fmt.Sprintf(
+			"no IP avaliable for pod %s/%s, %d/%d IPs in use",
+			pod.Namespace, pod.Name, len(latest.Status.Used), len(latest.Status.IPMap),
+		)
+		cond := GetCondition(&latest.Status, ipkv1.StaticIPPoolExhausted)
+		if cond != nil && cond.Status == corev1.ConditionTrue && cond.Message == message {
+			return false, nil
+		}
+		SetCondition(&latest.Status, ipkv1.StaticIPPoolExhausted, corev1.ConditionTrue, "AllocationFailed", message)
+		return true, nil
+	})
+	if err != nil {
+		klog.Warningf("failed to set pool exhausted condition of sip %s: %s", sip.Name, err)
+	}
+}
+
+// existingIP 查找 pod(按 UID)已经占用的 IP, 每种地址族都已占用时才返回, 否则返回 nil.
+// 同一 Pod 的 sandbox 被重建时 containerID 会变化, 此时仍沿用原来的 IP, 并更新记录的 containerID 与 netns,
+// 新的 sandbox 使用的是当前的网关. changed 表示 sip 是否被修改.
+func existingIP(
+	sip *ipkv1.StaticIP,
+	pod *corev1.Pod,
+	containerID, netns string,
+) (alloc *AllocatedIP, changed bool) {
+	hasV4, hasV6 := ipFamilies(sip)
+	found := &AllocatedIP{}
+	owned := map[string]*ipkv1.OwnerPod{}
+	for ip, ownerPod := range sip.Status.IPMap {
+		if ownerPod == nil || ownerPod.UID != pod.UID {
+			continue
+		}
+		if isIPv6(ip) {
+			found.IPAddress6, found.Gateway6 = ip, sip.Spec.Gateway6
+		} else {
+			found.IPAddress, found.Gateway = ip, sip.Spec.Gateway
+		}
+		owned[ip] = ownerPod
+	}
+	if (hasV4 && found.IPAddress == "") || (hasV6 && found.IPAddress6 == "") {
+		return nil, false
+	}
+	for ip, ownerPod := range owned {
+		if containerID != "" && ownerPod.ContainerID != containerID {
+			klog.Infof("pod %s changes sandbox from %s to %s", pod.Name, ownerPod.ContainerID, containerID)
+			ownerPod.ContainerID = containerID
+			ownerPod.NetNs = netns
+			ownerPod.Gateway = GatewayOf(sip, ip)
+			ownerPod.GatewayError = ""
+			changed = true
+		}
+	}
+	return found, changed
+}
+
+// allocateIP 在 sip 中为 pod 选取 IP 并标记为已占用, 只修改内存中的 sip 对象.
+func allocateIP(
+	sip *ipkv1.StaticIP,
+	pod *corev1.Pod,
+	containerID, netns string,
+) (alloc *AllocatedIP, err error) {
+	hasV4, hasV6 := ipFamilies(sip)
+	if sip.Spec.OwnerKind == "StatefulSet" {
+		alloc, err = pickOrdinalIPs(sip, pod)
+		if err != nil {
+			return nil, err
 		}
+	} else if sip.Spec.OwnerKind == "DaemonSet" {
+		alloc, err = pickNodeIPs(sip, pod)
+		if err != nil {
+			return nil, err
+		}
+	} else if pod.Annotations[util.RequestedIPAnnotation] != "" {
+		alloc, err = pickRequestedIPs(sip, pod)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		alloc, err = pickFreeIPs(sip, pod)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// 如果没找到就直接返回错误, 双栈时任意一种地址不足都不能分配.
+	if (hasV4 && alloc.IPAddress == "") || (hasV6 && alloc.IPAddress6 == "") {
+		return nil, &PoolExhaustedError{SIP: sip.Name}
 	}
-	// 如果没找到就直接返回错误.
-	if ipaddr == "" && gateway == "" {
-		return "", "", fmt.Errorf("no more IP avaliable in sip: %s", sip.Name)
+	if alloc.IPAddress != "" {
+		alloc.Gateway = sip.Spec.Gateway
+	}
+	if alloc.IPAddress6 != "" {
+		alloc.Gateway6 = sip.Spec.Gateway6
 	}
 
-	newAvaliable := []string{}
-	for _, ip := range sip.Spec.Avaliable {
-		if ip == ipaddr {
+	for _, ipaddr := range []string{alloc.IPAddress, alloc.IPAddress6} {
+		if ipaddr == "" {
 			continue
 		}
-		newAvaliable = append(newAvaliable, ip)
+		// 已被占用的 IP 只可能是同名(或同一节点上的) Pod 遗留下来的, 此时直接接管, 不需要再修改列表.
+		if sip.Status.IPMap[ipaddr] == nil {
+			sip.Status.Avaliable = removeString(sip.Status.Avaliable, ipaddr)
+			sip.Status.Used = append(sip.Status.Used, ipaddr)
+			// StatefulSet 与 DaemonSet 的 Pod 可以直接使用绑定给自己的, 仍处于冷却期的 IP.
+			delete(sip.Status.Releasing, ipaddr)
+		}
+		delete(sip.Status.Handover, ipaddr)
+		sip.Status.IPMap[ipaddr] = &crdv1.OwnerPod{
+			Namespace:   pod.Namespace,
+			Name:        pod.Name,
+			UID:         pod.UID,
+			NodeName:    pod.Spec.NodeName,
+			ContainerID: containerID,
+			NetNs:       netns,
+			Gateway:     GatewayOf(sip, ipaddr),
+		}
 	}
-	sip.Spec.Avaliable = newAvaliable
-	sip.Spec.Used = append(sip.Spec.Used, ipaddr)
-	sip.Spec.Ratio = fmt.Sprintf("%d/%d", len(sip.Spec.Used), len(sip.Spec.IPMap))
+	return
+}
 
-	_, err = h.crdClient.IpkeeperV1().StaticIPs(sip.Namespace).Update(sip)
+// pickOrdinalIPs 按 StatefulSet Pod 名称中的序号选取 IP, 每种地址族各一个, 优先级如下:
+// 1. 该序号之前绑定过的 IP(OrdinalBindings);
+// 2. 同名 Pod 正在占用的 IP(绑定记录出现之前分配的 IP);
+// 3. IP 池中(按声明顺序)该地址族的第 N 个 IP, 如果它没有被绑定给其他序号;
+// 4. 其他未绑定给任何序号的空闲 IP.
+// 选取结果会记录到 sip 的 OrdinalBindings 中, 由调用者负责写回, 这样 Pod 重启或被重新调度后 IP 保持不变,
+// 从 IP 池中移除某个 IP 也不会改变其他序号的 IP.
+// 没有未绑定的空闲 IP 时, Pod 会一直处于 ContainerCreating 状态, 直到 IP 池被扩充或 replicas 被缩减.
+func pickOrdinalIPs(sip *ipkv1.StaticIP, pod *corev1.Pod) (alloc *AllocatedIP, err error) {
+	ordinal, err := podOrdinal(pod)
+	if err != nil {
+		return nil, err
+	}
+	key := strconv.Itoa(ordinal)
+	ips, err := ParseIPPool(sip.Spec.IPPool)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to occupy one IP from sip: %s", sip.Name)
+		return nil, err
+	}
+	// reserved 中是已绑定给其他序号, 或被其他 Pod 占用的 IP.
+	reserved := map[string]bool{}
+	for other, ordinalIPs := range sip.Status.OrdinalBindings {
+		if other == key {
+			continue
+		}
+		for _, ip := range ordinalIPs {
+			reserved[ip] = true
+		}
+	}
+	// StatefulSet 保证同一时刻只有一个同名 Pod, 所以同名 Pod 占用的 IP 可以直接接管.
+	for ip, ownerPod := range sip.Status.IPMap {
+		if ownerPod != nil && ownerPod.Name != pod.Name {
+			reserved[ip] = true
+		}
+	}
+
+	alloc = &AllocatedIP{}
+	for _, v6 := range []bool{false, true} {
+		familyIPs := []string{}
+		for _, ip := range ips {
+			if isIPv6(ip) == v6 {
+				familyIPs = append(familyIPs, ip)
+			}
+		}
+		if len(familyIPs) == 0 {
+			continue
+		}
+		var chosen string
+		for _, ip := range sip.Status.OrdinalBindings[key] {
+			if isIPv6(ip) != v6 {
+				continue
+			}
+			if ownerPod := sip.Status.IPMap[ip]; ownerPod != nil && ownerPod.Name != pod.Name {
+				return nil, fmt.Errorf("ip %s of pod %s is occupied by %s", ip, pod.Name, ownerPod.Name)
+			}
+			if _, ok := sip.Status.IPMap[ip]; ok {
+				chosen = ip
+				break
+			}
+		}
+		if chosen == "" {
+			for _, ip := range familyIPs {
+				if ownerPod := sip.Status.IPMap[ip]; ownerPod != nil && ownerPod.Name == pod.Name && !reserved[ip] {
+					chosen = ip
+					break
+				}
+			}
+		}
+		if chosen == "" && ordinal < len(familyIPs) {
+			if ip := familyIPs[ordinal]; !reserved[ip] && !isReleasing(sip, ip) {
+				chosen = ip
+			}
+		}
+		if chosen == "" {
+			for _, ip := range familyIPs {
+				if !reserved[ip] && sip.Status.IPMap[ip] == nil && !isReleasing(sip, ip) {
+					chosen = ip
+					break
+				}
+			}
+		}
+		if chosen == "" {
+			return nil, fmt.Errorf("no unbound ip in sip %s for ordinal %d of pod %s", sip.Name, ordinal, pod.Name)
+		}
+		if v6 {
+			alloc.IPAddress6 = chosen
+		} else {
+			alloc.IPAddress = chosen
+		}
+	}
+
+	if sip.Status.OrdinalBindings == nil {
+		sip.Status.OrdinalBindings = map[string][]string{}
+	}
+	bound := []string{}
+	for _, ip := range []string{alloc.IPAddress, alloc.IPAddress6} {
+		if ip != "" {
+			bound = append(bound, ip)
+		}
+	}
+	if len(bound) != 0 {
+		sip.Status.OrdinalBindings[key] = bound
+	}
+	return
+}
+
+// podOrdinal 解析 StatefulSet Pod 名称中的序号, 如 web-3 的序号为 3.
+func podOrdinal(pod *corev1.Pod) (ordinal int, err error) {
+	idx := strings.LastIndex(pod.Name, "-")
+	if idx == -1 {
+		return 0, fmt.Errorf("pod %s doesn't have an ordinal", pod.Name)
+	}
+	ordinal, err = strconv.Atoi(pod.Name[idx+1:])
+	if err != nil || ordinal < 0 {
+		return 0, fmt.Errorf("pod %s doesn't have an ordinal", pod.Name)
 	}
 	return
 }
 
-// ReleaseIP ...
+// ReleaseIP 释放 pod 在 sip 中占用的 IP, 双栈时两个地址会一同释放.
+// 与 AccquireIP() 相同, 遇到冲突时会基于最新的 sip 重试, 传入的 sip 对象本身不会被修改.
+// pod 没有占用 IP 时什么也不做, 因此可以重复调用.
+// @param containerID: 不为空时只释放该 sandbox 申请的 IP, 避免旧 sandbox 的 DEL 请求
+// 释放了同一 Pod 新 sandbox 正在使用的 IP; 为空时释放 pod 占用的所有 IP.
+// @return released: 实际释放的 IP, 供调用者记录事件.
 func (h *Helper) ReleaseIP(
 	sip *ipkv1.StaticIP,
 	pod *corev1.Pod,
-) (err error) {
-	var podIP string
+	containerID string,
+) (released []string, err error) {
+	result, err := mutateStatus(h.crdClient, sip, func(latest *ipkv1.StaticIP) (bool, error) {
+		released = releaseIP(latest, pod, containerID)
+		return len(released) != 0, nil
+	})
+	if err != nil {
+		klog.Errorf("failed to release one IP to sip %s: %s", sip.Name, err)
+		return nil, err
+	}
+	// owner 的 IP 池注解已被移除时, 最后一个 IP 被释放后删除 StaticIP.
+	if result != nil {
+		if err := h.deleteIfRetired(result); err != nil {
+			klog.Warningf("failed to delete retired staticip %s: %s", sip.Name, err)
+		}
+	}
+	return
+}
+
+// releaseIP 释放 pod 在 sip 中占用的 IP, 只修改内存中的 sip 对象.
+// 返回被释放的 IP, pod 没有占用任何 IP 时为空.
+func releaseIP(sip *ipkv1.StaticIP, pod *corev1.Pod, containerID string) (podIPs []string) {
+	podIPs = []string{}
 	/*
 		// pod.Status.PodIP 是没有掩码位的, 所以不能这么用.
 		podIP = pod.Status.PodIP
-		_, ok := sip.Spec.IPMap[podIP]
+		_, ok := sip.Status.IPMap[podIP]
 		if !ok {
 			klog.Warningf("get a ip that not belong to it: %s", podIP)
 			return
 		}
 	*/
-	for ip, ownerPod := range sip.Spec.IPMap {
+	for ip, ownerPod := range sip.Status.IPMap {
 		if ownerPod == nil {
 			continue
 		}
-		if ownerPod.UID == pod.UID {
-			podIP = ip
-			break
+		if ownerPod.UID != pod.UID {
+			continue
+		}
+		if containerID != "" && ownerPod.ContainerID != "" && ownerPod.ContainerID != containerID {
+			continue
+		}
+		podIPs = append(podIPs, ip)
+	}
+	// IP 池缩小后等待驱逐(或等待被替换)的 Pod, 其 IP 已经不在 IPMap 中了.
+	evicted := append(releaseEvicting(sip, pod, containerID), releaseDraining(sip, pod, containerID)...)
+	if len(podIPs) == 0 {
+		if len(evicted) == 0 {
+			klog.Warningf("the pod: %s has an ip that not belong to it's staticip", pod.Name)
 		}
+		return evicted
 	}
-	if podIP == "" {
-		klog.Warningf("the pod: %s has an ip that not belong to it's staticip", pod.Name)
-		return
+	markReleased(sip, podIPs)
+	return append(podIPs, evicted...)
+}
+
+// markReleased 将 ips 标记为已释放, 设置了冷却时间时先进入 Releasing, 否则直接放回 Avaliable.
+func markReleased(sip *ipkv1.StaticIP, ips []string) {
+	if sip.Status.LastReleased == nil {
+		sip.Status.LastReleased = map[string]metav1.Time{}
 	}
-	newUsed := []string{}
-	for _, ip := range sip.Spec.Used {
-		if ip == podIP {
-			continue
+	// 设置了冷却时间时, IP 先进入 Releasing, 冷却结束后才由 controller 移回 Avaliable.
+	cooldown, _ := ParseReleaseCooldown(sip.Spec.ReleaseCooldown)
+	if cooldown > 0 && sip.Status.Releasing == nil {
+		sip.Status.Releasing = map[string]metav1.Time{}
+	}
+	now := metav1.Now()
+	for _, ip := range ips {
+		sip.Status.Used = removeString(sip.Status.Used, ip)
+		sip.Status.IPMap[ip] = nil
+		sip.Status.LastReleased[ip] = now
+		if cooldown > 0 {
+			sip.Status.Releasing[ip] = now
+		} else {
+			sip.Status.Avaliable = append(sip.Status.Avaliable, ip)
 		}
-		newUsed = append(newUsed, ip)
 	}
-	sip.Spec.Used = newUsed
-	sip.Spec.Avaliable = append(sip.Spec.Avaliable, podIP)
-	sip.Spec.IPMap[podIP] = nil
-	sip.Spec.Ratio = fmt.Sprintf("%d/%d", len(sip.Spec.Used), len(sip.Spec.IPMap))
-	_, err = h.crdClient.IpkeeperV1().StaticIPs(sip.Namespace).Update(sip)
-	if err != nil {
-		klog.Errorf("failed to occupy one IP from sip: %s", sip.Name)
-		return
+}
+
+// ipFamilies 判断 sip 的 IP 池中是否包含 IPv4 与 IPv6 地址.
+func ipFamilies(sip *ipkv1.StaticIP) (hasV4, hasV6 bool) {
+	for ip := range sip.Status.IPMap {
+		if isIPv6(ip) {
+			hasV6 = true
+		} else {
+			hasV4 = true
+		}
+	}
+	return
+}
+
+// PoolSize 返回 sip 的 IP 池能够容纳的 Pod 数量, 双栈时取两种地址中较少的那个.
+func PoolSize(sip *ipkv1.StaticIP) (size int) {
+	v4Num, v6Num := 0, 0
+	for ip := range sip.Status.IPMap {
+		if isIPv6(ip) {
+			v6Num++
+		} else {
+			v4Num++
+		}
+	}
+	if v4Num == 0 || (v6Num != 0 && v6Num < v4Num) {
+		return v6Num
+	}
+	return v4Num
+}
+
+// removeString 返回移除了 target 之后的新列表.
+func removeString(list []string, target string) (result []string) {
+	result = []string{}
+	for _, item := range list {
+		if item == target {
+			continue
+		}
+		result = append(result, item)
 	}
 	return
 }
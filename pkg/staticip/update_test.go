@@ -0,0 +1,302 @@
+package staticip
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apimmetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	cgtesting "k8s.io/client-go/testing"
+
+	ipkv1 "github.com/generals-space/crd-ipkeeper/pkg/apis/ipkeeper/v1"
+	crdfake "github.com/generals-space/crd-ipkeeper/pkg/client/clientset/versioned/fake"
+)
+
+// newConflictingClient 创建带有一个 StaticIP 的 fake clientset.
+// fake clientset 本身不检查 resourceVersion, 这里添加 reactor 模拟 apiserver 的乐观锁:
+// 只有 resourceVersion 与当前对象一致时才能更新成功, 否则返回 Conflict.
+func newConflictingClient(sip *ipkv1.StaticIP) *crdfake.Clientset {
+	client := crdfake.NewSimpleClientset(sip)
+	gvr := ipkv1.SchemeGroupVersion.WithResource("staticips")
+	var lock sync.Mutex
+	version := 1
+	client.PrependReactor("update", "staticips", func(action cgtesting.Action) (bool, runtime.Object, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		obj := action.(cgtesting.UpdateAction).GetObject().(*ipkv1.StaticIP).DeepCopy()
+		current, err := client.Tracker().Get(gvr, obj.Namespace, obj.Name)
+		if err != nil {
+			return true, nil, err
+		}
+		if current.(*ipkv1.StaticIP).ResourceVersion != obj.ResourceVersion {
+			return true, nil, apierrors.NewConflict(
+				ipkv1.Resource("staticips"), obj.Name, fmt.Errorf("resourceVersion %s is stale", obj.ResourceVersion),
+			)
+		}
+		version++
+		obj.ResourceVersion = strconv.Itoa(version)
+		return true, obj, client.Tracker().Update(gvr, obj, obj.Namespace)
+	})
+	return client
+}
+
+func newTestStaticIP(t *testing.T, pool string) *ipkv1.StaticIP {
+	h := &Helper{}
+	sip := &ipkv1.StaticIP{
+		ObjectMeta: apimmetav1.ObjectMeta{
+			Name:            "deploy-test",
+			Namespace:       "default",
+			ResourceVersion: "1",
+		},
+		Spec: ipkv1.StaticIPSpec{
+			Namespace: "default",
+			OwnerKind: "Deployment",
+			IPPool:    pool,
+			Gateway:   "172.16.0.254",
+		},
+	}
+	var err error
+	sip.Status.Avaliable, sip.Status.IPMap, err = h.InitIPMap(pool)
+	if err != nil {
+		t.Fatalf("failed to init ip map: %s", err)
+	}
+	sip.Status.Used = []string{}
+	return sip
+}
+
+func newTestPod(i int) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: apimmetav1.ObjectMeta{
+			Name:      fmt.Sprintf("test-%d", i),
+			Namespace: "default",
+			UID:       types.UID(fmt.Sprintf("uid-%d", i)),
+		},
+	}
+}
+
+// TestConcurrentAccquireIP 多个 Pod 基于同一个(过期的) StaticIP 对象同时申请 IP,
+// 每个 Pod 都应该成功分配到 IP, 且不会有两个 Pod 得到同一个 IP.
+func TestConcurrentAccquireIP(t *testing.T) {
+	const podNum = 40
+	sip := newTestStaticIP(t, "172.16.0.1-172.16.0.50/24")
+	client := newConflictingClient(sip)
+	h := &Helper{crdClient: client}
+
+	var wg sync.WaitGroup
+	allocs := make([]*AllocatedIP, podNum)
+	errs := make([]error, podNum)
+	for i := 0; i < podNum; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			allocs[i], errs[i] = h.AccquireIP(sip, newTestPod(i), "", "")
+		}(i)
+	}
+	wg.Wait()
+
+	latest, err := client.IpkeeperV1().StaticIPs(sip.Namespace).Get(sip.Name, apimmetav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get sip: %s", err)
+	}
+	owners := map[string]int{}
+	for i := 0; i < podNum; i++ {
+		if errs[i] != nil {
+			t.Fatalf("pod %d failed to accquire ip: %s", i, errs[i])
+		}
+		ip := allocs[i].IPAddress
+		if other, ok := owners[ip]; ok {
+			t.Fatalf("ip %s is handed out to both pod %d and pod %d", ip, other, i)
+		}
+		owners[ip] = i
+		ownerPod := latest.Status.IPMap[ip]
+		if ownerPod == nil || ownerPod.Name != newTestPod(i).Name {
+			t.Fatalf("ip %s of pod %d is not recorded in sip: %+v", ip, i, ownerPod)
+		}
+	}
+	if len(latest.Status.Used) != podNum || len(latest.Status.Avaliable) != 50-podNum {
+		t.Fatalf("unexpected used/avaliable: %d/%d", len(latest.Status.Used), len(latest.Status.Avaliable))
+	}
+	// 传入的 sip 对象不应被修改.
+	if len(sip.Status.Used) != 0 {
+		t.Fatalf("the given sip is modified: %v", sip.Status.Used)
+	}
+}
+
+// TestConcurrentReleaseIP 一部分 Pod 释放 IP 的同时另一部分 Pod 申请 IP, 最终状态应当一致.
+func TestConcurrentReleaseIP(t *testing.T) {
+	const podNum = 20
+	// 申请可能先于释放完成, 所以 IP 池需要能同时容纳新旧两批 Pod.
+	sip := newTestStaticIP(t, "172.16.0.1-172.16.0.40/24")
+	client := newConflictingClient(sip)
+	h := &Helper{crdClient: client}
+
+	for i := 0; i < podNum; i++ {
+		if _, err := h.AccquireIP(sip, newTestPod(i), "", ""); err != nil {
+			t.Fatalf("pod %d failed to accquire ip: %s", i, err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	allocs := make([]*AllocatedIP, podNum)
+	errs := make([]error, 2*podNum)
+	for i := 0; i < podNum; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = h.ReleaseIP(sip, newTestPod(i), "")
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			allocs[i], errs[podNum+i] = h.AccquireIP(sip, newTestPod(podNum+i), "", "")
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("operation %d failed: %s", i, err)
+		}
+	}
+	latest, err := client.IpkeeperV1().StaticIPs(sip.Namespace).Get(sip.Name, apimmetav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get sip: %s", err)
+	}
+	owners := map[string]string{}
+	for ip, ownerPod := range latest.Status.IPMap {
+		if ownerPod == nil {
+			continue
+		}
+		owners[ownerPod.Name] = ip
+	}
+	if len(owners) != podNum || len(latest.Status.Used) != podNum {
+		t.Fatalf("expect %d ips in use, got %d(%d)", podNum, len(owners), len(latest.Status.Used))
+	}
+	for i, alloc := range allocs {
+		if owners[newTestPod(podNum+i).Name] != alloc.IPAddress {
+			t.Fatalf("ip %s of pod %d is not recorded in sip", alloc.IPAddress, podNum+i)
+		}
+	}
+}
+
+// TestAccquireIPIdempotent 同一 sandbox 重复 ADD 时返回相同的 IP, 旧 sandbox 的 DEL 不会释放新 sandbox 的 IP.
+func TestAccquireIPIdempotent(t *testing.T) {
+	sip := newTestStaticIP(t, "172.16.0.1-172.16.0.10/24")
+	client := newConflictingClient(sip)
+	h := &Helper{crdClient: client}
+	pod := newTestPod(0)
+
+	first, err := h.AccquireIP(sip, pod, "sandbox-1", "")
+	if err != nil {
+		t.Fatalf("failed to accquire ip: %s", err)
+	}
+	second, err := h.AccquireIP(sip, pod, "sandbox-1", "")
+	if err != nil {
+		t.Fatalf("failed to accquire ip again: %s", err)
+	}
+	if *first != *second {
+		t.Fatalf("repeated ADD returns a different ip: %+v, %+v", first, second)
+	}
+	// sandbox 重建后沿用原来的 IP.
+	third, err := h.AccquireIP(sip, pod, "sandbox-2", "")
+	if err != nil || *third != *first {
+		t.Fatalf("new sandbox gets ip %+v, err: %v", third, err)
+	}
+	if _, err = h.ReleaseIP(sip, pod, "sandbox-1"); err != nil {
+		t.Fatalf("failed to release ip: %s", err)
+	}
+	latest, err := client.IpkeeperV1().StaticIPs(sip.Namespace).Get(sip.Name, apimmetav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get sip: %s", err)
+	}
+	ownerPod := latest.Status.IPMap[first.IPAddress]
+	if ownerPod == nil || ownerPod.ContainerID != "sandbox-2" || len(latest.Status.Used) != 1 {
+		t.Fatalf("unexpected owner of ip %s: %+v", first.IPAddress, ownerPod)
+	}
+}
+
+// TestRenewStaticIPStale IP 池变化时传入的 StaticIP 已经过期(期间有 Pod 分配了 IP),
+// 更新后仍应保留这次分配, 且新增的 IP 可以分配.
+func TestRenewStaticIPStale(t *testing.T) {
+	oldSIP := newTestStaticIP(t, "172.16.0.1-172.16.0.3/24")
+	client := newConflictingClient(oldSIP)
+	h := &Helper{crdClient: client}
+	alloc, err := h.AccquireIP(oldSIP, newTestPod(0), "", "")
+	if err != nil {
+		t.Fatalf("failed to accquire ip: %s", err)
+	}
+
+	newSIP := newTestStaticIP(t, "172.16.0.1-172.16.0.4/24")
+	if _, err = RenewStaticIP(client, oldSIP, newSIP); err != nil {
+		t.Fatalf("failed to renew staticip: %s", err)
+	}
+	latest, err := client.IpkeeperV1().StaticIPs(oldSIP.Namespace).Get(oldSIP.Name, apimmetav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get sip: %s", err)
+	}
+	if latest.Spec.IPPool != "172.16.0.1-172.16.0.4/24" {
+		t.Errorf("spec is not updated: %s", latest.Spec.IPPool)
+	}
+	if ownerPod := latest.Status.IPMap[alloc.IPAddress]; ownerPod == nil || ownerPod.Name != "test-0" {
+		t.Errorf("allocation of test-0 is lost: %+v", latest.Status.IPMap)
+	}
+	if len(latest.Status.Used) != 1 || len(latest.Status.Avaliable) != 3 {
+		t.Errorf("unexpected used/avaliable: %v/%v", latest.Status.Used, latest.Status.Avaliable)
+	}
+	if oldSIP.ResourceVersion != latest.ResourceVersion {
+		t.Errorf("the given sip is not refreshed")
+	}
+}
+
+// TestPickOrdinalIPsAfterRemoval 从 StatefulSet 的 IP 池中移除中间的 IP 后, 其他序号的 IP 保持不变,
+// 新的序号使用下一个未绑定的 IP.
+func TestPickOrdinalIPsAfterRemoval(t *testing.T) {
+	oldSIP := newTestStaticIP(t, "172.16.0.1-172.16.0.3/24")
+	oldSIP.Spec.OwnerKind = "StatefulSet"
+	for i := 0; i < 3; i++ {
+		pod := newTestPod(i)
+		alloc, err := pickOrdinalIPs(oldSIP, pod)
+		if err != nil {
+			t.Fatalf("failed to pick ip for pod %d: %s", i, err)
+		}
+		oldSIP.Status.IPMap[alloc.IPAddress] = &ipkv1.OwnerPod{Namespace: pod.Namespace, Name: pod.Name, UID: pod.UID}
+		oldSIP.Status.Avaliable = removeString(oldSIP.Status.Avaliable, alloc.IPAddress)
+		oldSIP.Status.Used = append(oldSIP.Status.Used, alloc.IPAddress)
+	}
+	// test-1 退出后移除 172.16.0.2.
+	oldSIP.Status.IPMap["172.16.0.2/24"] = nil
+	oldSIP.Status.Used = removeString(oldSIP.Status.Used, "172.16.0.2/24")
+	newSIP := newTestStaticIP(t, "172.16.0.1/24,172.16.0.3/24,172.16.0.4/24")
+	newSIP.Spec.OwnerKind = "StatefulSet"
+	sip := renewStaticIP(oldSIP, newSIP)
+
+	tests := []struct {
+		pod      int
+		expected string
+	}{
+		// 172.16.0.3 已经绑定给了序号 2, 即使按位置它是池中的第 2 个 IP.
+		{2, "172.16.0.3/24"},
+		{0, "172.16.0.1/24"},
+		{1, "172.16.0.4/24"},
+	}
+	for _, test := range tests {
+		// 序号 2 的 Pod 被重建, 不再占用 IP.
+		if test.pod == 2 {
+			sip.Status.IPMap["172.16.0.3/24"] = nil
+		}
+		alloc, err := pickOrdinalIPs(sip, newTestPod(test.pod))
+		if err != nil {
+			t.Fatalf("failed to pick ip for pod %d: %s", test.pod, err)
+		}
+		if alloc.IPAddress != test.expected {
+			t.Errorf("expected pod %d to get %s, got %s", test.pod, test.expected, alloc.IPAddress)
+		}
+	}
+	if _, err := pickOrdinalIPs(sip, newTestPod(3)); err == nil {
+		t.Errorf("expected pod 3 to get no ip from a full pool")
+	}
+}
@@ -0,0 +1,213 @@
+package staticip
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	apimmetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	ipkv1 "github.com/generals-space/crd-ipkeeper/pkg/apis/ipkeeper/v1"
+	crdLister "github.com/generals-space/crd-ipkeeper/pkg/client/listers/ipkeeper/v1"
+	"github.com/generals-space/crd-ipkeeper/pkg/util"
+)
+
+// 这里的函数供 admission webhook 使用, 解析部分与运行时共用 ParseIPPool() 等函数,
+// 保证 webhook 放行的注解在分配 IP 时同样能够被正确解析.
+
+// ValidateIPPool 校验 IP 池与网关, 返回解析得到的 "ip/掩码" 形式的 IP 列表.
+// 1. IP 池与网关的格式合法;
+// 2. IP 池中没有重复的 IP;
+// 3. 池中每种地址族都有对应的网关, 且网关处于该 IP 所在的网段中, 但本身不在池中.
+func ValidateIPPool(poolStr, gatewayStr string) (ips []string, err error) {
+	ips, dups, err := parseIPPool(poolStr)
+	if err != nil {
+		return nil, err
+	}
+	if len(dups) != 0 {
+		return nil, fmt.Errorf("duplicate IPs in pool: %v", dups)
+	}
+	gateway, gateway6, err := ParseGateways(gatewayStr)
+	if err != nil {
+		return nil, err
+	}
+	for _, ipStr := range ips {
+		ip, subnet, _ := net.ParseCIDR(ipStr)
+		gwStr := gateway
+		if isIPv6(ipStr) {
+			gwStr = gateway6
+		}
+		if gwStr == "" {
+			return nil, fmt.Errorf("no gateway of the same ip family for %s", ipStr)
+		}
+		gw := net.ParseIP(gwStr)
+		if !subnet.Contains(gw) {
+			return nil, fmt.Errorf("gateway %s is not in the subnet %s of %s", gwStr, subnet, ipStr)
+		}
+		if gw.Equal(ip) {
+			return nil, fmt.Errorf("gateway %s can not be in the ip pool", gwStr)
+		}
+	}
+	return ips, nil
+}
+
+// UseStaticIPLister 设置 h.CheckOverlap() 使用的 lister, 未设置时直接请求 apiserver.
+// caller: pkg/webhook/server.go -> NewWebhookServer()
+func (h *Helper) UseStaticIPLister(sipLister crdLister.StaticIPLister) {
+	h.sipLister = sipLister
+}
+
+// CheckOverlap 检查 ips 中是否存在已属于其他 StaticIP 的 IP.
+// namespace/name 为 ips 所属的 StaticIP, 校验时会跳过ta自身, 其不存在时也没有影响.
+func (h *Helper) CheckOverlap(namespace, name string, ips []string) (err error) {
+	sips := []ipkv1.StaticIP{}
+	if h.sipLister != nil {
+		cached, err := h.sipLister.List(labels.Everything())
+		if err != nil {
+			return fmt.Errorf("failed to list staticips: %s", err)
+		}
+		for _, sip := range cached {
+			sips = append(sips, *sip)
+		}
+	} else {
+		sipList, err := h.crdClient.IpkeeperV1().StaticIPs("").List(apimmetav1.ListOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to list staticips: %s", err)
+		}
+		sips = sipList.Items
+	}
+	conflicts := overlapIPs(sips, namespace, name, ips)
+	if len(conflicts) != 0 {
+		return fmt.Errorf("IPs already owned by other staticip: %v", conflicts)
+	}
+	return nil
+}
+
+// overlapIPs 返回 ips 中已经出现在 sipList 其他 StaticIP 的 IPMap 中的 IP.
+// 比较时忽略掩码, 同一个 IP 即使掩码不同也算作冲突.
+// caller: h.CheckOverlap(), checkConflict()
+func overlapIPs(sipList []ipkv1.StaticIP, namespace, name string, ips []string) (conflicts []string) {
+	conflicts = []string{}
+	wanted := map[string]bool{}
+	for _, ip := range ips {
+		wanted[trimPrefixLen(ip)] = true
+	}
+	for _, other := range sipList {
+		if other.Namespace == namespace && other.Name == name {
+			continue
+		}
+		for ip := range other.Status.IPMap {
+			if wanted[trimPrefixLen(ip)] {
+				conflicts = append(conflicts, fmt.Sprintf("%s(%s/%s)", ip, other.Namespace, other.Name))
+			}
+		}
+	}
+	return
+}
+
+// trimPrefixLen 移除 "ip/掩码" 中的掩码部分.
+func trimPrefixLen(ipStr string) string {
+	if idx := strings.Index(ipStr, "/"); idx != -1 {
+		return ipStr[:idx]
+	}
+	return ipStr
+}
+
+// ValidateStaticIP 校验 StaticIP 对象的 IP 池, 网关, 以及是否与其他 StaticIP 冲突.
+func (h *Helper) ValidateStaticIP(sip *ipkv1.StaticIP) (err error) {
+	gateways := []string{}
+	for _, gw := range []string{sip.Spec.Gateway, sip.Spec.Gateway6} {
+		if gw != "" {
+			gateways = append(gateways, gw)
+		}
+	}
+	if _, err = GetStrategy(sip.Spec.Strategy); err != nil {
+		return err
+	}
+	if _, err = ParseReleaseCooldown(sip.Spec.ReleaseCooldown); err != nil {
+		return err
+	}
+	if err = ValidateShrinkPolicy(sip.Spec.ShrinkPolicy); err != nil {
+		return err
+	}
+	ips, err := ValidateIPPool(sip.Spec.IPPool, strings.Join(gateways, ","))
+	if err != nil {
+		return err
+	}
+	return h.CheckOverlap(sip.Namespace, sip.Name, ips)
+}
+
+// CheckUnknownAnnotations 拒绝带有 ipkeeper 前缀但不在 util.KnownAnnotations 中的注解, 以便尽早发现拼写错误.
+// 只在资源创建时检查, 以免已经存在的资源因为带有这样的注解而无法再更新.
+func CheckUnknownAnnotations(annotations map[string]string) (err error) {
+	for key := range annotations {
+		if strings.HasPrefix(key, util.AnnotationPrefix) && !util.KnownAnnotations[key] {
+			return fmt.Errorf("unknown annotation %s", key)
+		}
+	}
+	return nil
+}
+
+// ValidateOwner 校验 Pod, Deployment 等资源上的 ipkeeper 注解.
+// 没有任何 ipkeeper 注解的资源直接放行.
+// @param ownerKind: Pod, Deployment, StatefulSet, DaemonSet 等
+func (h *Helper) ValidateOwner(owner apimmetav1.Object, ownerKind string) (err error) {
+	annotations := owner.GetAnnotations()
+	if _, err = GetStrategy(annotations[util.StrategyAnnotation]); err != nil {
+		return err
+	}
+	if _, err = ParseReleaseCooldown(annotations[util.ReleaseCooldownAnnotation]); err != nil {
+		return err
+	}
+	if err = ValidateShrinkPolicy(annotations[util.ShrinkPolicyAnnotation]); err != nil {
+		return err
+	}
+
+	if poolName := annotations[util.PoolNameAnnotation]; poolName != "" {
+		_, err = h.crdClient.IpkeeperV1().IPPools().Get(poolName, apimmetav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to get ippool %s: %s", poolName, err)
+		}
+		_, err = h.getPoolSize(owner, ownerKind)
+		return err
+	}
+
+	poolKey := util.IPPoolAnnotation
+	if ownerKind == "Pod" {
+		poolKey = util.IPAddressAnnotation
+	}
+	poolStr := annotations[poolKey]
+	gatewayStr := annotations[util.GatewayAnnotation]
+	if poolStr == "" && gatewayStr == "" {
+		return nil
+	}
+	if poolStr == "" {
+		return fmt.Errorf("annotation %s requires %s", util.GatewayAnnotation, poolKey)
+	}
+	if gatewayStr == "" {
+		return fmt.Errorf("annotation %s requires %s", poolKey, util.GatewayAnnotation)
+	}
+	if HasLargeSubnet(poolStr) {
+		_, gateway6, err := ParseGateways(gatewayStr)
+		if err != nil {
+			return err
+		}
+		poolStr, err = h.expandLargeSubnets(owner, ownerKind, poolStr, gateway6)
+		if err != nil {
+			return err
+		}
+	}
+	ips, err := ValidateIPPool(poolStr, gatewayStr)
+	if err != nil {
+		return err
+	}
+	if ownerKind == "DaemonSet" {
+		_, err = ResolveNodeIPs(annotations[util.NodeIPsAnnotation], ips)
+		if err != nil {
+			return err
+		}
+	}
+	sipName := h.generateSIPName(ownerKind, owner.GetName())
+	return h.CheckOverlap(owner.GetNamespace(), sipName, ips)
+}
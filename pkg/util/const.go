@@ -6,7 +6,93 @@ const (
 	IPAddressAnnotation  = "ipkeeper.generals.space/ip_address"
 	// GatewayAnnotation 点分十进制+掩码字符串, 如`192.168.0.254`
 	// 必须处于IPAddressAnnotation所指的网络中.
+	// 双栈时以逗号分隔 IPv4 与 IPv6 网关, 如`192.168.0.254,fd00::1`.
 	GatewayAnnotation    = "ipkeeper.generals.space/gateway"
 	// IPPoolAnnotation deployment,daemonset,
 	IPPoolAnnotation     = "ipkeeper.generals.space/ip_pool"
+	// PoolNameAnnotation 引用的集群级别 IPPool 资源名称, 可代替 ip_pool 与 gateway 注解,
+	// IP 列表与网关都由 IPPool 划分得到.
+	PoolNameAnnotation   = "ipkeeper.generals.space/pool_name"
+	// PoolSizeAnnotation 从 IPPool 中划分的 IP 数量, 不指定时与 Deployment 的 replicas 相同.
+	PoolSizeAnnotation   = "ipkeeper.generals.space/pool_size"
+	// NodeIPsAnnotation 仅用于 DaemonSet, 显式声明各节点使用的 IP,
+	// 如`node1=192.168.0.10,node2=192.168.0.11`, 未声明的节点按首次分配的结果绑定.
+	NodeIPsAnnotation    = "ipkeeper.generals.space/node_ips"
+	// StrategyAnnotation 从 IP 池中选取空闲 IP 的策略, 可选值为 lowest(默认), round-robin, hash,
+	// 对 StatefulSet 与 DaemonSet 无效.
+	StrategyAnnotation   = "ipkeeper.generals.space/strategy"
+	// ReleaseCooldownAnnotation 被释放的 IP 的冷却时间, 如`30s`, `5m`,
+	// 冷却期间不会分配给其他 Pod, 以免交换机, 防火墙中残留的 ARP 与会话信息造成影响.
+	ReleaseCooldownAnnotation = "ipkeeper.generals.space/release_cooldown"
+	// RequestedIPAnnotation 仅用于 Pod, 从其 owner 的 IP 池中申请指定的 IP, 如`192.168.0.10`,
+	// 双栈时以逗号分隔. 该 IP 被占用时 Pod 无法创建, 而不会分配其他 IP.
+	RequestedIPAnnotation = "ipkeeper.generals.space/requested_ip"
+	// AdoptPodsAnnotation 仅用于 Deployment, 值为`true`时, 为已经运行的 Deployment 添加 IP 池注解后,
+	// controller 会逐个驱逐没有固定 IP 的 Pod, 使重建后的 Pod 获得固定 IP.
+	AdoptPodsAnnotation = "ipkeeper.generals.space/adopt_pods"
+	// ShrinkPolicyAnnotation 仅用于 Deployment, IP 池缩小后如何处理占用了被移除的 IP 的 Pod,
+	// 可选值为 evict(默认, 逐个驱逐), drain(保留到 Pod 被自然替换为止).
+	ShrinkPolicyAnnotation = "ipkeeper.generals.space/shrink_policy"
 )
+
+// StaticIPFinalizer StaticIP 的 finalizer, 占用其 IP 的 Pod 全部退出后才会被 controller 移除.
+const StaticIPFinalizer = "ipkeeper.generals.space/release-ips"
+
+// AnnotationPrefix 本工程所有注解的公共前缀.
+const AnnotationPrefix = "ipkeeper.generals.space/"
+
+// KnownAnnotations 所有合法的注解, admission webhook 在资源创建时会拒绝带有此前缀但不在此列表中的注解,
+// 以便尽早发现注解名称的拼写错误. 新增注解时需要同步添加到这里.
+var KnownAnnotations = map[string]bool{
+	IPAddressAnnotation:       true,
+	GatewayAnnotation:         true,
+	IPPoolAnnotation:          true,
+	PoolNameAnnotation:        true,
+	PoolSizeAnnotation:        true,
+	NodeIPsAnnotation:         true,
+	StrategyAnnotation:        true,
+	ReleaseCooldownAnnotation: true,
+	RequestedIPAnnotation:     true,
+	AdoptPodsAnnotation:       true,
+	ShrinkPolicyAnnotation:    true,
+}
+
+// 记录到 Deployment, Pod 等资源上的 Event 的 Reason 字段.
+const (
+	// EventInvalidIPPool IP 池注解格式错误
+	EventInvalidIPPool = "InvalidIPPool"
+	// EventPoolTooSmall IP 池小于 StatefulSet 的 replicas, 序号超出范围的 Pod 无法分配 IP,
+	// 或是小于 Deployment 的 replicas + maxSurge, 滚动更新时新 Pod 无法分配 IP
+	EventPoolTooSmall = "PoolTooSmall"
+	// EventRequestedIPUnavailable Pod 通过 requested_ip 注解申请的 IP 不在 IP 池中或已被占用
+	EventRequestedIPUnavailable = "RequestedIPUnavailable"
+	// EventIPReclaimed controller 回收了被已经不存在的 Pod 占用的 IP
+	EventIPReclaimed = "IPReclaimed"
+	// EventPoolExhausted IP 池中没有空闲的 IP, Pod 无法创建
+	EventPoolExhausted = "PoolExhausted"
+	// EventAddressAssigned 为 Pod 分配了 IP
+	EventAddressAssigned = "AddressAssigned"
+	// EventAddressReleased Pod 退出后释放了 IP
+	EventAddressReleased = "AddressReleased"
+	// EventPoolShrunk owner 的 IP 池被缩小, 占用了被移除的 IP 的 Pod 会被驱逐重建
+	EventPoolShrunk = "PoolShrunk"
+	// EventPodAdopted 为使 Pod 获得固定 IP 而驱逐了已有的 Pod
+	EventPodAdopted = "PodAdopted"
+	// EventPodEvicted IP 池缩小后驱逐了占用被移除的 IP 的 Pod
+	EventPodEvicted = "PodEvicted"
+	// EventEvictionBlocked 驱逐占用被移除的 IP 的 Pod 时被 PodDisruptionBudget 拒绝
+	EventEvictionBlocked = "EvictionBlocked"
+	// EventGatewayUpdated 网关变化后更新了 Pod 的默认路由
+	EventGatewayUpdated = "GatewayUpdated"
+	// EventGatewayUpdateFailed 网关变化后更新 Pod 的默认路由失败
+	EventGatewayUpdateFailed = "GatewayUpdateFailed"
+)
+
+// HasIPPoolAnnotations 判断 deployment 等资源是否声明了 IP 池,
+// 即同时拥有 ip_pool 与 gateway 注解, 或是拥有 pool_name 注解.
+func HasIPPoolAnnotations(annotations map[string]string) bool {
+	if annotations[PoolNameAnnotation] != "" {
+		return true
+	}
+	return annotations[IPPoolAnnotation] != "" && annotations[GatewayAnnotation] != ""
+}
@@ -0,0 +1,156 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+
+	restful "github.com/emicklei/go-restful"
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apimmetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/klog"
+
+	ipkv1 "github.com/generals-space/crd-ipkeeper/pkg/apis/ipkeeper/v1"
+	"github.com/generals-space/crd-ipkeeper/pkg/staticip"
+)
+
+// handleValidate 处理 apiserver 发来的 AdmissionReview 请求.
+// v1 与 v1beta1 版本的 AdmissionReview 结构相同, 这里统一按 v1 解析,
+// 返回时保留请求中的 apiVersion, 这样两个版本都可以支持.
+func (s *WebhookServer) handleValidate(req *restful.Request, resp *restful.Response) {
+	review := &admissionv1.AdmissionReview{}
+	err := req.ReadEntity(review)
+	if err != nil {
+		klog.Errorf("parse admission review failed %v", err)
+		resp.WriteHeaderAndEntity(http.StatusBadRequest, err)
+		return
+	}
+	if review.Request == nil {
+		resp.WriteHeaderAndEntity(http.StatusBadRequest, "empty admission request")
+		return
+	}
+
+	response := &admissionv1.AdmissionResponse{
+		UID:     review.Request.UID,
+		Allowed: true,
+	}
+	err = s.validate(review.Request)
+	if err != nil {
+		klog.Infof(
+			"reject %s %s/%s: %s", review.Request.Kind.Kind,
+			review.Request.Namespace, review.Request.Name, err,
+		)
+		response.Allowed = false
+		response.Result = &apimmetav1.Status{
+			Status:  apimmetav1.StatusFailure,
+			Reason:  apimmetav1.StatusReasonInvalid,
+			Message: err.Error(),
+			Code:    http.StatusUnprocessableEntity,
+		}
+	}
+	review.Request = nil
+	review.Response = response
+	resp.WriteEntity(review)
+}
+
+// validate 按资源类型调用 staticip 包中的校验函数.
+func (s *WebhookServer) validate(req *admissionv1.AdmissionRequest) (err error) {
+	switch req.Kind.Kind {
+	case "StaticIP":
+		sip := &ipkv1.StaticIP{}
+		if err = json.Unmarshal(req.Object.Raw, sip); err != nil {
+			return fmt.Errorf("failed to decode staticip: %s", err)
+		}
+		if sip.Namespace == "" {
+			sip.Namespace = req.Namespace
+		}
+		// 正在删除的 StaticIP 只会被移除 finalizer, 不能因为校验失败而无法删除.
+		if sip.DeletionTimestamp != nil {
+			return nil
+		}
+		// controller 添加或移除 finalizer 等更新不会修改 spec, 不需要再做全集群的冲突检查.
+		if req.Operation == admissionv1.Update && len(req.OldObject.Raw) != 0 {
+			oldSIP := &ipkv1.StaticIP{}
+			if err = json.Unmarshal(req.OldObject.Raw, oldSIP); err != nil {
+				return fmt.Errorf("failed to decode old staticip: %s", err)
+			}
+			if reflect.DeepEqual(oldSIP.Spec, sip.Spec) {
+				return nil
+			}
+		}
+		return s.sipHelper.ValidateStaticIP(sip)
+	case "Deployment":
+		deploy := &appsv1.Deployment{}
+		if err = json.Unmarshal(req.Object.Raw, deploy); err != nil {
+			return fmt.Errorf("failed to decode deployment: %s", err)
+		}
+		if deploy.Namespace == "" {
+			deploy.Namespace = req.Namespace
+		}
+		return s.validateOwner(req, deploy, "Deployment")
+	case "StatefulSet":
+		sts := &appsv1.StatefulSet{}
+		if err = json.Unmarshal(req.Object.Raw, sts); err != nil {
+			return fmt.Errorf("failed to decode statefulset: %s", err)
+		}
+		if sts.Namespace == "" {
+			sts.Namespace = req.Namespace
+		}
+		return s.validateOwner(req, sts, "StatefulSet")
+	case "DaemonSet":
+		ds := &appsv1.DaemonSet{}
+		if err = json.Unmarshal(req.Object.Raw, ds); err != nil {
+			return fmt.Errorf("failed to decode daemonset: %s", err)
+		}
+		if ds.Namespace == "" {
+			ds.Namespace = req.Namespace
+		}
+		return s.validateOwner(req, ds, "DaemonSet")
+	case "Pod":
+		pod := &corev1.Pod{}
+		if err = json.Unmarshal(req.Object.Raw, pod); err != nil {
+			return fmt.Errorf("failed to decode pod: %s", err)
+		}
+		if pod.Namespace == "" {
+			pod.Namespace = req.Namespace
+		}
+		// 只有不属于任何 owner 的 Pod 才会使用自身的 IP 池注解, 见 Helper.GetPodOwner().
+		if len(pod.OwnerReferences) == 0 {
+			if err = s.validateOwner(req, pod, "Pod"); err != nil {
+				return err
+			}
+		}
+		return s.sipHelper.ValidateRequestedIP(pod)
+	default:
+		// CloneSet, Rollout 等通过 --owner-kinds 允许的其他资源类型.
+		if !s.sipHelper.OwnerKindAllowed(req.Kind.Kind) {
+			return nil
+		}
+		owner := &unstructured.Unstructured{}
+		if err = json.Unmarshal(req.Object.Raw, &owner.Object); err != nil {
+			return fmt.Errorf("failed to decode %s: %s", req.Kind.Kind, err)
+		}
+		if owner.GetNamespace() == "" {
+			owner.SetNamespace(req.Namespace)
+		}
+		return s.validateOwner(req, owner, req.Kind.Kind)
+	}
+}
+
+// validateOwner 校验 owner 上的 ipkeeper 注解, 创建时还会拒绝未知的注解, 见 staticip.CheckUnknownAnnotations().
+func (s *WebhookServer) validateOwner(
+	req *admissionv1.AdmissionRequest,
+	owner apimmetav1.Object,
+	ownerKind string,
+) (err error) {
+	if req.Operation == admissionv1.Create {
+		if err = staticip.CheckUnknownAnnotations(owner.GetAnnotations()); err != nil {
+			return err
+		}
+	}
+	return s.sipHelper.ValidateOwner(owner, ownerKind)
+}
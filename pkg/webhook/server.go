@@ -0,0 +1,80 @@
+package webhook
+
+import (
+	"net/http"
+	"time"
+
+	restful "github.com/emicklei/go-restful"
+	"k8s.io/client-go/dynamic"
+	cgkuber "k8s.io/client-go/kubernetes"
+	cgcache "k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+
+	crdClientset "github.com/generals-space/crd-ipkeeper/pkg/client/clientset/versioned"
+	crdInformers "github.com/generals-space/crd-ipkeeper/pkg/client/informers/externalversions"
+	"github.com/generals-space/crd-ipkeeper/pkg/server"
+	"github.com/generals-space/crd-ipkeeper/pkg/staticip"
+)
+
+// WebhookServer validating admission webhook 服务,
+// 在 StaticIP, 以及带有 ipkeeper 注解的 Pod, Deployment 资源提交时校验其中的 IP 池与网关.
+type WebhookServer struct {
+	config     *server.Configuration
+	httpServer *http.Server
+	sipHelper  *staticip.Helper
+
+	// 检查 IP 冲突时从缓存中获取所有 StaticIP, 而不是每次校验都请求 apiserver.
+	crdInformerFactory crdInformers.SharedInformerFactory
+	sipSynced          cgcache.InformerSynced
+}
+
+// NewWebhookServer ...
+func NewWebhookServer(
+	config *server.Configuration,
+	kubeClient cgkuber.Interface,
+	crdClient crdClientset.Interface,
+	dynamicClient dynamic.Interface,
+) *WebhookServer {
+	s := &WebhookServer{
+		config:    config,
+		sipHelper: staticip.New(kubeClient, crdClient, dynamicClient, config.OwnerKinds),
+	}
+	s.crdInformerFactory = crdInformers.NewSharedInformerFactory(
+		crdClient, time.Second*30,
+	)
+	sipInformer := s.crdInformerFactory.Ipkeeper().V1().StaticIPs()
+	s.sipHelper.UseStaticIPLister(sipInformer.Lister())
+	s.sipSynced = sipInformer.Informer().HasSynced
+	s.createHandler()
+	return s
+}
+
+// Run 启动 https 服务器, apiserver 只能通过 https 调用 webhook.
+// @param stopCh: 同 controller.Run(), 收到退出信号时关闭.
+func (s *WebhookServer) Run(stopCh <-chan struct{}) {
+	s.crdInformerFactory.Start(stopCh)
+	// 缓存同步完成之前无法检查 IP 冲突.
+	if !cgcache.WaitForCacheSync(stopCh, s.sipSynced) {
+		klog.Errorf("failed to wait for staticip cache to sync")
+		return
+	}
+	klog.Infof("start webhook server on %s", s.config.WebhookBindAddress)
+	klog.Fatal(s.httpServer.ListenAndServeTLS(s.config.TLSCertFile, s.config.TLSKeyFile))
+}
+
+// createHandler 挂载 webhook 接口, 路径需要与 ValidatingWebhookConfiguration 中的一致.
+func (s *WebhookServer) createHandler() {
+	wsContainer := restful.NewContainer()
+
+	ws := new(restful.WebService)
+	ws.Consumes(restful.MIME_JSON).Produces(restful.MIME_JSON)
+	wsContainer.Add(ws)
+
+	ws.Route(ws.POST("/validate").To(s.handleValidate))
+
+	s.httpServer = &http.Server{
+		Addr:    s.config.WebhookBindAddress,
+		Handler: wsContainer,
+	}
+	return
+}